@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnauthenticated  = errors.New("unauthenticated")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// ParseNetworks parses comma separated cidrs, a bare ip is a single host network
+func ParseNetworks(s string) (networks []*net.IPNet, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil {
+				if ip.To4() != nil {
+					item += "/32"
+				} else {
+					item += "/128"
+				}
+			}
+		}
+		var network *net.IPNet
+		if _, network, err = net.ParseCIDR(item); err != nil {
+			return
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the identity of a client
+type Principal struct {
+	IP net.IP
+	// User is the authenticated user or the common name of tls client certificate, empty if unknown
+	User string
+}
+
+// Rule restricts principals matching it
+type Rule struct {
+	// Network matches principals by ip, nil for any
+	Network *net.IPNet
+	// User matches principals by user, empty for any
+	User string
+
+	ReadOnly bool
+	NoFlush  bool
+	// Prefixes restricts keys to these prefixes, empty for any
+	Prefixes []string
+}
+
+// ParseRule parses a rule in form of "<principal> <permission>...",
+// principal is one of "*", "ip:<cidr>" or "user:<name>",
+// permission is one of "readonly", "noflush" or "prefix=<prefix>|<prefix>..."
+func ParseRule(s string) (rule Rule, err error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		err = errors.New("invalid acl rule, should be principal and permissions: " + s)
+		return
+	}
+	switch principal := fields[0]; {
+	case principal == "*":
+	case strings.HasPrefix(principal, "ip:"):
+		var networks []*net.IPNet
+		if networks, err = ParseNetworks(strings.TrimPrefix(principal, "ip:")); err != nil {
+			return
+		}
+		if len(networks) != 1 {
+			err = errors.New("invalid acl rule principal: " + principal)
+			return
+		}
+		rule.Network = networks[0]
+	case strings.HasPrefix(principal, "user:") && len(principal) > len("user:"):
+		rule.User = strings.TrimPrefix(principal, "user:")
+	default:
+		err = errors.New("invalid acl rule principal: " + principal)
+		return
+	}
+	for _, perm := range fields[1:] {
+		switch {
+		case perm == "readonly":
+			rule.ReadOnly = true
+		case perm == "noflush":
+			rule.NoFlush = true
+		case strings.HasPrefix(perm, "prefix="):
+			for _, prefix := range strings.Split(strings.TrimPrefix(perm, "prefix="), "|") {
+				if prefix != "" {
+					rule.Prefixes = append(rule.Prefixes, prefix)
+				}
+			}
+			if len(rule.Prefixes) == 0 {
+				err = errors.New("invalid acl rule permission: " + perm)
+				return
+			}
+		default:
+			err = errors.New("invalid acl rule permission: " + perm)
+			return
+		}
+	}
+	return
+}
+
+// Matches returns whether rule applies to principal
+func (r Rule) Matches(p Principal) bool {
+	if r.Network != nil && (p.IP == nil || !r.Network.Contains(p.IP)) {
+		return false
+	}
+	if r.User != "" && r.User != p.User {
+		return false
+	}
+	return true
+}
+
+func (r Rule) allowsKey(key string) bool {
+	if len(r.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range r.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ACL is the network and command access control
+type ACL struct {
+	// Allow is the allowed networks, any if empty
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+	// Rules are all applied to matching principals
+	Rules []Rule
+	// Users are passwords by user, authentication is required if not empty
+	Users map[string]string
+}
+
+// ParseACL parses acl from comma separated networks and rules
+func ParseACL(allow, deny, rules string) (acl *ACL, err error) {
+	acl = &ACL{}
+	if acl.Allow, err = ParseNetworks(allow); err != nil {
+		return
+	}
+	if acl.Deny, err = ParseNetworks(deny); err != nil {
+		return
+	}
+	for _, item := range strings.Split(rules, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		var rule Rule
+		if rule, err = ParseRule(item); err != nil {
+			return
+		}
+		acl.Rules = append(acl.Rules, rule)
+	}
+	return
+}
+
+// LoadUsers loads users from a file of "user:password" lines, like memcached
+func LoadUsers(file string) (users map[string]string, err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+	users = map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		splits := strings.SplitN(line, ":", 2)
+		if len(splits) != 2 || splits[0] == "" {
+			// never echo the line, it may be a password without user
+			err = errors.New("invalid auth file line " + strconv.Itoa(n))
+			return
+		}
+		users[splits[0]] = splits[1]
+	}
+	err = s.Err()
+	return
+}
+
+// AllowConn returns whether a connection from ip is allowed
+func (a *ACL) AllowConn(ip net.IP) bool {
+	if ip == nil {
+		return true
+	}
+	if containsIP(a.Deny, ip) {
+		return false
+	}
+	return len(a.Allow) == 0 || containsIP(a.Allow, ip)
+}
+
+// AuthRequired returns whether principals must authenticate
+func (a *ACL) AuthRequired() bool {
+	return len(a.Users) > 0
+}
+
+// Authenticate checks password of user
+func (a *ACL) Authenticate(user, password string) bool {
+	expected, ok := a.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// isReadCommand returns whether command never modifies data or server state
+func isReadCommand(command string, args []string) bool {
+	switch command {
+	case "get", "gets", "version", "quit":
+		return true
+	case "stats":
+		return strings.Join(args, " ") != "slowlog reset"
+	}
+	return false
+}
+
+// isGlobalCommand returns whether command exposes or affects keys of all prefixes
+func isGlobalCommand(command string, args []string) bool {
+	switch command {
+	case "flush_all", "watch", "lru_crawler":
+		return true
+	case "stats":
+		return len(args) > 0 && (args[0] == "slowlog" || args[0] == "hotkeys")
+	}
+	return false
+}
+
+// Check checks whether principal is allowed to run command on keys
+func (a *ACL) Check(p Principal, command string, keys []string) error {
+	for _, rule := range a.Rules {
+		if !rule.Matches(p) {
+			continue
+		}
+		if rule.ReadOnly && !isReadCommand(command, keys) {
+			return ErrPermissionDenied
+		}
+		if rule.NoFlush && command == "flush_all" {
+			return ErrPermissionDenied
+		}
+		if len(rule.Prefixes) > 0 {
+			if isGlobalCommand(command, keys) {
+				return ErrPermissionDenied
+			}
+			// arguments of stats are subcommands rather than keys
+			if command == "stats" {
+				continue
+			}
+			for _, key := range keys {
+				if !rule.allowsKey(key) {
+					return ErrPermissionDenied
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var (
+	aclMu sync.RWMutex
+	acl   = &ACL{}
+)
+
+// currentACL returns the acl in effect
+func currentACL() *ACL {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	return acl
+}
+
+// setACL replaces the acl in effect
+func setACL(a *ACL) {
+	aclMu.Lock()
+	defer aclMu.Unlock()
+	acl = a
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("ip:10.0.0.0/8 readonly prefix=a:|b:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Network.String() != "10.0.0.0/8" || !rule.ReadOnly || rule.NoFlush || len(rule.Prefixes) != 2 {
+		t.Errorf("bad rule: %+v", rule)
+	}
+	if rule, err = ParseRule("user:batch noflush"); err != nil || rule.User != "batch" || !rule.NoFlush {
+		t.Errorf("bad rule: %+v %v", rule, err)
+	}
+	for _, s := range []string{"*", "user: readonly", "ip:10.0.0.0/33 readonly", "* write", "* prefix="} {
+		if _, err = ParseRule(s); err == nil {
+			t.Errorf("should fail: %s", s)
+		}
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	a, err := ParseACL("10.0.0.0/8, 192.168.1.1", "10.0.9.0/24", "user:reporting readonly, ip:10.0.0.0/8 noflush, user:app prefix=app:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.0.9.1":    false,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+	} {
+		if a.AllowConn(net.ParseIP(ip)) != allowed {
+			t.Errorf("bad network acl of %s", ip)
+		}
+	}
+
+	lan := net.ParseIP("10.0.0.1")
+	for _, c := range []struct {
+		p       Principal
+		command string
+		keys    []string
+		allowed bool
+	}{
+		{Principal{}, "flush_all", nil, true},
+		{Principal{IP: lan}, "flush_all", nil, false},
+		{Principal{IP: lan}, "set", []string{"a"}, true},
+		{Principal{User: "reporting"}, "get", []string{"a"}, true},
+		{Principal{User: "reporting"}, "delete", []string{"a"}, false},
+		{Principal{User: "app"}, "set", []string{"app:1"}, true},
+		{Principal{User: "app"}, "get", []string{"app:1", "other:1"}, false},
+		{Principal{User: "app"}, "flush_all", nil, false},
+		// watch streams keys, users and addresses of all clients
+		{Principal{}, "watch", nil, true},
+		{Principal{User: "reporting"}, "watch", nil, false},
+		{Principal{User: "app"}, "watch", nil, false},
+		{Principal{User: "app"}, "watch", []string{"app:"}, false},
+		// metadump dumps metadata of all keys
+		{Principal{}, "lru_crawler", []string{"metadump", "all"}, true},
+		{Principal{User: "reporting"}, "lru_crawler", []string{"metadump", "all"}, false},
+		{Principal{User: "app"}, "lru_crawler", []string{"metadump", "all"}, false},
+		{Principal{User: "reporting"}, "stats", []string{"slowlog"}, true},
+		{Principal{User: "reporting"}, "stats", []string{"slowlog", "reset"}, false},
+		{Principal{IP: lan}, "stats", []string{"slowlog", "reset"}, true},
+		{Principal{User: "app"}, "stats", nil, true},
+		{Principal{User: "app"}, "stats", []string{"shards"}, true},
+		// slowlog and hotkeys expose keys of all prefixes
+		{Principal{User: "app"}, "stats", []string{"slowlog"}, false},
+		{Principal{User: "app"}, "stats", []string{"hotkeys"}, false},
+	} {
+		if err := a.Check(c.p, c.command, c.keys); (err == nil) != c.allowed {
+			t.Errorf("bad command acl of %+v %s %v: %v", c.p, c.command, c.keys, err)
+		}
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "auth")
+	if err := ioutil.WriteFile(file, []byte("# users\nalice:pass:word\n\nbob:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := LoadUsers(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &ACL{Users: users}
+	if !a.AuthRequired() || !a.Authenticate("alice", "pass:word") || !a.Authenticate("bob", "secret") {
+		t.Errorf("bad users: %v", users)
+	}
+	if a.Authenticate("bob", "Secret") || a.Authenticate("carol", "") {
+		t.Error("should not authenticate")
+	}
+}
+
+func TestLoadUsersInvalidLine(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "auth")
+	if err := ioutil.WriteFile(file, []byte("# password without user\nsecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUsers(file); err == nil || err.Error() != "invalid auth file line 2" {
+		t.Errorf("LoadUsers should fail with line number: %v", err)
+	}
+}
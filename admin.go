@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminPreviewSize = 256
+	adminConfirmTTL  = time.Minute
+)
+
+var startedAt = time.Now()
+
+// Admin serves the admin http api
+type Admin struct {
+	Token string
+	Redis *redis.Client
+
+	mu           sync.Mutex
+	flushConfirm string
+	flushExpires time.Time
+}
+
+// KeyInfo is the result of a key lookup
+type KeyInfo struct {
+	Key      string `json:"key"`
+	Flags    string `json:"flags"`
+	Cas      string `json:"cas"`
+	TTL      int64  `json:"ttl"`
+	Size     int    `json:"size"`
+	Chunked  bool   `json:"chunked"`
+	Preview  string `json:"preview"`
+	Encoding string `json:"encoding,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+// Handler returns http handler of admin api, mounted at /admin/
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/info", a.handleInfo)
+	mux.HandleFunc("/admin/connections", a.handleConnections)
+	mux.HandleFunc("/admin/key", a.handleKey)
+	mux.HandleFunc("/admin/keys", a.handleKeys)
+	mux.HandleFunc("/admin/flush", a.handleFlush)
+	mux.HandleFunc("/admin/log_level", a.handleLogLevel)
+	mux.HandleFunc("/admin/slowlog", a.handleSlowlog)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		a.mu.Lock()
+		expected := a.Token
+		a.mu.Unlock()
+		auth := req.Header.Get("Authorization")
+		if expected == "" || !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(expected)) != 1 {
+			writeJSON(rw, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+// SetToken changes the bearer token, an empty token rejects all requests
+func (a *Admin) SetToken(token string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Token = token
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func writeError(rw http.ResponseWriter, code int, err error) {
+	writeJSON(rw, code, map[string]string{"error": err.Error()})
+}
+
+func allowMethods(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	rw.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(rw, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func (a *Admin) handleInfo(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet) {
+		return
+	}
+	st := map[string]string{}
+	for _, line := range stats.Report() {
+		fields := strings.Fields(line)
+		st[fields[0]] = fields[1]
+	}
+	pools := redisPools(a.Redis, shards)
+	info := map[string]interface{}{
+		"started_at":         startedAt,
+		"uptime":             int64(time.Since(startedAt).Seconds()),
+		"log_level":          logger.Level().String(),
+		"connections_active": metrics.ConnectionsActive.Load(),
+		"connections_total":  metrics.ConnectionsTotal.Load(),
+		"hits":               metrics.Hits.Load(),
+		"misses":             metrics.Misses.Load(),
+		"read_bytes":         metrics.BytesRead.Load(),
+		"written_bytes":      metrics.BytesWritten.Load(),
+		"parse_errors":       metrics.ParseErrors.Load(),
+		"redis_pool":         sumPoolStats(pools),
+		"stats":              st,
+	}
+	if shards != nil {
+		shardPools := map[string]*redis.PoolStats{}
+		for _, pool := range pools {
+			shardPools[pool.Shard] = pool.Client.PoolStats()
+		}
+		info["redis_shard_pools"] = shardPools
+	}
+	writeJSON(rw, http.StatusOK, info)
+}
+
+func (a *Admin) handleConnections(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if req.Method == http.MethodGet {
+		writeJSON(rw, http.StatusOK, sessions.List())
+		return
+	}
+	id, err := strconv.ParseInt(req.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	s := sessions.Get(id)
+	if s == nil {
+		writeJSON(rw, http.StatusNotFound, map[string]string{"error": "connection not found"})
+		return
+	}
+	if err = s.Kill(); err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, s.Info())
+}
+
+func (a *Admin) handleKey(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "missing key"})
+		return
+	}
+	ctx := req.Context()
+	store := newStore(a.Redis)
+	if req.Method == http.MethodDelete {
+		ok, err := store.Delete(ctx, key)
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, err)
+			return
+		}
+		if !ok {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "key not found"})
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"deleted": 1})
+		return
+	}
+	raw, item, err := store.LoadOpen(ctx, key)
+	var ttl time.Duration
+	if err == nil {
+		if ttl, err = store.client(key).TTL(ctx, key).Result(); err == nil && ttl == -2 {
+			// deleted since read
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			writeJSON(rw, http.StatusNotFound, map[string]string{"error": "key not found"})
+			return
+		}
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	info := KeyInfo{
+		Key:      key,
+		Flags:    item.Flags,
+		Cas:      item.Token,
+		TTL:      -1,
+		Size:     len(item.Value),
+		Encoding: raw.Encoding,
+		KeyID:    raw.KeyID,
+	}
+	if ttl > 0 {
+		info.TTL = int64(ttl.Seconds())
+	}
+	if item.Manifest != nil {
+		info.Chunked = true
+		info.Size = item.Manifest.Size
+		var preview []byte
+		// only the first chunk is read
+		_ = store.ReadChunks(ctx, key, item, func(chunk []byte) error {
+			preview = chunk
+			return io.EOF
+		})
+		item.Value = preview
+	}
+	if len(item.Value) > adminPreviewSize {
+		info.Preview = string(item.Value[:adminPreviewSize])
+	} else {
+		info.Preview = string(item.Value)
+	}
+	writeJSON(rw, http.StatusOK, info)
+}
+
+// escapeGlob escapes special characters of redis glob pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (a *Admin) handleKeys(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodDelete) {
+		return
+	}
+	prefix := req.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{"error": "missing prefix, use flush to delete all keys"})
+		return
+	}
+	ctx := req.Context()
+	store := newStore(a.Redis)
+	var deleted int
+	if err := store.Scan(ctx, escapeGlob(prefix)+"*", func(key string) error {
+		ok, err := store.Delete(ctx, key)
+		if ok {
+			deleted++
+		}
+		return err
+	}); err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"deleted": deleted})
+}
+
+// handleFlush flushes all keys in two steps, the first request returns a confirmation token for the second one
+func (a *Admin) handleFlush(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodPost) {
+		return
+	}
+	confirm := req.URL.Query().Get("confirm")
+
+	a.mu.Lock()
+	confirmed := confirm != "" && confirm == a.flushConfirm && time.Now().Before(a.flushExpires)
+	if confirmed {
+		a.flushConfirm = ""
+	} else {
+		a.flushConfirm = NewToken()
+		a.flushExpires = time.Now().Add(adminConfirmTTL)
+	}
+	next := a.flushConfirm
+	a.mu.Unlock()
+
+	if !confirmed {
+		writeJSON(rw, http.StatusAccepted, map[string]interface{}{
+			"confirm":    next,
+			"expires_in": int64(adminConfirmTTL.Seconds()),
+		})
+		return
+	}
+	if err := newStore(a.Redis).Flush(context.Background()); err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"flushed": true})
+}
+
+func (a *Admin) handleLogLevel(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if req.Method == http.MethodPut {
+		level, err := ParseLevel(req.URL.Query().Get("level"))
+		if err != nil {
+			writeError(rw, http.StatusBadRequest, err)
+			return
+		}
+		logger.SetLevel(level)
+		logger.Warn("log level changed", "level", level)
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"level": logger.Level().String()})
+}
+
+func (a *Admin) handleSlowlog(rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	if req.Method == http.MethodDelete {
+		slowlog.Reset()
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"reset": true})
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"threshold_ms": float64(slowlog.Threshold().Microseconds()) / 1000,
+		"entries":      slowlog.Entries(),
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEscapeGlob(t *testing.T) {
+	if s := escapeGlob(`a*b?c[d]e\f`); s != `a\*b\?c\[d\]e\\f` {
+		t.Errorf("escapeGlob %s", s)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := (&Admin{Token: "secret"}).Handler()
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/admin/log_level", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Code %d", rw.Code)
+	}
+
+	// the bearer scheme is required
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/log_level", nil)
+	req.Header.Set("Authorization", "secret")
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("Code %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/admin/log_level", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Code %d", rw.Code)
+	}
+}
+
+func TestAdminKey(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	h := (&Admin{Token: "secret", Redis: client}).Handler()
+	get := func(key string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/key?key="+key, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := get("missing"); rw.Code != http.StatusNotFound {
+		t.Errorf("Code %d", rw.Code)
+	}
+	if err := (&Store{Redis: client}).Set(context.Background(), "a", &Item{Value: []byte("hello"), Flags: "3", Token: "7"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rw := get("a")
+	var info KeyInfo
+	if err := json.Unmarshal(rw.Body.Bytes(), &info); rw.Code != http.StatusOK || err != nil {
+		t.Fatalf("Code %d, %v", rw.Code, err)
+	}
+	if info.Size != 5 || info.Flags != "3" || info.Cas != "7" || info.Preview != "hello" || info.TTL <= 0 {
+		t.Errorf("bad info: %+v", info)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-redis/redis/v8"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditQueueSize = 8192
+	auditBatchSize = 256
+)
+
+// AuditRecord is a record of a mutating command
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Conn      int64     `json:"conn"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Command   string    `json:"command"`
+	Key       string    `json:"key,omitempty"`
+	ValueSize int       `json:"value_size"`
+	// ValueHash is hex encoded sha256 of value, absent for commands without value
+	ValueHash string `json:"value_hash,omitempty"`
+	// Delta is the amount of incr and decr
+	Delta int64 `json:"delta,omitempty"`
+	// Exptime is the expiration of storage commands and touch
+	Exptime int64  `json:"exptime,omitempty"`
+	Result  string `json:"result"`
+}
+
+// isMutatingCommand returns whether command is audited
+func isMutatingCommand(command string) bool {
+	switch command {
+	case "set", "cas", "add", "replace", "append", "prepend", "incr", "decr", "delete", "touch", "flush_all":
+		return true
+	}
+	return false
+}
+
+// hashValue returns hex encoded sha256 of value
+func hashValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditSink writes encoded records, one json object per record
+type AuditSink interface {
+	Write(records [][]byte) error
+	Close() error
+}
+
+// FileAuditSink appends records to a file as lines, the file is rotated when it exceeds MaxSize
+type FileAuditSink struct {
+	Path string
+	// MaxSize is the max file size in bytes, never rotated if 0
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept, named as path.1, path.2, ...
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileAuditSink opens or creates the file for appending
+func NewFileAuditSink(path string, maxSize int64, maxBackups int) (s *FileAuditSink, err error) {
+	s = &FileAuditSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err = s.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (s *FileAuditSink) open() (err error) {
+	if s.file, err = os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = s.file.Stat(); err != nil {
+		_ = s.file.Close()
+		return
+	}
+	s.size = info.Size()
+	return
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, the oldest backup is removed
+func (s *FileAuditSink) rotate() (err error) {
+	if err = s.file.Close(); err != nil {
+		return
+	}
+	// reopen even if renaming failed, to keep writing records
+	defer func() {
+		if errOpen := s.open(); err == nil {
+			err = errOpen
+		}
+	}()
+	if s.MaxBackups > 0 {
+		for i := s.MaxBackups - 1; i > 0; i-- {
+			from := s.Path + "." + strconv.Itoa(i)
+			if _, err = os.Stat(from); err == nil {
+				if err = os.Rename(from, s.Path+"."+strconv.Itoa(i+1)); err != nil {
+					return
+				}
+			}
+		}
+		err = os.Rename(s.Path, s.Path+".1")
+	} else {
+		err = os.Remove(s.Path)
+	}
+	return
+}
+
+func (s *FileAuditSink) Write(records [][]byte) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buf []byte
+	for _, record := range records {
+		buf = append(buf, record...)
+		buf = append(buf, '\n')
+	}
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(buf)) > s.MaxSize {
+		if err = s.rotate(); err != nil {
+			return
+		}
+	}
+	var n int
+	n, err = s.file.Write(buf)
+	s.size += int64(n)
+	return
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// StreamAuditSink adds records to a redis stream, as field "record"
+type StreamAuditSink struct {
+	Redis *redis.Client
+	Key   string
+	// MaxLen approximately trims the stream, never trimmed if 0
+	MaxLen int64
+
+	ownsRedis bool
+}
+
+func (s *StreamAuditSink) Write(records [][]byte) error {
+	ctx := context.Background()
+	_, err := s.Redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, record := range records {
+			p.XAdd(ctx, &redis.XAddArgs{
+				Stream: s.Key,
+				MaxLen: s.MaxLen,
+				Approx: true,
+				Values: []interface{}{"record", record},
+			})
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *StreamAuditSink) Close() error {
+	if s.ownsRedis {
+		return s.Redis.Close()
+	}
+	return nil
+}
+
+// Auditor writes audit records to sink asynchronously, records are dropped if the queue is full
+type Auditor struct {
+	Sink AuditSink
+
+	queue chan *AuditRecord
+}
+
+// NewAuditor creates an auditor, Run must be called to write records
+func NewAuditor(sink AuditSink) *Auditor {
+	return &Auditor{
+		Sink:  sink,
+		queue: make(chan *AuditRecord, auditQueueSize),
+	}
+}
+
+// Log queues a record without blocking, a is nil-safe
+func (a *Auditor) Log(r *AuditRecord) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.queue <- r:
+	default:
+		stats.AuditDropped.Add(1)
+	}
+}
+
+// Run writes queued records in batches until ctx is done, then writes the remaining ones and closes sink
+func (a *Auditor) Run(ctx context.Context) {
+	defer a.Sink.Close()
+
+	var batch [][]byte
+	add := func(r *AuditRecord) {
+		buf, err := json.Marshal(r)
+		if err != nil {
+			stats.AuditDropped.Add(1)
+			return
+		}
+		batch = append(batch, buf)
+	}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.Sink.Write(batch); err != nil {
+			stats.AuditDropped.Add(int64(len(batch)))
+			logger.Error("failed to write audit records", "records", len(batch), "err", err)
+		} else {
+			stats.AuditRecords.Add(int64(len(batch)))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case r := <-a.queue:
+					if add(r); len(batch) >= auditBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		case r := <-a.queue:
+			// write what's queued now, records are not held back waiting for more
+			add(r)
+		drain:
+			for len(batch) < auditBatchSize {
+				select {
+				case r = <-a.queue:
+					add(r)
+				default:
+					break drain
+				}
+			}
+			flush()
+		}
+	}
+}
+
+var auditor *Auditor
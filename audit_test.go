@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewFileAuditSink(path, 9, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"1234", "5678", "abcd", "efgh"} {
+		if err = s.Write([][]byte{[]byte(record)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		path:        "efgh\n",
+		path + ".1": "abcd\n",
+		path + ".2": "5678\n",
+	} {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Errorf("bad content of %s: %q", name, buf)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("oldest backup should be removed")
+	}
+
+	// reopened file is appended
+	if s, err = NewFileAuditSink(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Write([][]byte{[]byte("ijkl"), []byte("mnop")}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	if buf, _ := ioutil.ReadFile(path); string(buf) != "efgh\nijkl\nmnop\n" {
+		t.Errorf("bad content after reopen: %q", buf)
+	}
+}
+
+type testAuditSink struct {
+	mu      sync.Mutex
+	records []string
+	closed  bool
+}
+
+func (s *testAuditSink) Write(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range records {
+		s.records = append(s.records, string(record))
+	}
+	return nil
+}
+
+func (s *testAuditSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	var a *Auditor
+	a.Log(&AuditRecord{})
+
+	sink := &testAuditSink{}
+	a = NewAuditor(sink)
+	for _, key := range []string{"a", "b", "c"} {
+		a.Log(&AuditRecord{Command: "set", Key: key, ValueSize: 5, ValueHash: hashValue([]byte("hello")), Result: "STORED"})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	a.Run(ctx)
+
+	if !sink.closed {
+		t.Error("sink should be closed")
+	}
+	if len(sink.records) != 3 {
+		t.Fatalf("bad records: %v", sink.records)
+	}
+	var r AuditRecord
+	if err := json.Unmarshal([]byte(sink.records[2]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Key != "c" || r.ValueHash != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("bad record: %s", sink.records[2])
+	}
+	if strings.Contains(sink.records[2], "delta") {
+		t.Errorf("empty fields should be omitted: %s", sink.records[2])
+	}
+}
+
+func TestIsMutatingCommand(t *testing.T) {
+	for _, command := range []string{"set", "cas", "append", "incr", "delete", "touch", "flush_all"} {
+		if !isMutatingCommand(command) {
+			t.Errorf("%s should be mutating", command)
+		}
+	}
+	for _, command := range []string{"get", "gets", "stats", "version"} {
+		if isMutatingCommand(command) {
+			t.Errorf("%s should not be mutating", command)
+		}
+	}
+}
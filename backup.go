@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang/snappy"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupFormat identifies backup files
+	BackupFormat = "redmemd-backup"
+	// BackupVersion is the version of backup files written, files of newer versions are rejected
+	BackupVersion = 2
+
+	// backupExportCheckpoint and backupImportCheckpoint are appended to backup file name for the checkpoint of
+	// an unfinished export or import, they never resume each other
+	backupExportCheckpoint = ".export-progress"
+	backupImportCheckpoint = ".import-progress"
+	// backupCheckpointRecords is the number of records imported between checkpoints
+	backupCheckpointRecords = 100
+)
+
+var (
+	// backupSnappyMagic is the stream identifier of snappy framing format
+	backupSnappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+
+	ErrInvalidBackup = errors.New("invalid backup file")
+)
+
+// BackupHeader is the first line of a backup file
+type BackupHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Prefix     string    `json:"prefix,omitempty"`
+}
+
+// BackupRecord is an item in a backup file
+type BackupRecord struct {
+	Key   string `json:"key"`
+	Flags string `json:"flags"`
+	Cas   string `json:"cas"`
+	// ExpiresAt is the expiration in unix milliseconds, 0 if never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// TTL is the remaining time to live in milliseconds when exported, only in files of version 1
+	TTL   int64  `json:"ttl_ms,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// unixMilli returns t in unix milliseconds
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// TTLAt returns the remaining time to live at now, 0 if never expires, expired is true if no time is left
+func (rec *BackupRecord) TTLAt(now time.Time) (ttl time.Duration, expired bool) {
+	if rec.ExpiresAt == 0 {
+		return
+	}
+	if ttl = time.Duration(rec.ExpiresAt-unixMilli(now)) * time.Millisecond; ttl <= 0 {
+		return 0, true
+	}
+	return
+}
+
+// BackupWriter writes header and records as json lines, optionally compressed with snappy framing format
+type BackupWriter struct {
+	w      *bufio.Writer
+	snappy *snappy.Writer
+	enc    *json.Encoder
+}
+
+// NewBackupWriter creates a writer, header is omitted if nil, for appending to an existing file
+func NewBackupWriter(w io.Writer, header *BackupHeader, compress bool) (bw *BackupWriter, err error) {
+	bw = &BackupWriter{}
+	if compress {
+		bw.snappy = snappy.NewBufferedWriter(w)
+		w = bw.snappy
+	}
+	bw.w = bufio.NewWriter(w)
+	bw.enc = json.NewEncoder(bw.w)
+	if header != nil {
+		err = bw.enc.Encode(header)
+	}
+	return
+}
+
+// Write writes a record
+func (bw *BackupWriter) Write(rec *BackupRecord) error {
+	return bw.enc.Encode(rec)
+}
+
+// Flush writes buffered records to the underlying writer
+func (bw *BackupWriter) Flush() (err error) {
+	if err = bw.w.Flush(); err != nil {
+		return
+	}
+	if bw.snappy != nil {
+		err = bw.snappy.Flush()
+	}
+	return
+}
+
+// Close flushes buffered records, the underlying writer is not closed
+func (bw *BackupWriter) Close() (err error) {
+	if err = bw.w.Flush(); err != nil {
+		return
+	}
+	if bw.snappy != nil {
+		err = bw.snappy.Close()
+	}
+	return
+}
+
+// BackupReader reads a backup file, compression is detected automatically
+type BackupReader struct {
+	Header BackupHeader
+	dec    *json.Decoder
+}
+
+// NewBackupReader creates a reader and reads the header
+func NewBackupReader(r io.Reader) (br *BackupReader, err error) {
+	buf := bufio.NewReader(r)
+	if magic, _ := buf.Peek(len(backupSnappyMagic)); bytes.Equal(magic, backupSnappyMagic) {
+		r = snappy.NewReader(buf)
+	} else {
+		r = buf
+	}
+	br = &BackupReader{dec: json.NewDecoder(r)}
+	if err = br.dec.Decode(&br.Header); err != nil {
+		err = ErrInvalidBackup
+		return
+	}
+	if br.Header.Format != BackupFormat {
+		err = ErrInvalidBackup
+		return
+	}
+	if br.Header.Version > BackupVersion {
+		err = errors.New("unsupported backup version: " + strconv.Itoa(br.Header.Version))
+		return
+	}
+	return
+}
+
+// Next returns the next record, or io.EOF
+func (br *BackupReader) Next() (rec *BackupRecord, err error) {
+	rec = &BackupRecord{}
+	if err = br.dec.Decode(rec); err != nil {
+		rec = nil
+		return
+	}
+	if rec.TTL > 0 {
+		// version 1 records expire relative to the time of export
+		rec.ExpiresAt = unixMilli(br.Header.ExportedAt) + rec.TTL
+		rec.TTL = 0
+	}
+	return
+}
+
+// backupCheckpoint records progress of an unfinished export or import
+type backupCheckpoint struct {
+	// Shard is the index of shard to continue export from, if sharded
+	Shard int `json:"shard,omitempty"`
+	// Cursor is the scan cursor to continue export from
+	Cursor uint64 `json:"cursor,omitempty"`
+	// Offset is the size of backup file exported so far
+	Offset int64 `json:"offset,omitempty"`
+	// Compress is whether the export is compressed
+	Compress bool `json:"compress,omitempty"`
+	// Records is the number of records exported or read
+	Records int64 `json:"records"`
+}
+
+// loadBackupCheckpoint loads checkpoint of file with suffix, ok is false if there is none
+func loadBackupCheckpoint(file string, suffix string) (cp backupCheckpoint, ok bool, err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(file + suffix); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(buf, &cp); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// saveBackupCheckpoint replaces checkpoint of file with suffix atomically
+func saveBackupCheckpoint(file string, suffix string, cp backupCheckpoint) (err error) {
+	var buf []byte
+	if buf, err = json.Marshal(cp); err != nil {
+		return
+	}
+	tmp := file + suffix + ".tmp"
+	if err = ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, file+suffix)
+}
+
+// offsetWriter counts bytes written
+type offsetWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = ow.w.Write(p)
+	ow.offset += int64(n)
+	return
+}
+
+// offsetReader counts bytes read
+type offsetReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (or *offsetReader) Read(p []byte) (n int, err error) {
+	n, err = or.r.Read(p)
+	or.offset += int64(n)
+	return
+}
+
+// ExportRecord reads key as a record, or returns ErrNotFound
+func (s *Store) ExportRecord(ctx context.Context, key string) (rec *BackupRecord, err error) {
+	var ttl time.Duration
+	if ttl, err = s.client(key).PTTL(ctx, key).Result(); err != nil {
+		return
+	}
+	var item *Item
+	if item, err = s.Get(ctx, key); err != nil {
+		return
+	}
+	rec = &BackupRecord{Key: key, Flags: item.Flags, Cas: item.Token, Value: item.Value}
+	if ttl > 0 {
+		rec.ExpiresAt = unixMilli(time.Now().Add(ttl))
+	}
+	return
+}
+
+// ImportRecord writes a record expiring at its original expiration, an existing item is kept unless overwrite, an expired record is skipped
+func (s *Store) ImportRecord(ctx context.Context, rec *BackupRecord, overwrite bool) (ok bool, err error) {
+	ttl, expired := rec.TTLAt(time.Now())
+	if expired {
+		return
+	}
+	item := &Item{Value: rec.Value, Flags: rec.Flags, Token: rec.Cas}
+	if item.Token == "" {
+		item.Token = NewToken()
+	}
+	if item.Flags == "" {
+		item.Flags = "0"
+	}
+	err = s.WithLock(ctx, rec.Key, func(ctx context.Context) (err error) {
+		if !overwrite {
+			var n int64
+			if n, err = s.client(rec.Key).Exists(ctx, rec.Key).Result(); err != nil || n > 0 {
+				return
+			}
+		}
+		if err = s.Set(ctx, rec.Key, item, ttl); err != nil {
+			return
+		}
+		ok = true
+		return
+	})
+	return
+}
+
+// runExport exports items with an optional prefix to file, continues an unfinished export if backup.resume is set
+func runExport(args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("usage: redmemd export <file> [prefix]")
+	}
+	file := args[0]
+	var prefix string
+	if len(args) > 1 {
+		prefix = args[1]
+	}
+
+	var cp backupCheckpoint
+	var resumed bool
+	if optBackupResume {
+		if cp, resumed, err = loadBackupCheckpoint(file, backupExportCheckpoint); err != nil {
+			return
+		}
+	}
+
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx := context.Background()
+	store := newStore(client)
+
+	var f *os.File
+	var header *BackupHeader
+	if resumed {
+		// records written after the last checkpoint are discarded and exported again
+		if f, err = os.OpenFile(file, os.O_WRONLY, 0644); err != nil {
+			return
+		}
+		if err = f.Truncate(cp.Offset); err != nil {
+			return
+		}
+		if _, err = f.Seek(cp.Offset, io.SeekStart); err != nil {
+			return
+		}
+		logger.Info("resuming export", "file", file, "records", cp.Records)
+	} else {
+		if f, err = os.Create(file); err != nil {
+			return
+		}
+		cp = backupCheckpoint{Compress: optBackupCompress}
+		header = &BackupHeader{Format: BackupFormat, Version: BackupVersion, ExportedAt: time.Now().UTC(), Prefix: prefix}
+	}
+	defer f.Close()
+
+	ow := &offsetWriter{w: f, offset: cp.Offset}
+	var bw *BackupWriter
+	if bw, err = NewBackupWriter(ow, header, cp.Compress); err != nil {
+		return
+	}
+
+	var match string
+	if prefix != "" {
+		match = escapeGlob(prefix) + "*"
+	}
+
+	var (
+		keys     []string
+		cursor   = cp.Cursor
+		reported = time.Now()
+		clients  = store.Clients()
+	)
+	for cp.Shard < len(clients) {
+		if keys, cursor, err = clients[cp.Shard].Scan(ctx, cursor, match, 100).Result(); err != nil {
+			return
+		}
+		for _, key := range keys {
+			if isInternalKey(key) {
+				continue
+			}
+			var rec *BackupRecord
+			if rec, err = store.ExportRecord(ctx, key); err != nil {
+				if err == ErrNotFound {
+					// expired or deleted after scanned
+					err = nil
+					continue
+				}
+				if err == ErrInvalidFlags || err == ErrCorruptedValue || err == ErrUnknownKey {
+					logger.Warn("skipped", "key", key, "err", err)
+					err = nil
+					continue
+				}
+				return
+			}
+			if err = bw.Write(rec); err != nil {
+				return
+			}
+			cp.Records++
+		}
+		if cursor == 0 {
+			// continue with the next shard
+			cp.Shard++
+		}
+		if cp.Shard == len(clients) {
+			break
+		}
+		// checkpoint after each batch, the file is complete up to offset
+		if err = bw.Flush(); err != nil {
+			return
+		}
+		cp.Cursor, cp.Offset = cursor, ow.offset
+		if err = saveBackupCheckpoint(file, backupExportCheckpoint, cp); err != nil {
+			return
+		}
+		if time.Since(reported) >= optBackupProgressInterval {
+			reported = time.Now()
+			logger.Info("exporting", "records", cp.Records, "bytes", ow.offset)
+		}
+	}
+
+	if err = bw.Close(); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = os.Remove(file + backupExportCheckpoint); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	logger.Info("exported", "records", cp.Records, "bytes", ow.offset)
+	return
+}
+
+// runImport imports items with an optional prefix from file, continues an unfinished import if backup.resume is set
+func runImport(args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("usage: redmemd import <file> [prefix]")
+	}
+	file := args[0]
+	var prefix string
+	if len(args) > 1 {
+		prefix = args[1]
+	}
+
+	var cp backupCheckpoint
+	if optBackupResume {
+		var resumed bool
+		if cp, resumed, err = loadBackupCheckpoint(file, backupImportCheckpoint); err != nil {
+			return
+		}
+		if resumed {
+			logger.Info("resuming import", "file", file, "records", cp.Records)
+		}
+	}
+
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx := context.Background()
+	store := newStore(client)
+
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	or := &offsetReader{r: f}
+	var br *BackupReader
+	if br, err = NewBackupReader(or); err != nil {
+		return
+	}
+	logger.Info("importing", "file", file, "exported_at", br.Header.ExportedAt, "version", br.Header.Version)
+
+	var (
+		read     int64
+		imported int64
+		expired  int64
+		skipped  = cp.Records
+		reported = time.Now()
+	)
+	for {
+		var rec *BackupRecord
+		if rec, err = br.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		read++
+		if read <= skipped {
+			// imported before resuming
+			continue
+		}
+		if strings.HasPrefix(rec.Key, prefix) && !isInternalKey(rec.Key) {
+			var ok bool
+			if ok, err = store.ImportRecord(ctx, rec, true); err != nil {
+				if err != ErrInvalidFlags {
+					return
+				}
+				logger.Warn("skipped", "key", rec.Key, "err", err)
+				err = nil
+			} else if ok {
+				imported++
+			} else {
+				expired++
+			}
+		}
+		if read%backupCheckpointRecords == 0 {
+			if err = saveBackupCheckpoint(file, backupImportCheckpoint, backupCheckpoint{Records: read}); err != nil {
+				return
+			}
+		}
+		if time.Since(reported) >= optBackupProgressInterval {
+			reported = time.Now()
+			var percent float64
+			if size > 0 {
+				percent = float64(or.offset) * 100 / float64(size)
+			}
+			logger.Info("importing", "records", read, "imported", imported, "expired", expired, "progress", strconv.FormatFloat(percent, 'f', 1, 64)+"%")
+		}
+	}
+
+	if err = os.Remove(file + backupImportCheckpoint); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	logger.Info("imported", "records", read, "imported", imported, "expired", expired)
+	return
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupWriterReader(t *testing.T) {
+	exportedAt := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		bw, err := NewBackupWriter(&buf, &BackupHeader{Format: BackupFormat, Version: BackupVersion, ExportedAt: exportedAt}, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = bw.Write(&BackupRecord{Key: "a", Flags: "1", Cas: "10", ExpiresAt: 1622534401500, Value: []byte("hello")})
+		if err = bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// appending after resuming
+		if bw, err = NewBackupWriter(&buf, nil, compress); err != nil {
+			t.Fatal(err)
+		}
+		_ = bw.Write(&BackupRecord{Key: "b", Flags: "0", Cas: "11", Value: []byte{0, 1, 2}})
+		if err = bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if compress != bytes.HasPrefix(buf.Bytes(), backupSnappyMagic) {
+			t.Errorf("compress %v: bad file %q", compress, buf.Bytes())
+		}
+
+		br, err := NewBackupReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if br.Header.Version != BackupVersion || !br.Header.ExportedAt.Equal(exportedAt) {
+			t.Errorf("bad header: %+v", br.Header)
+		}
+		rec, err := br.Next()
+		if err != nil || rec.Key != "a" || rec.Flags != "1" || rec.Cas != "10" || rec.ExpiresAt != 1622534401500 || string(rec.Value) != "hello" {
+			t.Errorf("bad record: %+v, %v", rec, err)
+		}
+		rec, err = br.Next()
+		if err != nil || rec.Key != "b" || rec.ExpiresAt != 0 || !bytes.Equal(rec.Value, []byte{0, 1, 2}) {
+			t.Errorf("bad record: %+v, %v", rec, err)
+		}
+		if _, err = br.Next(); err != io.EOF {
+			t.Errorf("should be EOF: %v", err)
+		}
+	}
+}
+
+func TestBackupReaderVersion1(t *testing.T) {
+	br, err := NewBackupReader(bytes.NewReader([]byte("{\"format\":\"redmemd-backup\",\"version\":1,\"exported_at\":\"2021-06-01T00:00:00Z\"}\n" +
+		"{\"key\":\"a\",\"flags\":\"0\",\"cas\":\"1\",\"ttl_ms\":1500,\"value\":\"aGk=\"}\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ttl of version 1 is relative to the time of export
+	if rec, err := br.Next(); err != nil || rec.ExpiresAt != 1622505601500 || rec.TTL != 0 {
+		t.Errorf("bad record: %+v, %v", rec, err)
+	}
+}
+
+func TestBackupRecordTTLAt(t *testing.T) {
+	exportedAt := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	rec := &BackupRecord{ExpiresAt: unixMilli(exportedAt.Add(time.Hour))}
+	// the remaining ttl counts from export, not import
+	if ttl, expired := rec.TTLAt(exportedAt.Add(time.Minute * 20)); ttl != time.Minute*40 || expired {
+		t.Errorf("bad ttl: %v, %v", ttl, expired)
+	}
+	if ttl, expired := rec.TTLAt(exportedAt.Add(time.Hour * 24)); ttl != 0 || !expired {
+		t.Errorf("should be expired: %v, %v", ttl, expired)
+	}
+	if ttl, expired := (&BackupRecord{}).TTLAt(exportedAt); ttl != 0 || expired {
+		t.Errorf("should never expire: %v, %v", ttl, expired)
+	}
+}
+
+func TestBackupReaderInvalid(t *testing.T) {
+	if _, err := NewBackupReader(bytes.NewReader([]byte("{\"key\":\"a\"}\n"))); err != ErrInvalidBackup {
+		t.Errorf("should be invalid: %v", err)
+	}
+	if _, err := NewBackupReader(bytes.NewReader([]byte("{\"format\":\"redmemd-backup\",\"version\":99}\n"))); err == nil {
+		t.Error("newer version should be rejected")
+	}
+}
+
+func TestBackupCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redmemd-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backup")
+	if _, ok, err := loadBackupCheckpoint(file, backupExportCheckpoint); ok || err != nil {
+		t.Errorf("should have no checkpoint: %v", err)
+	}
+	if err = saveBackupCheckpoint(file, backupExportCheckpoint, backupCheckpoint{Cursor: 42, Offset: 100, Compress: true, Records: 7}); err != nil {
+		t.Fatal(err)
+	}
+	cp, ok, err := loadBackupCheckpoint(file, backupExportCheckpoint)
+	if !ok || err != nil || cp.Cursor != 42 || cp.Offset != 100 || !cp.Compress || cp.Records != 7 {
+		t.Errorf("bad checkpoint: %+v, %v, %v", cp, ok, err)
+	}
+	// an import never resumes from an export checkpoint
+	if _, ok, err = loadBackupCheckpoint(file, backupImportCheckpoint); ok || err != nil {
+		t.Errorf("should have no import checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheEntryOverhead is the estimated memory overhead of a cache entry besides key and value
+	cacheEntryOverhead = 128
+
+	invalidateChannel = "__redis__:invalidate"
+	// invalidationTimeout is the timeout of a silent invalidation connection, it's pinged at a third of it
+	invalidationTimeout = time.Second * 30
+)
+
+// cacheKey is a key of a shard, shard is empty if not sharded
+type cacheKey struct {
+	shard string
+	key   string
+}
+
+type cacheEntry struct {
+	cacheKey
+	item *Item
+	size int
+}
+
+// Cache is a bounded in-memory LRU cache of items, kept coherent by redis client tracking,
+// entries are kept by shard, each shard is cached only while its invalidation messages are being received
+type Cache struct {
+	// Prefixes limits cached keys, empty means all keys
+	Prefixes []string
+	// MaxBytes is the memory limit of cache
+	MaxBytes int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+	bytes   int
+	gen     uint64
+	// online is whether invalidation messages of each shard are being received
+	online map[string]bool
+}
+
+// NewCache creates a new cache
+func NewCache(maxBytes int, prefixes []string) *Cache {
+	return &Cache{
+		Prefixes: prefixes,
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[cacheKey]*list.Element{},
+		online:   map[string]bool{},
+	}
+}
+
+// Cacheable returns whether key should be cached
+func (c *Cache) Cacheable(key string) bool {
+	if isInternalKey(key) {
+		return false
+	}
+	if len(c.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range c.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns cached item of key of shard
+func (c *Cache) Get(shard, key string) *Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.online[shard] {
+		return nil
+	}
+	if el := c.entries[cacheKey{shard: shard, key: key}]; el != nil {
+		c.lru.MoveToFront(el)
+		stats.L1Hits.Add(1)
+		return el.Value.(*cacheEntry).item
+	}
+	stats.L1Misses.Add(1)
+	return nil
+}
+
+// Generation returns the invalidation generation, to be passed to Put
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// Put caches item of key of shard, unless there was an invalidation after gen was taken
+func (c *Cache) Put(shard, key string, item *Item, gen uint64) {
+	size := len(key) + len(item.Value) + len(item.Flags) + len(item.Token) + cacheEntryOverhead
+	if size > c.MaxBytes || !c.Cacheable(key) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || !c.online[shard] {
+		return
+	}
+	ck := cacheKey{shard: shard, key: key}
+	c.remove(ck)
+	c.entries[ck] = c.lru.PushFront(&cacheEntry{cacheKey: ck, item: item, size: size})
+	c.bytes += size
+	for c.bytes > c.MaxBytes {
+		c.remove(c.lru.Back().Value.(*cacheEntry).cacheKey)
+		stats.L1Evictions.Add(1)
+	}
+}
+
+func (c *Cache) remove(ck cacheKey) {
+	if el := c.entries[ck]; el != nil {
+		c.lru.Remove(el)
+		delete(c.entries, ck)
+		c.bytes -= el.Value.(*cacheEntry).size
+	}
+}
+
+// Invalidate removes keys of all shards from cache, a key may be cached under a shard it was moved from
+func (c *Cache) Invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if !c.Cacheable(key) {
+			continue
+		}
+		c.gen++
+		for shard := range c.online {
+			c.remove(cacheKey{shard: shard, key: key})
+		}
+		stats.L1Invalidations.Add(1)
+	}
+}
+
+// Purge removes all keys from cache
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge()
+}
+
+func (c *Cache) purge() {
+	c.gen++
+	c.lru.Init()
+	c.entries = map[cacheKey]*list.Element{}
+	c.bytes = 0
+	stats.L1Purges.Add(1)
+}
+
+// PurgeShard removes all keys of shard from cache
+func (c *Cache) PurgeShard(shard string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgeShard(shard)
+}
+
+func (c *Cache) purgeShard(shard string) {
+	c.gen++
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if ck := el.Value.(*cacheEntry).cacheKey; ck.shard == shard {
+			c.remove(ck)
+		}
+		el = next
+	}
+	stats.L1Purges.Add(1)
+}
+
+// setOnline purges keys of shard and enables or disables caching them
+func (c *Cache) setOnline(shard string, online bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgeShard(shard)
+	c.online[shard] = online
+}
+
+// RunInvalidation subscribes to redis invalidation messages of shard in BCAST mode, until ctx is done,
+// shard is empty if not sharded; keys of shard are cached only while subscribed
+func (c *Cache) RunInvalidation(ctx context.Context, shard string, opts *redis.Options) {
+	for {
+		err := c.subscribeInvalidation(ctx, shard, opts)
+		// serve keys of shard from redis until subscribed again
+		c.setOnline(shard, false)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("invalidation error", "shard", shard, "err", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// subscribeInvalidation subscribes to invalidation messages with a connection of its own, until connection fails,
+// it speaks resp directly, go-redis can't deliver invalidation messages of flushes, which have a nil payload
+func (c *Cache) subscribeInvalidation(ctx context.Context, shard string, opts *redis.Options) (err error) {
+	var conn net.Conn
+	if conn, err = dialRedis(ctx, opts); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		_ = conn.Close()
+	}()
+
+	rc := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	_ = conn.SetDeadline(time.Now().Add(invalidationTimeout))
+	if opts.Password != "" {
+		if opts.Username != "" {
+			_, err = rc.Do("auth", opts.Username, opts.Password)
+		} else {
+			_, err = rc.Do("auth", opts.Password)
+		}
+		if err != nil {
+			return
+		}
+	}
+	var id interface{}
+	if id, err = rc.Do("client", "id"); err != nil {
+		return
+	}
+	args := []string{"client", "tracking", "on", "redirect", strconv.FormatInt(respInt(id), 10), "bcast"}
+	for _, prefix := range c.Prefixes {
+		args = append(args, "prefix", prefix)
+	}
+	if _, err = rc.Do(args...); err != nil {
+		return
+	}
+	// invalidation messages are received only once subscribed, confirmed by the reply
+	if _, err = rc.Do("subscribe", invalidateChannel); err != nil {
+		return
+	}
+	// invalidation messages may have been lost while not subscribed
+	c.setOnline(shard, true)
+	_ = conn.SetDeadline(time.Time{})
+
+	// pings keep a dead connection from going unnoticed
+	go func() {
+		ticker := time.NewTicker(invalidationTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if rc.Send("ping") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(invalidationTimeout))
+		var reply interface{}
+		if reply, err = rc.Read(); err != nil {
+			return
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" || msg[1] != invalidateChannel {
+			continue
+		}
+		switch payload := msg[2].(type) {
+		case nil:
+			// flushes are sent with a nil payload
+			c.PurgeShard(shard)
+		case string:
+			c.Invalidate(payload)
+		case []interface{}:
+			keys := make([]string, 0, len(payload))
+			for _, key := range payload {
+				if key, ok := key.(string); ok {
+					keys = append(keys, key)
+				}
+			}
+			c.Invalidate(keys...)
+		}
+	}
+}
+
+// dialRedis dials redis with network, address and tls settings of opts
+func dialRedis(ctx context.Context, opts *redis.Options) (net.Conn, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if opts.Dialer != nil {
+		return opts.Dialer(ctx, network, opts.Addr)
+	}
+	d := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: time.Minute * 5}
+	if d.Timeout == 0 {
+		d.Timeout = time.Second * 5
+	}
+	if opts.TLSConfig != nil {
+		return tls.DialWithDialer(d, network, opts.Addr, opts.TLSConfig)
+	}
+	return d.DialContext(ctx, network, opts.Addr)
+}
+
+// respConn is a minimal resp2 connection, replies are nil, string, int64, error or []interface{}
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	mu   sync.Mutex
+}
+
+// Send writes a command
+func (rc *respConn) Send(args ...string) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		rc.w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return rc.w.Flush()
+}
+
+// Do writes a command and reads its reply, an error reply is returned as err
+func (rc *respConn) Do(args ...string) (reply interface{}, err error) {
+	if err = rc.Send(args...); err != nil {
+		return
+	}
+	if reply, err = rc.Read(); err != nil {
+		return
+	}
+	if e, ok := reply.(error); ok {
+		return nil, e
+	}
+	return
+}
+
+// Read reads a reply
+func (rc *respConn) Read() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("invalid resp line: " + strconv.Quote(line))
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return errors.New(line), nil
+	}
+	n, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid resp integer: " + strconv.Quote(line))
+	}
+	switch kind {
+	case ':':
+		return n, nil
+	case '$':
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = rc.Read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("invalid resp type: " + string(kind))
+}
+
+// respInt returns reply as an integer, 0 if it's not
+func respInt(reply interface{}) int64 {
+	n, _ := reply.(int64)
+	return n
+}
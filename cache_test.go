@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/go-redis/redis/v8"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(cacheEntryOverhead*3, []string{"cfg:"})
+	c.setOnline("", true)
+
+	c.Put("", "cfg:1", &Item{Value: []byte("1")}, c.Generation())
+	c.Put("", "cfg:2", &Item{Value: []byte("2")}, c.Generation())
+	c.Put("", "user:1", &Item{Value: []byte("1")}, c.Generation())
+	if c.Get("", "user:1") != nil {
+		t.Errorf("user:1 should not be cached")
+	}
+	if c.Get("", "cfg:1") == nil {
+		t.Errorf("cfg:1 should be cached")
+	}
+
+	// cfg:2 is the least recently used
+	c.Put("", "cfg:3", &Item{Value: []byte("3")}, c.Generation())
+	if c.Get("", "cfg:2") != nil {
+		t.Errorf("cfg:2 should be evicted")
+	}
+	if c.Get("", "cfg:1") == nil || c.Get("", "cfg:3") == nil {
+		t.Errorf("cfg:1 and cfg:3 should be cached")
+	}
+
+	c.Invalidate("cfg:1")
+	if c.Get("", "cfg:1") != nil {
+		t.Errorf("cfg:1 should be invalidated")
+	}
+
+	gen := c.Generation()
+	c.Invalidate("cfg:4")
+	c.Put("", "cfg:4", &Item{Value: []byte("4")}, gen)
+	if c.Get("", "cfg:4") != nil {
+		t.Errorf("cfg:4 should not be cached after invalidation")
+	}
+
+	c.setOnline("", false)
+	c.Put("", "cfg:5", &Item{Value: []byte("5")}, c.Generation())
+	if c.Get("", "cfg:3") != nil || c.Get("", "cfg:5") != nil {
+		t.Errorf("offline cache should be empty")
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	c := NewCache(cacheEntryOverhead*4, nil)
+	c.setOnline("a", true)
+	c.setOnline("b", true)
+
+	c.Put("a", "1", &Item{Value: []byte("1")}, c.Generation())
+	c.Put("b", "2", &Item{Value: []byte("2")}, c.Generation())
+	if c.Get("a", "1") == nil || c.Get("b", "2") == nil {
+		t.Errorf("keys of both shards should be cached")
+	}
+	if c.Get("b", "1") != nil {
+		t.Errorf("keys should be cached by shard")
+	}
+
+	// invalidation messages of shard a are being lost
+	c.setOnline("a", false)
+	c.Put("a", "3", &Item{Value: []byte("3")}, c.Generation())
+	if c.Get("a", "1") != nil || c.Get("a", "3") != nil {
+		t.Errorf("keys of offline shard should not be cached")
+	}
+	if c.Get("b", "2") == nil {
+		t.Errorf("keys of online shard should be kept")
+	}
+
+	// a key moved to shard b is invalidated in both shards
+	c.setOnline("a", true)
+	c.Put("a", "4", &Item{Value: []byte("4")}, c.Generation())
+	c.Put("b", "4", &Item{Value: []byte("4")}, c.Generation())
+	c.Invalidate("4")
+	if c.Get("a", "4") != nil || c.Get("b", "4") != nil {
+		t.Errorf("4 should be invalidated in all shards")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	subscribing, subscribed, push := make(chan struct{}), make(chan struct{}), make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			args, err := readFakeRedisCommand(r)
+			if err != nil {
+				return
+			}
+			switch strings.ToLower(strings.Join(args, " ")) {
+			case "client id":
+				_, _ = conn.Write([]byte(":7\r\n"))
+			case "client tracking on redirect 7 bcast":
+				_, _ = conn.Write([]byte("+OK\r\n"))
+			case "subscribe " + invalidateChannel:
+				close(subscribing)
+				<-subscribed
+				_, _ = conn.Write([]byte("*3\r\n" + fakeRedisBulk([]byte("subscribe")) + fakeRedisBulk([]byte(invalidateChannel)) + ":1\r\n"))
+				for msg := range push {
+					_, _ = conn.Write([]byte("*3\r\n" + fakeRedisBulk([]byte("message")) + fakeRedisBulk([]byte(invalidateChannel)) + msg))
+				}
+				return
+			default:
+				_, _ = conn.Write([]byte("-ERR unexpected command\r\n"))
+			}
+		}
+	}()
+
+	c := NewCache(cacheEntryOverhead*4, nil)
+	c.setOnline("b", true)
+	c.Put("b", "other", &Item{Value: []byte("b")}, c.Generation())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.RunInvalidation(ctx, "a", &redis.Options{Addr: l.Addr().String()})
+
+	eventually := func(cond func() bool, msg string) {
+		deadline := time.Now().Add(time.Second * 5)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	put := func() bool {
+		c.Put("a", "k", &Item{Value: []byte("a")}, c.Generation())
+		return c.Get("a", "k") != nil
+	}
+
+	<-subscribing
+	// invalidation messages may be lost until subscription is confirmed
+	if put() {
+		t.Error("shard should be offline until subscribed")
+	}
+	close(subscribed)
+	eventually(put, "shard should be online once subscribed")
+
+	push <- "*1\r\n" + fakeRedisBulk([]byte("k"))
+	eventually(func() bool { return c.Get("a", "k") == nil }, "k should be invalidated")
+
+	eventually(put, "k should be cached again")
+	// flushes are sent with a nil payload
+	push <- "$-1\r\n"
+	eventually(func() bool { return c.Get("a", "k") == nil }, "shard should be purged by a flush")
+	if c.Get("b", "other") == nil {
+		t.Error("other shards should be kept")
+	}
+	close(push)
+}
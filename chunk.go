@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// EncodingChunked marks a manifest item, whose value is split into chunk keys
+	EncodingChunked = "chunked"
+
+	// chunkGrace keeps stale chunks readable for readers still streaming them
+	chunkGrace = time.Minute
+)
+
+// Manifest describes chunks of a value
+type Manifest struct {
+	ID    string
+	Count int
+	Size  int
+}
+
+// ParseManifest parses manifest in format "<id> <count> <size>"
+func ParseManifest(buf []byte) (*Manifest, error) {
+	fields := strings.Fields(string(buf))
+	if len(fields) != 3 {
+		return nil, ErrCorruptedValue
+	}
+	m := &Manifest{ID: fields[0]}
+	var err error
+	if m.Count, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, ErrCorruptedValue
+	}
+	if m.Size, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, ErrCorruptedValue
+	}
+	return m, nil
+}
+
+// Bytes returns manifest in format "<id> <count> <size>"
+func (m *Manifest) Bytes() []byte {
+	return []byte(m.ID + " " + strconv.Itoa(m.Count) + " " + strconv.Itoa(m.Size))
+}
+
+func chunkKey(key string, id string, i int) string {
+	return "__CHUNK." + key + "." + id + "." + strconv.Itoa(i)
+}
+
+// parseChunkKey returns key and manifest id of a chunk key
+func parseChunkKey(ck string) (key string, id string, ok bool) {
+	if !strings.HasPrefix(ck, "__CHUNK.") {
+		return
+	}
+	s := strings.TrimPrefix(ck, "__CHUNK.")
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return
+	}
+	s = s[:i]
+	if i = strings.LastIndexByte(s, '.'); i < 0 {
+		return
+	}
+	return s[:i], s[i+1:], true
+}
+
+func expireChunks(ctx context.Context, pipe redis.Pipeliner, key string, m *Manifest, ttl time.Duration) {
+	for i := 0; i < m.Count; i++ {
+		if ttl > 0 {
+			pipe.PExpire(ctx, chunkKey(key, m.ID, i), ttl)
+		} else {
+			pipe.Persist(ctx, chunkKey(key, m.ID, i))
+		}
+	}
+}
+
+// setChunked writes chunks under a new id with a short expiration, then switches the manifest in a transaction,
+// so readers see either the old value or the new one
+func (s *Store) setChunked(ctx context.Context, key string, item *Item, ttl time.Duration, stale *Manifest) (err error) {
+	m := &Manifest{
+		ID:    NewToken(),
+		Count: (len(item.Value) + s.ChunkSize - 1) / s.ChunkSize,
+		Size:  len(item.Value),
+	}
+	manifest := &Item{
+		Value:    m.Bytes(),
+		Flags:    item.Flags,
+		Token:    item.Token,
+		Encoding: EncodingChunked,
+	}
+	if s.Keyring != nil {
+		manifest.KeyID = s.Keyring.Current
+	}
+	for i := 0; i < m.Count; i++ {
+		ck := chunkKey(key, m.ID, i)
+		end := (i + 1) * s.ChunkSize
+		if end > len(item.Value) {
+			end = len(item.Value)
+		}
+		chunk := &Item{Value: item.Value[i*s.ChunkSize : end]}
+		if s.Keyring != nil {
+			if chunk, err = s.Keyring.Encrypt(ck, chunk); err != nil {
+				return
+			}
+		}
+		if err = s.client(key).Set(ctx, ck, chunk.Value, chunkGrace).Err(); err != nil {
+			return
+		}
+	}
+	_, err = s.client(key).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := s.write(ctx, pipe, key, manifest, ttl); err != nil {
+			return err
+		}
+		if ttl > 0 {
+			expireChunks(ctx, pipe, key, m, ttl+chunkGrace)
+		} else {
+			expireChunks(ctx, pipe, key, m, 0)
+		}
+		if stale != nil {
+			expireChunks(ctx, pipe, key, stale, chunkGrace)
+		}
+		return nil
+	})
+	return
+}
+
+// ReadChunks reads chunks of an opened item one by one, ErrCorruptedValue if chunks don't add up to size of manifest
+func (s *Store) ReadChunks(ctx context.Context, key string, item *Item, fn func(chunk []byte) error) error {
+	var size int
+	for i := 0; i < item.Manifest.Count; i++ {
+		ck := chunkKey(key, item.Manifest.ID, i)
+		buf, err := s.client(key).Get(ctx, ck).Bytes()
+		if err != nil {
+			if err == redis.Nil {
+				// chunks of a long replaced value
+				return ErrCorruptedValue
+			}
+			return err
+		}
+		if item.KeyID != "" {
+			chunk, err := s.Keyring.Decrypt(ck, &Item{Value: buf, KeyID: item.KeyID})
+			if err != nil {
+				return err
+			}
+			buf = chunk.Value
+		}
+		// never pass more than announced, a reply header with the size may have been written
+		if size += len(buf); size > item.Manifest.Size {
+			return ErrCorruptedValue
+		}
+		if err = fn(buf); err != nil {
+			return err
+		}
+	}
+	if size != item.Manifest.Size {
+		return ErrCorruptedValue
+	}
+	return nil
+}
+
+// SweepChunks expires chunks never expiring whose manifest is gone or replaced, like evicted by redis, returns number of chunks swept
+func (s *Store) SweepChunks(ctx context.Context) (swept int, err error) {
+	for _, client := range s.Clients() {
+		var (
+			cursor uint64
+			keys   []string
+		)
+		for {
+			if keys, cursor, err = client.Scan(ctx, cursor, "__CHUNK.*", 100).Result(); err != nil {
+				return
+			}
+			for _, ck := range keys {
+				key, id, ok := parseChunkKey(ck)
+				// chunks of keys on other shards are left, the ring may have changed
+				if !ok || s.client(key) != client {
+					continue
+				}
+				// chunks being written, replaced or of an expiring manifest always expire
+				var ttl time.Duration
+				if ttl, err = client.PTTL(ctx, ck).Result(); err != nil {
+					return
+				}
+				if ttl != -1 {
+					continue
+				}
+				if m := s.loadManifest(ctx, key); m != nil && m.ID == id {
+					continue
+				}
+				// expired later rather than deleted, for readers still streaming them
+				if err = client.PExpire(ctx, ck, chunkGrace).Err(); err != nil {
+					return
+				}
+				swept++
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// RunChunkSweeper sweeps orphaned chunks every interval, until ctx is done
+func (s *Store) RunChunkSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		swept, err := s.SweepChunks(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("failed to sweep chunks", "err", err)
+			}
+			continue
+		}
+		if swept > 0 {
+			logger.Info("chunks swept", "chunks", swept)
+		}
+	}
+}
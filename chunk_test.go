@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"go.guoyk.net/redmemd/memwire"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRedisValue struct {
+	str  []byte
+	hash map[string][]byte
+	// exp is the expiration, zero if never expires
+	exp time.Time
+}
+
+// fakeRedis serves the redis commands used by chunked items, "scan" only supports patterns of a prefix and "*"
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	values   map[string]*fakeRedisValue
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{listener: l, values: map[string]*fakeRedisValue{}}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) Client() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: s.listener.Addr().String()})
+}
+
+func (s *fakeRedis) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	var multi bool
+	for {
+		args, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch command := strings.ToLower(args[0]); {
+		case command == "multi":
+			multi, reply = true, "+OK\r\n"
+		case command == "exec":
+			s.mu.Lock()
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, args := range queued {
+				reply += s.do(args)
+			}
+			s.mu.Unlock()
+			multi, queued = false, nil
+		case multi:
+			queued, reply = append(queued, args), "+QUEUED\r\n"
+		default:
+			s.mu.Lock()
+			reply = s.do(args)
+			s.mu.Unlock()
+		}
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) (args []string, err error) {
+	var line string
+	if line, err = r.ReadString('\n'); err != nil {
+		return
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	for i := 0; i < n; i++ {
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return
+}
+
+func fakeRedisBulk(buf []byte) string {
+	return "$" + strconv.Itoa(len(buf)) + "\r\n" + string(buf) + "\r\n"
+}
+
+func fakeRedisInt(n int) string {
+	return ":" + strconv.Itoa(n) + "\r\n"
+}
+
+func (s *fakeRedis) get(key string) *fakeRedisValue {
+	v := s.values[key]
+	if v != nil && !v.exp.IsZero() && !v.exp.After(time.Now()) {
+		delete(s.values, key)
+		return nil
+	}
+	return v
+}
+
+func (s *fakeRedis) do(args []string) string {
+	const wrongType = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG\r\n"
+	case "get":
+		v := s.get(args[1])
+		if v == nil {
+			return "$-1\r\n"
+		}
+		if v.hash != nil {
+			return wrongType
+		}
+		return fakeRedisBulk(v.str)
+	case "set":
+		v := &fakeRedisValue{str: []byte(args[2])}
+		if len(args) == 5 {
+			n, _ := strconv.Atoi(args[4])
+			unit := time.Second
+			if strings.ToLower(args[3]) == "px" {
+				unit = time.Millisecond
+			}
+			v.exp = time.Now().Add(time.Duration(n) * unit)
+		}
+		s.values[args[1]] = v
+		return "+OK\r\n"
+	case "del", "exists":
+		var n int
+		for _, key := range args[1:] {
+			if s.get(key) != nil {
+				n++
+				if strings.ToLower(args[0]) == "del" {
+					delete(s.values, key)
+				}
+			}
+		}
+		return fakeRedisInt(n)
+	case "hset":
+		v := s.get(args[1])
+		if v == nil {
+			v = &fakeRedisValue{hash: map[string][]byte{}}
+			s.values[args[1]] = v
+		}
+		if v.hash == nil {
+			return wrongType
+		}
+		var n int
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := v.hash[args[i]]; !ok {
+				n++
+			}
+			v.hash[args[i]] = []byte(args[i+1])
+		}
+		return fakeRedisInt(n)
+	case "hgetall":
+		v := s.get(args[1])
+		if v == nil {
+			return "*0\r\n"
+		}
+		if v.hash == nil {
+			return wrongType
+		}
+		reply := "*" + strconv.Itoa(len(v.hash)*2) + "\r\n"
+		for field, value := range v.hash {
+			reply += fakeRedisBulk([]byte(field)) + fakeRedisBulk(value)
+		}
+		return reply
+	case "hget", "hstrlen":
+		v := s.get(args[1])
+		if v != nil && v.hash == nil {
+			return wrongType
+		}
+		var field []byte
+		if v != nil {
+			field = v.hash[args[2]]
+		}
+		if strings.ToLower(args[0]) == "hstrlen" {
+			return fakeRedisInt(len(field))
+		}
+		if field == nil {
+			return "$-1\r\n"
+		}
+		return fakeRedisBulk(field)
+	case "hmget":
+		v := s.get(args[1])
+		if v != nil && v.hash == nil {
+			return wrongType
+		}
+		reply := "*" + strconv.Itoa(len(args)-2) + "\r\n"
+		for _, field := range args[2:] {
+			if v == nil || v.hash[field] == nil {
+				reply += "$-1\r\n"
+			} else {
+				reply += fakeRedisBulk(v.hash[field])
+			}
+		}
+		return reply
+	case "strlen", "getrange":
+		v := s.get(args[1])
+		if v != nil && v.hash != nil {
+			return wrongType
+		}
+		var str []byte
+		if v != nil {
+			str = v.str
+		}
+		if strings.ToLower(args[0]) == "strlen" {
+			return fakeRedisInt(len(str))
+		}
+		start, _ := strconv.Atoi(args[2])
+		end, _ := strconv.Atoi(args[3])
+		if end >= len(str) {
+			end = len(str) - 1
+		}
+		if start > end {
+			return fakeRedisBulk(nil)
+		}
+		return fakeRedisBulk(str[start : end+1])
+	case "pexpire", "expire":
+		v := s.get(args[1])
+		if v == nil {
+			return fakeRedisInt(0)
+		}
+		n, _ := strconv.Atoi(args[2])
+		unit := time.Millisecond
+		if strings.ToLower(args[0]) == "expire" {
+			unit = time.Second
+		}
+		v.exp = time.Now().Add(time.Duration(n) * unit)
+		return fakeRedisInt(1)
+	case "persist":
+		v := s.get(args[1])
+		if v == nil || v.exp.IsZero() {
+			return fakeRedisInt(0)
+		}
+		v.exp = time.Time{}
+		return fakeRedisInt(1)
+	case "pttl", "ttl":
+		v := s.get(args[1])
+		switch {
+		case v == nil:
+			return fakeRedisInt(-2)
+		case v.exp.IsZero():
+			return fakeRedisInt(-1)
+		}
+		if strings.ToLower(args[0]) == "ttl" {
+			return fakeRedisInt(int(time.Until(v.exp).Seconds()))
+		}
+		return fakeRedisInt(int(time.Until(v.exp).Milliseconds()))
+	case "scan":
+		var prefix string
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToLower(args[i]) == "match" {
+				prefix = strings.TrimSuffix(args[i+1], "*")
+			}
+		}
+		var keys []string
+		for key := range s.values {
+			if strings.HasPrefix(key, prefix) && s.get(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		reply := "*2\r\n" + fakeRedisBulk([]byte("0")) + "*" + strconv.Itoa(len(keys)) + "\r\n"
+		for _, key := range keys {
+			reply += fakeRedisBulk([]byte(key))
+		}
+		return reply
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func newChunkedStore(client *redis.Client) *Store {
+	return &Store{Redis: client, RedisLock: redislock.New(client), ChunkSize: 4}
+}
+
+func TestManifest(t *testing.T) {
+	m, err := ParseManifest((&Manifest{ID: "123", Count: 3, Size: 2500}).Bytes())
+	if err != nil {
+		t.Fatalf("ParseManifest %+v", err)
+	}
+	if m.ID != "123" || m.Count != 3 || m.Size != 2500 {
+		t.Errorf("Manifest %+v", m)
+	}
+	if _, err = ParseManifest([]byte("123 x 2500")); err != ErrCorruptedValue {
+		t.Errorf("ParseManifest should fail with corrupted value")
+	}
+}
+
+func TestParseChunkKey(t *testing.T) {
+	if key, id, ok := parseChunkKey(chunkKey("user.1", "123", 7)); !ok || key != "user.1" || id != "123" {
+		t.Errorf("bad chunk key: %s, %s, %v", key, id, ok)
+	}
+	for _, ck := range []string{"user.1", "__CHUNK.a", "__LOCK.a.1.2"} {
+		if _, _, ok := parseChunkKey(ck); ok {
+			t.Errorf("%s should not be a chunk key", ck)
+		}
+	}
+}
+
+func TestStoreChunked(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := newChunkedStore(client)
+
+	value := []byte("hello, chunks")
+	if err := s.Set(ctx, "a.b", &Item{Value: value, Flags: "3", Token: "1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.Open(ctx, "a.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Manifest == nil || item.Manifest.Count != 4 || item.Manifest.Size != len(value) || item.Flags != "3" {
+		t.Fatalf("bad item: %+v", item)
+	}
+	var buf bytes.Buffer
+	if err = s.ReadChunks(ctx, "a.b", item, func(chunk []byte) error {
+		if len(chunk) > 4 {
+			t.Errorf("chunk too large: %q", chunk)
+		}
+		buf.Write(chunk)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), value) {
+		t.Errorf("bad value: %q", buf.Bytes())
+	}
+	// chunks of an item never expiring never expire
+	ck := chunkKey("a.b", item.Manifest.ID, 0)
+	if ttl := client.PTTL(ctx, ck).Val(); ttl != -1 {
+		t.Errorf("bad chunk ttl: %v", ttl)
+	}
+
+	// replaced chunks are kept for a grace period
+	if err = s.Set(ctx, "a.b", &Item{Value: []byte("short value"), Flags: "0", Token: "2"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := client.PTTL(ctx, ck).Val(); ttl <= 0 || ttl > chunkGrace {
+		t.Errorf("bad stale chunk ttl: %v", ttl)
+	}
+	if item, err = s.Get(ctx, "a.b"); err != nil || string(item.Value) != "short value" {
+		t.Errorf("bad item: %+v, %v", item, err)
+	}
+}
+
+func TestReadChunksShort(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := newChunkedStore(client)
+
+	if err := s.Set(ctx, "a", &Item{Value: []byte("0123456789"), Flags: "0", Token: "1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.Open(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last chunk is truncated
+	client.Set(ctx, chunkKey("a", item.Manifest.ID, item.Manifest.Count-1), "8", 0)
+	var n int
+	if err = s.ReadChunks(ctx, "a", item, func(chunk []byte) error {
+		n += len(chunk)
+		return nil
+	}); err != ErrCorruptedValue {
+		t.Errorf("should fail with corrupted value: %v", err)
+	}
+	// a chunk longer than announced is never passed
+	client.Set(ctx, chunkKey("a", item.Manifest.ID, 0), "0123456789a", 0)
+	n = 0
+	if err = s.ReadChunks(ctx, "a", item, func(chunk []byte) error {
+		n += len(chunk)
+		return nil
+	}); err != ErrCorruptedValue || n != 0 {
+		t.Errorf("should fail with corrupted value: %d, %v", n, err)
+	}
+}
+
+func TestSweepChunks(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := newChunkedStore(client)
+
+	for _, key := range []string{"evicted", "kept"} {
+		if err := s.Set(ctx, key, &Item{Value: []byte("0123456789"), Flags: "0", Token: "1"}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	item, err := s.Open(ctx, "evicted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the manifest is gone without its chunks, like evicted by redis
+	client.Del(ctx, "evicted")
+
+	swept, err := s.SweepChunks(ctx)
+	if err != nil || swept != 3 {
+		t.Errorf("bad swept: %d, %v", swept, err)
+	}
+	if ttl := client.PTTL(ctx, chunkKey("evicted", item.Manifest.ID, 0)).Val(); ttl <= 0 || ttl > chunkGrace {
+		t.Errorf("bad swept chunk ttl: %v", ttl)
+	}
+	if item, err = s.Get(ctx, "kept"); err != nil || string(item.Value) != "0123456789" {
+		t.Errorf("bad item: %+v, %v", item, err)
+	}
+	// swept chunks are expiring already
+	if swept, err = s.SweepChunks(ctx); err != nil || swept != 0 {
+		t.Errorf("bad swept: %d, %v", swept, err)
+	}
+}
+
+func TestReplyChunkedTraceKey(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := newChunkedStore(client)
+
+	// with tracing disabled, a key looking like trace context is a literal key
+	key := "@trace:0af7651916cd43dd8448eb211c80319c:user:1"
+	if err := s.Set(ctx, key, &Item{Value: []byte("hello, chunks"), Flags: "0", Token: "1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	rt := &RoundTripper{Request: &memwire.Request{Command: "get", Keys: []string{key}}, Store: s, ResponseWriter: bufio.NewWriter(&buf)}
+	res := &memwire.Response{Response: memwire.CodeEnd, Values: []memwire.Value{{Key: key, Flags: "0", Data: item.Value}}}
+	if err = rt.ReplyChunked(ctx, res, []string{key}, []*Item{item}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "VALUE " + key + " 0 13\r\nhello, chunks\r\nEND\r\n"; buf.String() != want {
+		t.Errorf("bad response: %q", buf.String())
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/golang/snappy"
+)
+
+const (
+	EncodingNone   = ""
+	EncodingSnappy = "snappy"
+)
+
+// Compress compresses item value with snappy if it's larger than threshold and actually shrinks
+func Compress(item *Item, threshold int) *Item {
+	if threshold <= 0 || len(item.Value) <= threshold || item.Encoding != EncodingNone {
+		return item
+	}
+	buf := snappy.Encode(nil, item.Value)
+	if len(buf) >= len(item.Value) {
+		return item
+	}
+	stats.CompressedItems.Add(1)
+	stats.CompressedBytesIn.Add(int64(len(item.Value)))
+	stats.CompressedBytesOut.Add(int64(len(buf)))
+	out := *item
+	out.Value = buf
+	out.Encoding = EncodingSnappy
+	return &out
+}
+
+// Decompress restores item value according to its encoding
+func Decompress(item *Item) (*Item, error) {
+	switch item.Encoding {
+	case EncodingNone:
+		return item, nil
+	case EncodingSnappy:
+		buf, err := snappy.Decode(nil, item.Value)
+		if err != nil {
+			return nil, ErrCorruptedValue
+		}
+		out := *item
+		out.Value = buf
+		out.Encoding = EncodingNone
+		return &out, nil
+	}
+	return nil, ErrCorruptedValue
+}
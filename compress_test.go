@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	value := bytes.Repeat([]byte("hello world "), 100)
+	item := Compress(&Item{Value: value, Flags: "3"}, 64)
+	if item.Encoding != EncodingSnappy {
+		t.Fatalf("Encoding %s", item.Encoding)
+	}
+	if len(item.Value) >= len(value) {
+		t.Errorf("Value not compressed, %d bytes", len(item.Value))
+	}
+	buf, err := EncodeCompact(item)
+	if err != nil {
+		t.Fatalf("EncodeCompact %+v", err)
+	}
+	if item, err = DecodeCompact(buf); err != nil {
+		t.Fatalf("DecodeCompact %+v", err)
+	}
+	if item, err = Decompress(item); err != nil {
+		t.Fatalf("Decompress %+v", err)
+	}
+	if !bytes.Equal(item.Value, value) || item.Flags != "3" || item.Encoding != EncodingNone {
+		t.Errorf("Item %+v", item)
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	if item := Compress(&Item{Value: []byte("short")}, 64); item.Encoding != EncodingNone {
+		t.Errorf("short value should not be compressed")
+	}
+	if item := Compress(&Item{Value: []byte("8f3a0c91d27e4b56")}, 8); item.Encoding != EncodingNone {
+		t.Errorf("incompressible value should not be compressed")
+	}
+	if item := Compress(&Item{Value: make([]byte, 1024)}, 0); item.Encoding != EncodingNone {
+		t.Errorf("zero threshold should disable compression")
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option is a setting read from, in order of precedence, command-line flags, environment variables, config file and default
+type Option struct {
+	// Name is the dotted path in config file, also the flag name with dots and underscores replaced by dashes
+	Name    string
+	Env     string
+	Default string
+	Usage   string
+	// Reloadable options are applied on SIGHUP, others require a restart
+	Reloadable bool
+
+	set   func(s string) error
+	value string
+}
+
+// Flag returns the command-line flag name of option
+func (o *Option) Flag() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(o.Name)
+}
+
+func stringOption(p *string) func(string) error {
+	return func(s string) error {
+		*p = s
+		return nil
+	}
+}
+
+func intOption(p *int) func(string) error {
+	return func(s string) (err error) {
+		if s == "" {
+			*p = 0
+			return
+		}
+		*p, err = strconv.Atoi(s)
+		return
+	}
+}
+
+func floatOption(p *float64) func(string) error {
+	return func(s string) (err error) {
+		if s == "" {
+			*p = 0
+			return
+		}
+		*p, err = strconv.ParseFloat(s, 64)
+		return
+	}
+}
+
+func boolOption(p *bool) func(string) error {
+	return func(s string) (err error) {
+		if s == "" {
+			*p = false
+			return
+		}
+		*p, err = strconv.ParseBool(s)
+		return
+	}
+}
+
+func durationOption(p *time.Duration) func(string) error {
+	return func(s string) (err error) {
+		if s == "" {
+			*p = 0
+			return
+		}
+		*p, err = time.ParseDuration(s)
+		return
+	}
+}
+
+var options = []*Option{
+	{Name: "port", Env: "PORT", Default: "11211", Usage: "memcached listening port", set: stringOption(&optPort)},
+	{Name: "http_port", Env: "HTTP_PORT", Usage: "http listening port for metrics, health checks and admin api, disabled if empty", set: stringOption(&optHTTPPort)},
+
+	{Name: "redis.url", Env: "REDIS_URL", Default: "redis://127.0.0.1:6379/0", Usage: "redis url", set: stringOption(&optRedisURL)},
+	{Name: "redis.pool_size", Env: "REDIS_POOL_SIZE", Usage: "redis connection pool size, 10 per cpu if 0", set: intOption(&optRedisPoolSize)},
+	{Name: "redis.dial_timeout", Env: "REDIS_DIAL_TIMEOUT", Usage: "redis dial timeout", set: durationOption(&optRedisDialTimeout)},
+	{Name: "redis.read_timeout", Env: "REDIS_READ_TIMEOUT", Usage: "redis read timeout", set: durationOption(&optRedisReadTimeout)},
+	{Name: "redis.write_timeout", Env: "REDIS_WRITE_TIMEOUT", Usage: "redis write timeout", set: durationOption(&optRedisWriteTimeout)},
+	{Name: "redis.shards", Env: "REDIS_SHARDS", Usage: "comma separated redis backends to shard keys with ketama consistent hashing, each as \"<redis url>[ weight=<weight>][ name=<name>]\", redis.url is used if empty", set: stringOption(&optRedisShards)},
+	{Name: "redis.shard_check_interval", Env: "REDIS_SHARD_CHECK_INTERVAL", Default: "1s", Usage: "interval of shard health checks for ejection", set: durationOption(&optRedisShardCheckInterval)},
+	{Name: "redis.shard_eject_failures", Env: "REDIS_SHARD_EJECT_FAILURES", Usage: "eject a shard from the ring after this number of consecutive failed health checks, never ejected if 0; writes to its keys go to other shards while ejected and are lost once it's re-added, stale values come back", set: intOption(&optRedisShardEjectFailures)},
+
+	{Name: "layout.default", Env: "LAYOUT", Usage: "default storage layout, hash or compact", set: stringOption(&optLayout)},
+	{Name: "layout.namespaces", Env: "LAYOUT_NAMESPACES", Usage: "storage layouts by key prefix, prefix=layout,...", set: stringOption(&optLayoutNS)},
+
+	{Name: "compress_threshold", Env: "COMPRESS_THRESHOLD", Usage: "compress values larger than this size, disabled if 0", set: intOption(&optCompressThreshold)},
+	{Name: "encryption_key_file", Env: "ENCRYPTION_KEY_FILE", Usage: "encryption key file, disabled if empty", set: stringOption(&optEncryptionKeyFile)},
+	{Name: "chunk_size", Env: "CHUNK_SIZE", Usage: "split values larger than this size into chunks, disabled if 0", set: intOption(&optChunkSize)},
+	{Name: "chunk_sweep_interval", Env: "CHUNK_SWEEP_INTERVAL", Default: "1h", Usage: "interval of sweeping chunks orphaned by evicted items without expiration, disabled if 0", set: durationOption(&optChunkSweepInterval)},
+
+	{Name: "l1.size", Env: "L1_SIZE", Usage: "in-process cache size in bytes, disabled if 0", set: intOption(&optL1Size)},
+	{Name: "l1.prefixes", Env: "L1_PREFIXES", Usage: "key prefixes to cache in-process, comma separated", set: stringOption(&optL1Prefixes)},
+
+	{Name: "rate_limit.mode", Env: "RATE_LIMIT_MODE", Default: RateLimitReject, Usage: "reject or delay requests over budget", Reloadable: true, set: stringOption(&optRateLimitMode)},
+	{Name: "rate_limit.max_delay", Env: "RATE_LIMIT_MAX_DELAY", Default: "1s", Usage: "longest delay in delay mode, requests are rejected beyond it", Reloadable: true, set: durationOption(&optRateLimitMaxDelay)},
+	{Name: "rate_limit.global", Env: "RATE_LIMIT_GLOBAL", Usage: "global budget of read/write requests per second, unlimited if empty", Reloadable: true, set: stringOption(&optRateLimitGlobal)},
+	{Name: "rate_limit.per_ip", Env: "RATE_LIMIT_PER_IP", Usage: "per client ip budget of read/write requests per second, unlimited if empty", Reloadable: true, set: stringOption(&optRateLimitPerIP)},
+	{Name: "rate_limit.per_user", Env: "RATE_LIMIT_PER_USER", Usage: "per user budget of read/write requests per second, unlimited if empty", Reloadable: true, set: stringOption(&optRateLimitPerUser)},
+	{Name: "rate_limit.overrides", Env: "RATE_LIMIT_OVERRIDES", Usage: "per client ip budgets by network, cidr=read/write,...", Reloadable: true, set: stringOption(&optRateLimitOverrides)},
+
+	{Name: "acl.allow", Env: "ACL_ALLOW", Usage: "allowed client networks, comma separated cidrs, any if empty", Reloadable: true, set: stringOption(&optACLAllow)},
+	{Name: "acl.deny", Env: "ACL_DENY", Usage: "denied client networks, comma separated cidrs", Reloadable: true, set: stringOption(&optACLDeny)},
+	{Name: "acl.rules", Env: "ACL_RULES", Usage: "command permissions, comma separated rules of \"<principal> <permission>...\"", Reloadable: true, set: stringOption(&optACLRules)},
+	{Name: "auth.file", Env: "AUTH_FILE", Usage: "file of user:password lines, authentication is required if set", Reloadable: true, set: stringOption(&optAuthFile)},
+
+	{Name: "tls.cert_file", Env: "TLS_CERT_FILE", Usage: "tls certificate file, tls is enabled if set", set: stringOption(&optTLSCertFile)},
+	{Name: "tls.key_file", Env: "TLS_KEY_FILE", Usage: "tls key file", set: stringOption(&optTLSKeyFile)},
+	{Name: "tls.client_ca_file", Env: "TLS_CLIENT_CA_FILE", Usage: "ca file to verify tls client certificates", set: stringOption(&optTLSClientCAFile)},
+
+	{Name: "admin.token", Env: "ADMIN_TOKEN", Usage: "admin api bearer token, disabled if empty", Reloadable: true, set: stringOption(&optAdminToken)},
+
+	{Name: "limits.max_connections", Env: "MAX_CONNECTIONS", Usage: "max number of active connections, unlimited if 0", Reloadable: true, set: intOption(&optMaxConnections)},
+	{Name: "limits.idle_timeout", Env: "IDLE_TIMEOUT", Usage: "close connections without requests for this duration, disabled if 0", Reloadable: true, set: durationOption(&optIdleTimeout)},
+	{Name: "limits.read_timeout", Env: "READ_TIMEOUT", Usage: "max duration of reading a request, disabled if 0", Reloadable: true, set: durationOption(&optReadTimeout)},
+	{Name: "limits.write_timeout", Env: "WRITE_TIMEOUT", Usage: "max duration of writing a response, disabled if 0", Reloadable: true, set: durationOption(&optWriteTimeout)},
+	{Name: "limits.tcp_keepalive", Env: "TCP_KEEPALIVE", Usage: "tcp keepalive period, disabled if 0", Reloadable: true, set: durationOption(&optTCPKeepAlive)},
+
+	{Name: "health.interval", Env: "HEALTH_INTERVAL", Default: "1s", Usage: "interval of redis health checks", set: durationOption(&optHealthInterval)},
+	{Name: "health.max_latency", Env: "HEALTH_MAX_LATENCY", Default: "100ms", Usage: "redis latency above which the server is not ready", Reloadable: true, set: durationOption(&optHealthMaxLatency)},
+	{Name: "shutdown_delay", Env: "SHUTDOWN_DELAY", Usage: "delay before closing listener on shutdown", set: durationOption(&optShutdownDelay)},
+	{Name: "shutdown_grace_period", Env: "SHUTDOWN_GRACE_PERIOD", Default: "10s", Usage: "max duration of draining connections on shutdown, connections are killed after it", Reloadable: true, set: durationOption(&optShutdownGrace)},
+
+	{Name: "slowlog.threshold", Env: "SLOWLOG_THRESHOLD", Default: "100ms", Usage: "log commands slower than this duration, disabled if 0", Reloadable: true, set: durationOption(&optSlowlogThreshold)},
+	{Name: "slowlog.max_len", Env: "SLOWLOG_MAX_LEN", Default: "128", Usage: "max number of slow commands kept in memory", Reloadable: true, set: intOption(&optSlowlogMaxLen)},
+
+	{Name: "hotkeys.top", Env: "HOTKEYS_TOP", Default: "10", Usage: "number of hottest read and write keys reported, disabled if 0", Reloadable: true, set: intOption(&optHotKeysTop)},
+	{Name: "hotkeys.window", Env: "HOTKEYS_WINDOW", Default: "1m", Usage: "sliding window of hot key detection", Reloadable: true, set: durationOption(&optHotKeysWindow)},
+	{Name: "hotkeys.log_threshold", Env: "HOTKEYS_LOG_THRESHOLD", Usage: "log keys over this number of requests per second, disabled if 0", Reloadable: true, set: floatOption(&optHotKeysLogThreshold)},
+
+	{Name: "metadump.rate", Env: "METADUMP_RATE", Default: "1000", Usage: "max keys per second of metadump, unlimited if 0", set: floatOption(&optMetaDumpRate)},
+	{Name: "metadump.format", Env: "METADUMP_FORMAT", Default: MetaDumpJSONL, Usage: "output format of dump-meta, jsonl or csv", set: stringOption(&optMetaDumpFormat)},
+	{Name: "metadump.output", Env: "METADUMP_OUTPUT", Usage: "output file of dump-meta, stdout if empty", set: stringOption(&optMetaDumpOutput)},
+
+	{Name: "backup.compress", Env: "BACKUP_COMPRESS", Default: "true", Usage: "compress export file with snappy", set: boolOption(&optBackupCompress)},
+	{Name: "backup.resume", Env: "BACKUP_RESUME", Usage: "continue an unfinished export or import from its checkpoint", set: boolOption(&optBackupResume)},
+	{Name: "backup.progress_interval", Env: "BACKUP_PROGRESS_INTERVAL", Default: "10s", Usage: "interval of logging export and import progress", set: durationOption(&optBackupProgressInterval)},
+
+	{Name: "memcached.source", Env: "MEMCACHED_SOURCE", Usage: "address of memcached server to migrate from", set: stringOption(&optMemcachedSource)},
+	{Name: "memcached.rate", Env: "MEMCACHED_RATE", Default: "1000", Usage: "max keys per second of memcached migration, unlimited if 0", set: floatOption(&optMemcachedRate)},
+	{Name: "memcached.overwrite", Env: "MEMCACHED_OVERWRITE", Usage: "overwrite existing items in memcached migration", set: boolOption(&optMemcachedOverwrite)},
+	{Name: "memcached.checkpoint", Env: "MEMCACHED_CHECKPOINT", Usage: "file of keys migrated from memcached in an unfinished migration, removed once migration completes", set: stringOption(&optMemcachedCheckpoint)},
+	{Name: "memcached.resume", Env: "MEMCACHED_RESUME", Usage: "continue an unfinished memcached migration, keys in checkpoint are skipped", set: boolOption(&optMemcachedResume)},
+	{Name: "memcached.progress_interval", Env: "MEMCACHED_PROGRESS_INTERVAL", Default: "10s", Usage: "interval of logging memcached migration progress", set: durationOption(&optMemcachedProgressInterval)},
+
+	{Name: "shadow.addr", Env: "SHADOW_ADDR", Usage: "address of reference memcached, requests are also replayed against it and responses compared, disabled if empty", set: stringOption(&optShadowAddr)},
+	{Name: "shadow.concurrency", Env: "SHADOW_CONCURRENCY", Default: "4", Usage: "number of connections to reference memcached", set: intOption(&optShadowConcurrency)},
+	{Name: "shadow.log_rate", Env: "SHADOW_LOG_RATE", Default: "10", Usage: "max mismatches logged per second, all logged if 0", set: floatOption(&optShadowLogRate)},
+
+	{Name: "mirror.url", Env: "MIRROR_URL", Usage: "secondary redis url, writes are also replayed to it asynchronously, disabled if empty", set: stringOption(&optMirrorURL)},
+	{Name: "mirror.concurrency", Env: "MIRROR_CONCURRENCY", Default: "4", Usage: "number of workers replaying writes to secondary redis", set: intOption(&optMirrorConcurrency)},
+	{Name: "mirror.queue_size", Env: "MIRROR_QUEUE_SIZE", Default: "10000", Usage: "max writes queued for each worker, writes are dropped beyond it", set: intOption(&optMirrorQueueSize)},
+	{Name: "mirror.retries", Env: "MIRROR_RETRIES", Default: "3", Usage: "number of retries of a failed replay", set: intOption(&optMirrorRetries)},
+	{Name: "mirror.read_fallback", Env: "MIRROR_READ_FALLBACK", Usage: "read keys missing in redis from secondary redis for get commands", set: boolOption(&optMirrorReadFallback)},
+
+	{Name: "audit.file", Env: "AUDIT_FILE", Usage: "audit log file of mutating commands, disabled if empty", set: stringOption(&optAuditFile)},
+	{Name: "audit.file_max_size", Env: "AUDIT_FILE_MAX_SIZE", Default: "104857600", Usage: "rotate audit log file when it exceeds this size in bytes, never rotated if 0", set: intOption(&optAuditFileMaxSize)},
+	{Name: "audit.file_max_backups", Env: "AUDIT_FILE_MAX_BACKUPS", Default: "5", Usage: "number of rotated audit log files kept", set: intOption(&optAuditFileMaxBackups)},
+	{Name: "audit.stream", Env: "AUDIT_STREAM", Usage: "redis stream key of audit log, disabled if empty", set: stringOption(&optAuditStream)},
+	{Name: "audit.stream_max_len", Env: "AUDIT_STREAM_MAX_LEN", Default: "1000000", Usage: "approximate max length of audit log stream, never trimmed if 0", set: intOption(&optAuditStreamMaxLen)},
+	{Name: "audit.redis_url", Env: "AUDIT_REDIS_URL", Usage: "redis url of audit log stream, same as redis.url if empty", set: stringOption(&optAuditRedisURL)},
+
+	{Name: "debug", Env: "DEBUG", Usage: "same as log.level=debug", Reloadable: true, set: boolOption(&optDebug)},
+	{Name: "log.level", Env: "LOG_LEVEL", Usage: "log level, debug, info, warn or error", Reloadable: true, set: stringOption(&optLogLevel)},
+	{Name: "log.format", Env: "LOG_FORMAT", Default: "logfmt", Usage: "log format, logfmt or json", set: stringOption(&optLogFormat)},
+	{Name: "log.conn_sample_rate", Env: "LOG_CONN_SAMPLE_RATE", Default: "1", Usage: "sample rate of connection logs", Reloadable: true, set: floatOption(&optLogConnSampleRate)},
+
+	{Name: "trace.endpoint", Env: "TRACE_ENDPOINT", Usage: "OTLP/HTTP endpoint, disabled if empty", set: stringOption(&optTraceEndpoint)},
+	{Name: "trace.sample_ratio", Env: "TRACE_SAMPLE_RATIO", Default: "1", Usage: "trace sampling ratio", Reloadable: true, set: floatOption(&optTraceSampleRatio)},
+	{Name: "trace.service_name", Env: "TRACE_SERVICE_NAME", Default: "redmemd", Usage: "trace service name", set: stringOption(&optTraceServiceName)},
+}
+
+// ConfigSource is the command-line part of configuration, it's kept for reloads
+type ConfigSource struct {
+	File       string
+	CheckOnly  bool
+	Flags      map[string]string
+	Subcommand []string
+}
+
+// ParseArgs parses command-line arguments, a subcommand may come either before or after flags
+func ParseArgs(args []string) (src ConfigSource, err error) {
+	fs := flag.NewFlagSet("redmemd", flag.ContinueOnError)
+	fs.StringVar(&src.File, "config", os.Getenv("CONFIG_FILE"), "config file in yaml (env CONFIG_FILE)")
+	fs.BoolVar(&src.CheckOnly, "check-config", false, "validate configuration and exit")
+	values := map[string]*string{}
+	for _, o := range options {
+		usage := o.Usage + " (env " + o.Env + ")"
+		values[o.Name] = fs.String(o.Flag(), o.Default, usage)
+	}
+
+	var sub []string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		sub, args = []string{args[0]}, args[1:]
+	}
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	src.Subcommand = append(sub, fs.Args()...)
+
+	src.Flags = map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range options {
+			if o.Flag() == f.Name {
+				src.Flags[o.Name] = *values[o.Name]
+			}
+		}
+	})
+	return
+}
+
+// flattenConfig flattens nested maps into dotted keys, lists are joined with commas
+func flattenConfig(prefix string, in map[interface{}]interface{}, out map[string]string) {
+	for k, v := range in {
+		key := fmt.Sprint(k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			flattenConfig(key, v, out)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			out[key] = strings.Join(items, ",")
+		case nil:
+			out[key] = ""
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// LoadConfigFile reads a yaml config file as dotted keys, unknown keys are rejected
+func LoadConfigFile(file string) (values map[string]string, err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(file); err != nil {
+		return
+	}
+	raw := map[interface{}]interface{}{}
+	if err = yaml.Unmarshal(buf, &raw); err != nil {
+		return
+	}
+	values = map[string]string{}
+	flattenConfig("", raw, values)
+	var unknown []string
+	for key := range values {
+		if findOption(key) == nil {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		err = errors.New("unknown config keys: " + strings.Join(unknown, ", "))
+	}
+	return
+}
+
+func findOption(name string) *Option {
+	for _, o := range options {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// Resolve returns raw values of all options, in order of precedence of flags, environment variables, config file and default
+func (src ConfigSource) Resolve() (values map[string]string, err error) {
+	file := map[string]string{}
+	if src.File != "" {
+		if file, err = LoadConfigFile(src.File); err != nil {
+			return
+		}
+	}
+	values = map[string]string{}
+	for _, o := range options {
+		if v, ok := src.Flags[o.Name]; ok {
+			values[o.Name] = v
+		} else if v = strings.TrimSpace(os.Getenv(o.Env)); v != "" {
+			values[o.Name] = v
+		} else if v, ok = file[o.Name]; ok {
+			values[o.Name] = v
+		} else {
+			values[o.Name] = o.Default
+		}
+	}
+	return
+}
+
+// LoadOptions resolves and sets all options
+func LoadOptions(src ConfigSource) (err error) {
+	var values map[string]string
+	if values, err = src.Resolve(); err != nil {
+		return
+	}
+	for _, o := range options {
+		if err = o.set(values[o.Name]); err != nil {
+			return errors.New("invalid option " + o.Name + ": " + err.Error())
+		}
+		o.value = values[o.Name]
+	}
+	return
+}
+
+// ReloadOptions resolves options again and sets the reloadable ones, returns names of changed options;
+// nothing is changed if any of them is invalid
+func ReloadOptions(src ConfigSource) (changed []string, err error) {
+	var values map[string]string
+	if values, err = src.Resolve(); err != nil {
+		return
+	}
+	var reload []*Option
+	for _, o := range options {
+		if values[o.Name] == o.value {
+			continue
+		}
+		if !o.Reloadable {
+			logger.Warn("option changed, restart required", "option", o.Name)
+			continue
+		}
+		reload = append(reload, o)
+	}
+	defer func() {
+		if err != nil {
+			for _, o := range reload {
+				_ = o.set(o.value)
+			}
+			changed = nil
+		}
+	}()
+	for _, o := range reload {
+		if err = o.set(values[o.Name]); err != nil {
+			err = errors.New("invalid option " + o.Name + ": " + err.Error())
+			return
+		}
+		changed = append(changed, o.Name)
+	}
+	if err = ValidateOptions(); err != nil {
+		return
+	}
+	for _, o := range reload {
+		o.value = values[o.Name]
+	}
+	return
+}
+
+// ValidateOptions checks options beyond their types
+func ValidateOptions() (err error) {
+	if _, err = ParseNamespaces(optLayout, optLayoutNS); err != nil {
+		return
+	}
+	if _, err = redis.ParseURL(optRedisURL); err != nil {
+		return
+	}
+	if optHealthInterval <= 0 {
+		return errors.New("invalid option health.interval: must be positive")
+	}
+	if optSlowlogMaxLen < 0 {
+		return errors.New("invalid option slowlog.max_len: must not be negative")
+	}
+	if optHotKeysTop < 0 || optHotKeysLogThreshold < 0 {
+		return errors.New("invalid option hotkeys.*: must not be negative")
+	}
+	if optHotKeysWindow < time.Second {
+		return errors.New("invalid option hotkeys.window: must be at least 1s")
+	}
+	if optMetaDumpRate < 0 {
+		return errors.New("invalid option metadump.rate: must not be negative")
+	}
+	switch optMetaDumpFormat {
+	case MetaDumpJSONL, MetaDumpCSV:
+	default:
+		return errors.New("invalid option metadump.format: " + optMetaDumpFormat)
+	}
+	if optBackupProgressInterval <= 0 {
+		return errors.New("invalid option backup.progress_interval: must be positive")
+	}
+	if optMemcachedRate < 0 {
+		return errors.New("invalid option memcached.rate: must not be negative")
+	}
+	if optMemcachedProgressInterval <= 0 {
+		return errors.New("invalid option memcached.progress_interval: must be positive")
+	}
+	if optRedisShards != "" {
+		for _, item := range strings.Split(optRedisShards, ",") {
+			if _, err := ParseShard(item); err != nil {
+				return errors.New("invalid option redis.shards: " + err.Error())
+			}
+		}
+	}
+	if optChunkSweepInterval < 0 {
+		return errors.New("invalid option chunk_sweep_interval: must not be negative")
+	}
+	if optRedisShardCheckInterval <= 0 {
+		return errors.New("invalid option redis.shard_check_interval: must be positive")
+	}
+	if optRedisShardEjectFailures < 0 {
+		return errors.New("invalid option redis.shard_eject_failures: must not be negative")
+	}
+	if optShadowConcurrency < 1 {
+		return errors.New("invalid option shadow.concurrency: must be positive")
+	}
+	if optShadowLogRate < 0 {
+		return errors.New("invalid option shadow.log_rate: must not be negative")
+	}
+	if optMirrorURL != "" {
+		if _, err := redis.ParseURL(optMirrorURL); err != nil {
+			return errors.New("invalid option mirror.url: " + err.Error())
+		}
+	}
+	if optMirrorConcurrency < 1 {
+		return errors.New("invalid option mirror.concurrency: must be positive")
+	}
+	if optMirrorQueueSize < 1 {
+		return errors.New("invalid option mirror.queue_size: must be positive")
+	}
+	if optMirrorRetries < 0 {
+		return errors.New("invalid option mirror.retries: must not be negative")
+	}
+	if optAuditFile != "" && optAuditStream != "" {
+		return errors.New("invalid option audit.file, audit.stream: only one of them can be set")
+	}
+	if optAuditFileMaxSize < 0 || optAuditFileMaxBackups < 0 || optAuditStreamMaxLen < 0 {
+		return errors.New("invalid option audit.*: must not be negative")
+	}
+	if optAuditRedisURL != "" {
+		if _, err = redis.ParseURL(optAuditRedisURL); err != nil {
+			return
+		}
+	}
+	if optLogLevel != "" {
+		if _, err = ParseLevel(optLogLevel); err != nil {
+			return
+		}
+	}
+	switch optLogFormat {
+	case "logfmt", "json":
+	default:
+		return errors.New("invalid log format: " + optLogFormat)
+	}
+	if optEncryptionKeyFile != "" {
+		if _, err = LoadKeyring(optEncryptionKeyFile); err != nil {
+			return
+		}
+	}
+	if _, err = newRateLimitConfig(); err != nil {
+		return
+	}
+	if _, err = newACL(); err != nil {
+		return
+	}
+	if (optTLSCertFile == "") != (optTLSKeyFile == "") {
+		return errors.New("tls.cert_file and tls.key_file must be set together")
+	}
+	if optTLSCertFile != "" {
+		if err = newTLSCerts().Load(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// newACL returns acl from options, auth file is loaded each time
+func newACL() (a *ACL, err error) {
+	if a, err = ParseACL(optACLAllow, optACLDeny, optACLRules); err != nil {
+		return
+	}
+	if optAuthFile != "" {
+		if a.Users, err = LoadUsers(optAuthFile); err != nil {
+			return
+		}
+		if len(a.Users) == 0 {
+			err = errors.New("no user found in " + optAuthFile)
+		}
+	}
+	return
+}
+
+// newAuditSink returns audit sink from options, nil if disabled, client is used unless audit.redis_url is set
+func newAuditSink(client *redis.Client) (sink AuditSink, err error) {
+	if optAuditFile != "" {
+		return NewFileAuditSink(optAuditFile, int64(optAuditFileMaxSize), optAuditFileMaxBackups)
+	}
+	if optAuditStream == "" {
+		return
+	}
+	s := &StreamAuditSink{Redis: client, Key: optAuditStream, MaxLen: int64(optAuditStreamMaxLen)}
+	if optAuditRedisURL != "" {
+		var opts *redis.Options
+		if opts, err = redis.ParseURL(optAuditRedisURL); err != nil {
+			return
+		}
+		s.Redis = redis.NewClient(opts)
+		s.ownsRedis = true
+	}
+	return s, nil
+}
+
+// newTLSCerts returns tls certs from options, not loaded yet
+func newTLSCerts() *TLSCerts {
+	return &TLSCerts{
+		CertFile:     optTLSCertFile,
+		KeyFile:      optTLSKeyFile,
+		ClientCAFile: optTLSClientCAFile,
+	}
+}
+
+// newRateLimitConfig returns rate limit config from options
+func newRateLimitConfig() (config RateLimitConfig, err error) {
+	config.Mode = optRateLimitMode
+	config.MaxDelay = optRateLimitMaxDelay
+	switch config.Mode {
+	case RateLimitReject, RateLimitDelay:
+	default:
+		err = errors.New("invalid rate limit mode: " + config.Mode)
+		return
+	}
+	if config.Global, err = ParseBudget(optRateLimitGlobal); err != nil {
+		return
+	}
+	if config.PerIP, err = ParseBudget(optRateLimitPerIP); err != nil {
+		return
+	}
+	if config.PerUser, err = ParseBudget(optRateLimitPerUser); err != nil {
+		return
+	}
+	config.Overrides, err = ParseBudgetOverrides(optRateLimitOverrides)
+	return
+}
+
+// newRedisOptions returns redis options from url with overrides
+func newRedisOptions() (opts *redis.Options, err error) {
+	return newRedisOptionsFromURL(optRedisURL)
+}
+
+// newRedisOptionsFromURL parses redis url with pool and timeout options
+func newRedisOptionsFromURL(u string) (opts *redis.Options, err error) {
+	if opts, err = redis.ParseURL(u); err != nil {
+		return
+	}
+	if optRedisPoolSize > 0 {
+		opts.PoolSize = optRedisPoolSize
+	}
+	if optRedisDialTimeout > 0 {
+		opts.DialTimeout = optRedisDialTimeout
+	}
+	if optRedisReadTimeout > 0 {
+		opts.ReadTimeout = optRedisReadTimeout
+	}
+	if optRedisWriteTimeout > 0 {
+		opts.WriteTimeout = optRedisWriteTimeout
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "redmemd.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseArgs(t *testing.T) {
+	src, err := ParseArgs([]string{"migrate", "--config", "a.yaml", "--redis-url", "redis://a", "--log-conn-sample-rate=0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src.File != "a.yaml" || len(src.Subcommand) != 1 || src.Subcommand[0] != "migrate" {
+		t.Errorf("bad source: %+v", src)
+	}
+	if src.Flags["redis.url"] != "redis://a" || src.Flags["log.conn_sample_rate"] != "0.5" || len(src.Flags) != 2 {
+		t.Errorf("bad flags: %+v", src.Flags)
+	}
+	if src, err = ParseArgs([]string{"--check-config", "reencrypt"}); err != nil {
+		t.Fatal(err)
+	}
+	if !src.CheckOnly || len(src.Subcommand) != 1 || src.Subcommand[0] != "reencrypt" {
+		t.Errorf("bad source: %+v", src)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	values, err := LoadConfigFile(writeConfigFile(t, `
+port: 11212
+redis:
+  url: redis://b
+  read_timeout: 3s
+l1:
+  prefixes: [a, b]
+log:
+  conn_sample_rate: 0.5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"port":                 "11212",
+		"redis.url":            "redis://b",
+		"redis.read_timeout":   "3s",
+		"l1.prefixes":          "a,b",
+		"log.conn_sample_rate": "0.5",
+	} {
+		if values[k] != v {
+			t.Errorf("bad %s: %s", k, values[k])
+		}
+	}
+	if _, err = LoadConfigFile(writeConfigFile(t, "redis:\n  uri: redis://b\n")); err == nil {
+		t.Error("unknown key should fail")
+	}
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	os.Setenv("REDIS_URL", "redis://env")
+	os.Setenv("PORT", "11213")
+	defer os.Unsetenv("REDIS_URL")
+	defer os.Unsetenv("PORT")
+
+	src := ConfigSource{
+		File:  writeConfigFile(t, "port: 11212\nhttp_port: 9090\nredis:\n  url: redis://file\n"),
+		Flags: map[string]string{"redis.url": "redis://flag"},
+	}
+	values, err := src.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"redis.url":       "redis://flag",
+		"port":            "11213",
+		"http_port":       "9090",
+		"health.interval": "1s",
+	} {
+		if values[k] != v {
+			t.Errorf("bad %s: %s", k, values[k])
+		}
+	}
+}
+
+func TestReloadOptions(t *testing.T) {
+	file := writeConfigFile(t, "health:\n  max_latency: 50ms\nchunk_size: 1024\n")
+	src := ConfigSource{File: file}
+	if err := LoadOptions(src); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = LoadOptions(ConfigSource{})
+	}()
+
+	if err := ioutil.WriteFile(file, []byte("health:\n  max_latency: 200ms\nchunk_size: 2048\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ReloadOptions(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 1 || changed[0] != "health.max_latency" || optHealthMaxLatency != time.Millisecond*200 {
+		t.Errorf("reloadable option not applied: %v %s", changed, optHealthMaxLatency)
+	}
+	if optChunkSize != 1024 {
+		t.Errorf("non-reloadable option applied: %d", optChunkSize)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("health:\n  max_latency: 1s\nlog:\n  level: loud\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReloadOptions(src); err == nil {
+		t.Error("invalid option should fail")
+	}
+	if optHealthMaxLatency != time.Millisecond*200 || optLogLevel != "" {
+		t.Errorf("failed reload should roll back: %s %s", optHealthMaxLatency, optLogLevel)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// Keyring is a set of AES-GCM keys, the last key in key file is the current one
+type Keyring struct {
+	Current string
+	aeads   map[string]cipher.AEAD
+}
+
+// LoadKeyring loads key file, each line is "<key id> <base64 encoded 16, 24 or 32 bytes key>"
+func LoadKeyring(file string) (k *Keyring, err error) {
+	var f *os.File
+	if f, err = os.Open(file); err != nil {
+		return
+	}
+	defer f.Close()
+
+	k = &Keyring{aeads: map[string]cipher.AEAD{}}
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			// never echo the line, it may be a key without id
+			err = errors.New("invalid key file line " + strconv.Itoa(n))
+			return
+		}
+		var raw []byte
+		if raw, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return
+		}
+		var block cipher.Block
+		if block, err = aes.NewCipher(raw); err != nil {
+			return
+		}
+		var aead cipher.AEAD
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return
+		}
+		k.aeads[fields[0]] = aead
+		k.Current = fields[0]
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+	if k.Current == "" {
+		err = errors.New("no key found in " + file)
+		return
+	}
+	return
+}
+
+// Encrypt encrypts item value with current key, redis key is used as additional data
+func (k *Keyring) Encrypt(key string, item *Item) (*Item, error) {
+	aead := k.aeads[k.Current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(item.Value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := *item
+	out.Value = aead.Seal(nonce, nonce, item.Value, []byte(key))
+	out.KeyID = k.Current
+	return &out, nil
+}
+
+// Decrypt decrypts item value with the key it was encrypted with
+func (k *Keyring) Decrypt(key string, item *Item) (*Item, error) {
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	aead := k.aeads[item.KeyID]
+	if aead == nil {
+		return nil, ErrUnknownKey
+	}
+	if len(item.Value) < aead.NonceSize() {
+		return nil, ErrCorruptedValue
+	}
+	buf, err := aead.Open(nil, item.Value[:aead.NonceSize()], item.Value[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, ErrCorruptedValue
+	}
+	out := *item
+	out.Value = buf
+	out.KeyID = ""
+	return &out, nil
+}
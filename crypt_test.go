@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyring(t *testing.T, content string) *Keyring {
+	dir, err := ioutil.TempDir("", "redmemd")
+	if err != nil {
+		t.Fatalf("TempDir %+v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	file := filepath.Join(dir, "keys")
+	if err = ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatalf("WriteFile %+v", err)
+	}
+	k, err := LoadKeyring(file)
+	if err != nil {
+		t.Fatalf("LoadKeyring %+v", err)
+	}
+	return k
+}
+
+func TestKeyring(t *testing.T) {
+	k1 := testKeyring(t, "# old key\nk1 MDEyMzQ1Njc4OWFiY2RlZg==\n")
+	k2 := testKeyring(t, "k1 MDEyMzQ1Njc4OWFiY2RlZg==\nk2 MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n")
+	if k2.Current != "k2" {
+		t.Fatalf("Current %s", k2.Current)
+	}
+
+	item, err := k1.Encrypt("hello", &Item{Value: []byte("world"), Flags: "1"})
+	if err != nil {
+		t.Fatalf("Encrypt %+v", err)
+	}
+	if item.KeyID != "k1" || bytes.Contains(item.Value, []byte("world")) {
+		t.Errorf("Item %+v", item)
+	}
+	if _, err = k2.Decrypt("hello2", item); err != ErrCorruptedValue {
+		t.Errorf("Decrypt should fail with another key")
+	}
+	if item, err = k2.Decrypt("hello", item); err != nil {
+		t.Fatalf("Decrypt %+v", err)
+	}
+	if string(item.Value) != "world" || item.Flags != "1" || item.KeyID != "" {
+		t.Errorf("Item %+v", item)
+	}
+	if _, err = k1.Decrypt("hello", &Item{Value: []byte("world"), KeyID: "k3"}); err != ErrUnknownKey {
+		t.Errorf("Decrypt should fail with unknown key")
+	}
+}
+
+func TestLoadKeyringInvalidLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redmemd")
+	if err != nil {
+		t.Fatalf("TempDir %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "keys")
+	if err = ioutil.WriteFile(file, []byte("# key without id\nMDEyMzQ1Njc4OWFiY2RlZg==\n"), 0600); err != nil {
+		t.Fatalf("WriteFile %+v", err)
+	}
+	_, err = LoadKeyring(file)
+	if err == nil || err.Error() != "invalid key file line 2" {
+		t.Errorf("LoadKeyring should fail with line number: %v", err)
+	}
+}
@@ -6,4 +6,6 @@ require (
 	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/bsm/redislock v0.7.1
 	github.com/go-redis/redis/v8 v8.11.0
+	github.com/golang/snappy v0.0.4
+	gopkg.in/yaml.v2 v2.3.0
 )
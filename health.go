@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health tracks redis reachability with a background canary
+type Health struct {
+	Redis *redis.Client
+	// Shards are pinged instead of Redis if set, see Shards.Ping
+	Shards *Shards
+	// Interval is the interval between canary checks
+	Interval time.Duration
+	// MaxLatency is the canary latency above which the server is not ready
+	MaxLatency time.Duration
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	latency   time.Duration
+	lastErr   error
+	draining  bool
+}
+
+// HealthStatus is the readiness status
+type HealthStatus struct {
+	Ready     bool      `json:"ready"`
+	Reason    string    `json:"reason,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Latency   float64   `json:"latency"`
+	Draining  bool      `json:"draining"`
+}
+
+// Run checks redis every interval, until ctx is done
+func (h *Health) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Health) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, h.Interval)
+	defer cancel()
+	var (
+		latency time.Duration
+		err     error
+	)
+	if h.Shards != nil {
+		latency, err = h.Shards.Ping(ctx)
+	} else {
+		start := time.Now()
+		err = h.Redis.Ping(ctx).Err()
+		latency = time.Since(start)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkedAt = time.Now()
+	h.latency = latency
+	h.lastErr = err
+}
+
+// SetDraining marks the server as draining, it's never ready again
+func (h *Health) SetDraining() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+// SetMaxLatency changes the max latency
+func (h *Health) SetMaxLatency(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.MaxLatency = d
+}
+
+// Status returns the readiness status
+func (h *Health) Status() (s HealthStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.CheckedAt = h.checkedAt
+	s.Latency = h.latency.Seconds()
+	s.Draining = h.draining
+	switch {
+	case h.draining:
+		s.Reason = "draining"
+	case h.checkedAt.IsZero():
+		s.Reason = "redis not checked yet"
+	case time.Since(h.checkedAt) > h.Interval*3:
+		s.Reason = "redis check stalled"
+	case h.lastErr != nil:
+		s.Reason = "redis unreachable: " + h.lastErr.Error()
+	case h.latency > h.MaxLatency:
+		s.Reason = "redis latency too high: " + h.latency.String()
+	default:
+		s.Ready = true
+	}
+	return
+}
+
+// HandleLive serves liveness, it's alive as long as it responds
+func (h *Health) HandleLive(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]interface{}{"alive": true})
+}
+
+// HandleReady serves readiness
+func (h *Health) HandleReady(rw http.ResponseWriter, req *http.Request) {
+	s := h.Status()
+	if s.Ready {
+		writeJSON(rw, http.StatusOK, s)
+	} else {
+		writeJSON(rw, http.StatusServiceUnavailable, s)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthStatus(t *testing.T) {
+	h := &Health{Interval: time.Second, MaxLatency: time.Millisecond * 100}
+	if s := h.Status(); s.Ready {
+		t.Errorf("should not be ready before checked")
+	}
+
+	h.checkedAt, h.latency = time.Now(), time.Millisecond
+	if s := h.Status(); !s.Ready {
+		t.Errorf("should be ready, %s", s.Reason)
+	}
+
+	h.latency = time.Second
+	if s := h.Status(); s.Ready {
+		t.Errorf("should not be ready with high latency")
+	}
+
+	h.latency, h.lastErr = time.Millisecond, errors.New("connection refused")
+	if s := h.Status(); s.Ready {
+		t.Errorf("should not be ready with redis unreachable")
+	}
+
+	h.lastErr = nil
+	h.SetDraining()
+	if s := h.Status(); s.Ready || !s.Draining {
+		t.Errorf("should not be ready while draining")
+	}
+}
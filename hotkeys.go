@@ -0,0 +1,414 @@
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sketchWidth is the total width of sketches of a window, divided among shards
+	sketchWidth = 2048
+	sketchDepth = 4
+
+	// hotKeyBuckets is the number of sub-windows of a sliding window
+	hotKeyBuckets = 6
+)
+
+// sketchHash is the pair of hashes of a key, row i uses h1 + i*h2
+type sketchHash struct {
+	h1, h2 uint32
+}
+
+func newSketchHash(key string) sketchHash {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	return sketchHash{h1: uint32(sum), h2: uint32(sum>>32) | 1}
+}
+
+func (h sketchHash) index(row int, width int) int {
+	return int((h.h1 + uint32(row)*h.h2) % uint32(width))
+}
+
+// shard returns shard of key among n shards, taken from bits not used by indexes of narrow sketches
+func (h sketchHash) shard(n int) int {
+	return int((h.h2 >> 16) % uint32(n))
+}
+
+// CountMinSketch estimates frequencies of keys in fixed memory, estimates never undercount
+type CountMinSketch struct {
+	width  int
+	counts [sketchDepth][]uint32
+}
+
+// NewCountMinSketch creates a sketch of width counters per row
+func NewCountMinSketch(width int) *CountMinSketch {
+	s := &CountMinSketch{width: width}
+	for i := range s.counts {
+		s.counts[i] = make([]uint32, width)
+	}
+	return s
+}
+
+func (s *CountMinSketch) add(h sketchHash, n uint32) {
+	for i := range s.counts {
+		s.counts[i][h.index(i, s.width)] += n
+	}
+}
+
+func (s *CountMinSketch) count(h sketchHash) uint32 {
+	var min uint32
+	for i := range s.counts {
+		if c := s.counts[i][h.index(i, s.width)]; i == 0 || c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// Add adds n occurrences of key
+func (s *CountMinSketch) Add(key string, n uint32) {
+	s.add(newSketchHash(key), n)
+}
+
+// Count returns estimated occurrences of key
+func (s *CountMinSketch) Count(key string) uint32 {
+	return s.count(newSketchHash(key))
+}
+
+// Reset clears all counts
+func (s *CountMinSketch) Reset() {
+	for i := range s.counts {
+		for j := range s.counts[i] {
+			s.counts[i][j] = 0
+		}
+	}
+}
+
+// HotKey is a key and its estimated occurrences
+type HotKey struct {
+	Key   string  `json:"key"`
+	Count uint64  `json:"count"`
+	Rate  float64 `json:"rate"`
+}
+
+type topKItem struct {
+	key   string
+	count uint64
+	index int
+}
+
+type topKHeap []*topKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	item := x.(*topKItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// TopK keeps k keys of the largest counts, with a min heap
+type TopK struct {
+	k     int
+	heap  topKHeap
+	items map[string]*topKItem
+}
+
+// NewTopK creates a top k
+func NewTopK(k int) *TopK {
+	return &TopK{k: k, items: map[string]*topKItem{}}
+}
+
+// Update sets count of key, key is kept if count is among the largest k
+func (t *TopK) Update(key string, count uint64) {
+	if item := t.items[key]; item != nil {
+		item.count = count
+		heap.Fix(&t.heap, item.index)
+		return
+	}
+	if len(t.heap) < t.k {
+		item := &topKItem{key: key, count: count}
+		heap.Push(&t.heap, item)
+		t.items[key] = item
+		return
+	}
+	if len(t.heap) == 0 || count <= t.heap[0].count {
+		return
+	}
+	min := t.heap[0]
+	delete(t.items, min.key)
+	min.key, min.count = key, count
+	heap.Fix(&t.heap, 0)
+	t.items[key] = min
+}
+
+// Keys returns keys kept, in no particular order
+func (t *TopK) Keys() []string {
+	keys := make([]string, 0, len(t.heap))
+	for _, item := range t.heap {
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+// Reset removes all keys
+func (t *TopK) Reset() {
+	t.heap = nil
+	t.items = map[string]*topKItem{}
+}
+
+type hotKeyBucket struct {
+	sketch *CountMinSketch
+	top    *TopK
+}
+
+// HotKeyTracker tracks hot keys over a sliding window, which is made of sub-windows rotated in turn
+type HotKeyTracker struct {
+	window  time.Duration
+	buckets [hotKeyBuckets]*hotKeyBucket
+	current int
+	// start is the start time of current bucket
+	start time.Time
+}
+
+// NewHotKeyTracker creates a tracker keeping top k keys, with sketches of width counters per row
+func NewHotKeyTracker(k int, width int, window time.Duration, now time.Time) *HotKeyTracker {
+	t := &HotKeyTracker{window: window, start: now}
+	for i := range t.buckets {
+		// candidates beyond k make the top more accurate as buckets expire
+		t.buckets[i] = &hotKeyBucket{sketch: NewCountMinSketch(width), top: NewTopK(k * 2)}
+	}
+	return t
+}
+
+func (t *HotKeyTracker) rotate(now time.Time) {
+	size := t.window / hotKeyBuckets
+	for i := 0; now.Sub(t.start) >= size; i++ {
+		if i >= hotKeyBuckets {
+			// all buckets expired
+			t.start = now
+			break
+		}
+		t.current = (t.current + 1) % hotKeyBuckets
+		t.buckets[t.current].sketch.Reset()
+		t.buckets[t.current].top.Reset()
+		t.start = t.start.Add(size)
+	}
+}
+
+func (t *HotKeyTracker) count(h sketchHash) (count uint64) {
+	for _, b := range t.buckets {
+		count += uint64(b.sketch.count(h))
+	}
+	return
+}
+
+// Add records an access of key, returns estimated accesses in window
+func (t *HotKeyTracker) Add(key string, now time.Time) uint64 {
+	t.rotate(now)
+	h := newSketchHash(key)
+	b := t.buckets[t.current]
+	b.sketch.add(h, 1)
+	count := t.count(h)
+	b.top.Update(key, count)
+	return count
+}
+
+// Top returns at most n hottest keys in window, hottest first
+func (t *HotKeyTracker) Top(n int, now time.Time) []HotKey {
+	t.rotate(now)
+	seen := map[string]bool{}
+	var keys []HotKey
+	for _, b := range t.buckets {
+		for _, key := range b.top.Keys() {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			count := t.count(newSketchHash(key))
+			keys = append(keys, HotKey{Key: key, Count: count, Rate: float64(count) / t.window.Seconds()})
+		}
+	}
+	return topHotKeys(keys, n)
+}
+
+// hotKeyShards is the number of shards of hot keys, keys are tracked by shard of their hashes to avoid a global lock,
+// each shard sees its share of keys and has its share of sketch width, memory is the same as a single tracker
+const hotKeyShards = 16
+
+// hotKeyShard tracks keys of a shard
+type hotKeyShard struct {
+	mu    sync.Mutex
+	read  *HotKeyTracker
+	write *HotKeyTracker
+	// logged is when a key is logged as hot, a key is logged once per window
+	logged    map[string]time.Time
+	lastPrune time.Time
+}
+
+// HotKeys detects hot read and write keys
+type HotKeys struct {
+	enabled int32
+
+	// mu guards settings, locked before shards
+	mu        sync.RWMutex
+	top       int
+	window    time.Duration
+	threshold float64
+	shards    [hotKeyShards]hotKeyShard
+}
+
+var hotKeys = &HotKeys{}
+
+// Configure changes settings, keys tracked are reset if top or window changes, disabled if top is 0
+func (h *HotKeys) Configure(top int, window time.Duration, threshold float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.threshold = threshold
+	if top == h.top && window == h.window && h.shards[0].read != nil {
+		return
+	}
+	h.top, h.window = top, window
+	now := time.Now()
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.Lock()
+		s.read, s.write, s.logged = nil, nil, nil
+		if top > 0 {
+			s.read = NewHotKeyTracker(top, sketchWidth/hotKeyShards, window, now)
+			s.write = NewHotKeyTracker(top, sketchWidth/hotKeyShards, window, now)
+			s.logged = map[string]time.Time{}
+		}
+		s.mu.Unlock()
+	}
+	if top > 0 {
+		atomic.StoreInt32(&h.enabled, 1)
+	} else {
+		atomic.StoreInt32(&h.enabled, 0)
+	}
+}
+
+// Record records accesses of keys by command, only reads and writes of keys are recorded
+func (h *HotKeys) Record(command string, keys []string) {
+	if atomic.LoadInt32(&h.enabled) == 0 || len(keys) == 0 {
+		return
+	}
+	op := "read"
+	switch {
+	case command == "get" || command == "gets":
+	case isMutatingCommand(command):
+		op = "write"
+	default:
+		return
+	}
+	now := time.Now()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, key := range keys {
+		h.shards[newSketchHash(key).shard(hotKeyShards)].record(op, key, now, h.window, h.threshold)
+	}
+}
+
+func (s *hotKeyShard) record(op string, key string, now time.Time, window time.Duration, threshold float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tracker := s.read
+	if op == "write" {
+		tracker = s.write
+	}
+	if tracker == nil {
+		return
+	}
+	count := tracker.Add(key, now)
+	if now.Sub(s.lastPrune) >= window {
+		s.lastPrune = now
+		for name, last := range s.logged {
+			if now.Sub(last) >= window {
+				delete(s.logged, name)
+			}
+		}
+	}
+	if threshold <= 0 {
+		return
+	}
+	if rate := float64(count) / window.Seconds(); rate >= threshold {
+		name := op + " " + key
+		if last, ok := s.logged[name]; ok && now.Sub(last) < window {
+			return
+		}
+		s.logged[name] = now
+		logger.Warn("hot key detected", "op", op, "key", key, "count", count, "rate", strconv.FormatFloat(rate, 'f', 2, 64), "window", window)
+	}
+}
+
+// Top returns the hottest read and write keys
+func (h *HotKeys) Top() (read, write []HotKey) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if atomic.LoadInt32(&h.enabled) == 0 {
+		return
+	}
+	now := time.Now()
+	for i := range h.shards {
+		s := &h.shards[i]
+		s.mu.Lock()
+		if s.read != nil {
+			read = append(read, s.read.Top(h.top, now)...)
+			write = append(write, s.write.Top(h.top, now)...)
+		}
+		s.mu.Unlock()
+	}
+	return topHotKeys(read, h.top), topHotKeys(write, h.top)
+}
+
+// topHotKeys sorts keys hottest first, returns at most n of them
+func topHotKeys(keys []HotKey, n int) []HotKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// Report returns hot keys as stats lines of "<op>:<rank> key=<key> count=<count> rate=<rate>"
+func (h *HotKeys) Report() []string {
+	read, write := h.Top()
+	var lines []string
+	for _, op := range []struct {
+		name string
+		keys []HotKey
+	}{{"read", read}, {"write", write}} {
+		for i, k := range op.keys {
+			lines = append(lines, op.name+":"+strconv.Itoa(i+1)+
+				" key="+k.Key+
+				" count="+strconv.FormatUint(k.Count, 10)+
+				" rate="+strconv.FormatFloat(k.Rate, 'f', 2, 64))
+		}
+	}
+	return lines
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(sketchWidth)
+	for i := 0; i < 10000; i++ {
+		s.Add("key"+strconv.Itoa(i), 1)
+	}
+	s.Add("hot", 500)
+	if c := s.Count("hot"); c < 500 || c > 520 {
+		t.Errorf("bad estimate: %d", c)
+	}
+	s.Reset()
+	if c := s.Count("hot"); c != 0 {
+		t.Errorf("bad estimate after reset: %d", c)
+	}
+}
+
+func TestTopK(t *testing.T) {
+	top := NewTopK(2)
+	top.Update("a", 1)
+	top.Update("b", 2)
+	top.Update("c", 3)
+	top.Update("d", 1)
+	top.Update("a", 5)
+	keys := top.Keys()
+	if len(keys) != 2 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+	for _, key := range keys {
+		if key != "a" && key != "c" {
+			t.Errorf("bad keys: %v", keys)
+		}
+	}
+}
+
+func TestHotKeyTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewHotKeyTracker(2, sketchWidth, time.Minute, now)
+	for i := 0; i < 30; i++ {
+		tracker.Add("a", now)
+	}
+	for i := 0; i < 20; i++ {
+		tracker.Add("b", now.Add(time.Second*30))
+	}
+	tracker.Add("c", now.Add(time.Second*30))
+
+	keys := tracker.Top(2, now.Add(time.Second*30))
+	if len(keys) != 2 || keys[0].Key != "a" || keys[0].Count != 30 || keys[1].Key != "b" || keys[0].Rate != 0.5 {
+		t.Errorf("bad top: %+v", keys)
+	}
+	// accesses of a expired
+	keys = tracker.Top(2, now.Add(time.Second*70))
+	if len(keys) != 2 || keys[0].Key != "b" || keys[0].Count != 20 || keys[1].Key != "c" {
+		t.Errorf("bad top after sliding: %+v", keys)
+	}
+	if keys = tracker.Top(2, now.Add(time.Hour)); len(keys) != 0 {
+		t.Errorf("bad top after all expired: %+v", keys)
+	}
+}
+
+func TestHotKeys(t *testing.T) {
+	h := &HotKeys{}
+	h.Record("get", []string{"a"})
+	if read, _ := h.Top(); len(read) != 0 {
+		t.Error("should be disabled")
+	}
+	h.Configure(1, time.Minute, 0)
+	h.Record("get", []string{"a", "b", "a"})
+	h.Record("set", []string{"c"})
+	h.Record("stats", []string{"slowlog"})
+	lines := h.Report()
+	if len(lines) != 2 || lines[0] != "read:1 key=a count=2 rate=0.03" || !strings.HasPrefix(lines[1], "write:1 key=c count=1 ") {
+		t.Errorf("bad report: %v", lines)
+	}
+	// keys are kept if top and window not changed
+	h.Configure(1, time.Minute, 10)
+	if lines = h.Report(); len(lines) != 2 {
+		t.Errorf("bad report after configure: %v", lines)
+	}
+	h.Configure(0, time.Minute, 0)
+	if lines = h.Report(); len(lines) != 0 {
+		t.Errorf("bad report after disabled: %v", lines)
+	}
+}
+
+func TestHotKeysShards(t *testing.T) {
+	h := &HotKeys{}
+	h.Configure(3, time.Minute, 0)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.Record("get", []string{"key" + strconv.Itoa(j%10), "hot1", "hot2"})
+			}
+		}()
+	}
+	wg.Wait()
+	read, _ := h.Top()
+	if len(read) != 3 || read[0].Key != "hot1" || read[0].Count != 800 || read[1].Key != "hot2" || read[2].Count != 80 {
+		t.Errorf("bad top: %+v", read)
+	}
+	// shards share the sketch width of a single tracker
+	var width int
+	for i := range h.shards {
+		width += h.shards[i].read.buckets[0].sketch.width
+	}
+	if width != sketchWidth {
+		t.Errorf("bad total sketch width: %d", width)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Limits are reloadable connection limits, zero values mean unlimited
+type Limits struct {
+	maxConnections int64
+	idleTimeout    int64
+	readTimeout    int64
+	writeTimeout   int64
+	keepAlive      int64
+}
+
+var limits = &Limits{}
+
+// ErrIdleTimeout is returned if no request arrived within idle timeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// Set changes all limits
+func (l *Limits) Set(maxConnections int, idleTimeout, readTimeout, writeTimeout, keepAlive time.Duration) {
+	atomic.StoreInt64(&l.maxConnections, int64(maxConnections))
+	atomic.StoreInt64(&l.idleTimeout, int64(idleTimeout))
+	atomic.StoreInt64(&l.readTimeout, int64(readTimeout))
+	atomic.StoreInt64(&l.writeTimeout, int64(writeTimeout))
+	atomic.StoreInt64(&l.keepAlive, int64(keepAlive))
+}
+
+// MaxConnections returns max number of active connections
+func (l *Limits) MaxConnections() int64 {
+	return atomic.LoadInt64(&l.maxConnections)
+}
+
+// IdleTimeout returns max time waiting for the next request
+func (l *Limits) IdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.idleTimeout))
+}
+
+// ReadTimeout returns max time reading a request once it started
+func (l *Limits) ReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.readTimeout))
+}
+
+// WriteTimeout returns max time writing a response
+func (l *Limits) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.writeTimeout))
+}
+
+// KeepAlive returns tcp keepalive period of new connections
+func (l *Limits) KeepAlive() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.keepAlive))
+}
+
+// deadline returns deadline after d, or no deadline if d is zero
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// waitRequest waits for the first byte of next request within idle timeout, then marks the session busy and
+// sets read deadline for the whole request and write deadline for its response, returns whether session is draining
+func (l *Limits) waitRequest(s *Session, r *bufio.Reader) (draining bool, err error) {
+	if r.Buffered() == 0 {
+		if err = s.SetIdleDeadline(deadline(l.IdleTimeout())); err != nil {
+			return
+		}
+		if _, err = r.Peek(1); err != nil {
+			if isTimeout(err) {
+				err = ErrIdleTimeout
+			}
+			return
+		}
+	}
+	return s.Begin(deadline(l.ReadTimeout()), deadline(l.WriteTimeout()))
+}
+
+// isTimeout returns whether err is a deadline exceeded error
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
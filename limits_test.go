@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitsWaitRequest(t *testing.T) {
+	l := &Limits{}
+	l.Set(0, time.Millisecond*50, time.Millisecond*50, 0, 0)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	r := bufio.NewReader(server)
+	session := &Session{conn: server}
+
+	if _, err := l.waitRequest(session, r); err != ErrIdleTimeout {
+		t.Errorf("should be idle timeout: %v", err)
+	}
+
+	go func() {
+		_, _ = client.Write([]byte("get"))
+	}()
+	if _, err := l.waitRequest(session, r); err != nil {
+		t.Fatalf("should not time out: %v", err)
+	}
+	// the rest of request never comes
+	buf := make([]byte, 16)
+	n, _ := r.Read(buf)
+	if _, err := r.Read(buf[n:]); !isTimeout(err) {
+		t.Errorf("should be read timeout: %v", err)
+	}
+}
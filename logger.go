@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is a log level
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLevel parses a level name
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New("invalid log level: " + s)
+}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// Logger is a leveled logger writing logfmt or json lines
+type Logger struct {
+	JSON bool
+
+	mu    sync.Mutex
+	out   io.Writer
+	level int32
+}
+
+var logger = &Logger{out: os.Stderr, level: int32(LevelInfo)}
+
+// Enabled returns whether level is enabled
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Level returns current level
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes current level
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Log writes a line with key value pairs, if level is enabled
+func (l *Logger) Log(level Level, msg string, kvs ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	if l.JSON {
+		b.WriteString("{")
+		writeJSONField(&b, "time", time.Now().Format(time.RFC3339Nano))
+		b.WriteString(",")
+		writeJSONField(&b, "level", level.String())
+		b.WriteString(",")
+		writeJSONField(&b, "msg", msg)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			b.WriteString(",")
+			writeJSONField(&b, fmt.Sprint(kvs[i]), logValue(kvs[i+1]))
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString("time=")
+		b.WriteString(time.Now().Format(time.RFC3339Nano))
+		b.WriteString(" level=")
+		b.WriteString(level.String())
+		b.WriteString(" msg=")
+		writeLogfmtValue(&b, msg)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			b.WriteString(" ")
+			b.WriteString(fmt.Sprint(kvs[i]))
+			b.WriteString("=")
+			writeLogfmtValue(&b, fmt.Sprint(logValue(kvs[i+1])))
+		}
+		b.WriteString("\n")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(b.Bytes())
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONField(b *bytes.Buffer, k string, v interface{}) {
+	kb, _ := json.Marshal(k)
+	vb, err := json.Marshal(v)
+	if err != nil {
+		vb, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(kb)
+	b.WriteString(":")
+	b.Write(vb)
+}
+
+func writeLogfmtValue(b *bytes.Buffer, s string) {
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		b.WriteString(strconv.Quote(s))
+	} else {
+		b.WriteString(s)
+	}
+}
+
+// Debug logs with debug level
+func (l *Logger) Debug(msg string, kvs ...interface{}) {
+	l.Log(LevelDebug, msg, kvs...)
+}
+
+// Info logs with info level
+func (l *Logger) Info(msg string, kvs ...interface{}) {
+	l.Log(LevelInfo, msg, kvs...)
+}
+
+// Warn logs with warn level
+func (l *Logger) Warn(msg string, kvs ...interface{}) {
+	l.Log(LevelWarn, msg, kvs...)
+}
+
+// Error logs with error level
+func (l *Logger) Error(msg string, kvs ...interface{}) {
+	l.Log(LevelError, msg, kvs...)
+}
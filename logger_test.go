@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil {
+			t.Errorf("failed to parse %s: %s", name, err.Error())
+		}
+		if level.String() != strings.ToLower(name) {
+			t.Errorf("bad level for %s: %s", name, level)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := &Logger{out: out, level: int32(LevelInfo)}
+	l.Debug("hidden")
+	if out.Len() != 0 {
+		t.Error("debug should be filtered")
+	}
+	l.Warn("hello world", "key", "a b", "n", 1, "err", errors.New("boom"), "empty", "")
+	line := out.String()
+	for _, s := range []string{` level=warn `, ` msg="hello world"`, ` key="a b"`, ` n=1`, ` err=boom`, ` empty=""`} {
+		if !strings.Contains(line, s) {
+			t.Errorf("missing %s in %s", s, line)
+		}
+	}
+	if !strings.HasSuffix(line, "\n") {
+		t.Error("missing newline")
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := &Logger{JSON: true, out: out, level: int32(LevelDebug)}
+	l.Debug("hello", "n", 1, "err", errors.New("boom"))
+	var m map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "debug" || m["msg"] != "hello" || m["n"] != float64(1) || m["err"] != "boom" {
+		t.Errorf("bad json: %s", out.String())
+	}
+}
@@ -3,47 +3,249 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"github.com/bsm/redislock"
 	"github.com/go-redis/redis/v8"
 	"go.guoyk.net/redmemd/memwire"
 	"io"
-	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 var (
-	optPort     = strings.TrimSpace(os.Getenv("PORT"))
-	optRedisURL = strings.TrimSpace(os.Getenv("REDIS_URL"))
-	optDebug, _ = strconv.ParseBool(os.Getenv("DEBUG"))
+	optPort     string
+	optHTTPPort string
+
+	optRedisURL          string
+	optRedisPoolSize     int
+	optRedisDialTimeout  time.Duration
+	optRedisReadTimeout  time.Duration
+	optRedisWriteTimeout time.Duration
+
+	optRedisShards             string
+	optRedisShardCheckInterval time.Duration
+	optRedisShardEjectFailures int
+
+	optLayout   string
+	optLayoutNS string
+
+	optCompressThreshold int
+	optEncryptionKeyFile string
+	optChunkSize         int
+
+	optChunkSweepInterval time.Duration
+
+	optL1Size     int
+	optL1Prefixes string
+
+	optAdminToken string
+
+	optMaxConnections int
+	optIdleTimeout    time.Duration
+	optReadTimeout    time.Duration
+	optWriteTimeout   time.Duration
+	optTCPKeepAlive   time.Duration
+
+	optRateLimitMode      string
+	optRateLimitMaxDelay  time.Duration
+	optRateLimitGlobal    string
+	optRateLimitPerIP     string
+	optRateLimitPerUser   string
+	optRateLimitOverrides string
+
+	optACLAllow string
+	optACLDeny  string
+	optACLRules string
+	optAuthFile string
+
+	optTLSCertFile     string
+	optTLSKeyFile      string
+	optTLSClientCAFile string
+
+	optHealthInterval   time.Duration
+	optHealthMaxLatency time.Duration
+	optShutdownDelay    time.Duration
+	optShutdownGrace    time.Duration
+
+	optSlowlogThreshold time.Duration
+	optSlowlogMaxLen    int
+
+	optHotKeysTop          int
+	optHotKeysWindow       time.Duration
+	optHotKeysLogThreshold float64
+
+	optMetaDumpRate   float64
+	optMetaDumpFormat string
+	optMetaDumpOutput string
+
+	optBackupCompress         bool
+	optBackupResume           bool
+	optBackupProgressInterval time.Duration
+
+	optMemcachedSource           string
+	optMemcachedRate             float64
+	optMemcachedOverwrite        bool
+	optMemcachedCheckpoint       string
+	optMemcachedResume           bool
+	optMemcachedProgressInterval time.Duration
+
+	optShadowAddr        string
+	optShadowConcurrency int
+	optShadowLogRate     float64
+
+	optMirrorURL          string
+	optMirrorConcurrency  int
+	optMirrorQueueSize    int
+	optMirrorRetries      int
+	optMirrorReadFallback bool
+
+	optAuditFile           string
+	optAuditFileMaxSize    int
+	optAuditFileMaxBackups int
+	optAuditStream         string
+	optAuditStreamMaxLen   int
+	optAuditRedisURL       string
+
+	optDebug             bool
+	optLogLevel          string
+	optLogFormat         string
+	optLogConnSampleRate float64
+
+	optTraceEndpoint    string
+	optTraceSampleRatio float64
+	optTraceServiceName string
+
+	namespaces Namespaces
+	keyring    *Keyring
+	cache      *Cache
+	tracer     *Tracer
+	tlsConfig  *tls.Config
+
+	// logConnSampleRate is the reloadable sample rate of connection logs, float64
+	logConnSampleRate atomic.Value
 )
 
+// logLevel returns level from options
+func logLevel() Level {
+	if optLogLevel != "" {
+		level, _ := ParseLevel(optLogLevel)
+		return level
+	}
+	if optDebug {
+		return LevelDebug
+	}
+	return LevelInfo
+}
+
 func main() {
 	var err error
 	defer func(err *error) {
 		if *err != nil {
-			log.Println("exited with error:", (*err).Error())
+			logger.Error("exited with error", "err", *err)
 			os.Exit(1)
 		} else {
-			log.Println("exited")
+			logger.Info("exited")
 		}
 	}(&err)
 
 	rand.Seed(time.Now().UnixNano())
 
-	if optPort == "" {
-		optPort = "11211"
+	var src ConfigSource
+	if src, err = ParseArgs(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			err = nil
+		}
+		return
+	}
+
+	if err = LoadOptions(src); err != nil {
+		return
+	}
+
+	if err = ValidateOptions(); err != nil {
+		return
+	}
+
+	if src.CheckOnly {
+		logger.Info("config ok", "file", src.File)
+		return
+	}
+
+	logger.JSON = optLogFormat == "json"
+	logger.SetLevel(logLevel())
+	logConnSampleRate.Store(optLogConnSampleRate)
+	limits.Set(optMaxConnections, optIdleTimeout, optReadTimeout, optWriteTimeout, optTCPKeepAlive)
+	slowlog.Configure(optSlowlogThreshold, optSlowlogMaxLen)
+	hotKeys.Configure(optHotKeysTop, optHotKeysWindow, optHotKeysLogThreshold)
+
+	var rateLimitConfig RateLimitConfig
+	if rateLimitConfig, err = newRateLimitConfig(); err != nil {
+		return
+	}
+	rateLimiter.Configure(rateLimitConfig)
+
+	var access *ACL
+	if access, err = newACL(); err != nil {
+		return
+	}
+	setACL(access)
+
+	var tlsCerts *TLSCerts
+	if optTLSCertFile != "" {
+		tlsCerts = newTLSCerts()
+		if err = tlsCerts.Load(); err != nil {
+			return
+		}
+		tlsConfig = tlsCerts.Config()
 	}
 
-	if optRedisURL == "" {
-		optRedisURL = "redis://127.0.0.1:6379/0"
+	if namespaces, err = ParseNamespaces(optLayout, optLayoutNS); err != nil {
+		return
+	}
+
+	if optEncryptionKeyFile != "" {
+		if keyring, err = LoadKeyring(optEncryptionKeyFile); err != nil {
+			return
+		}
+		logger.Info("using encryption key", "key_id", keyring.Current)
+	}
+
+	if shards, err = newShards(); err != nil {
+		return
+	}
+	if shards != nil {
+		defer shards.Close()
+		logger.Info("using shards", "shards", len(shards.All()))
+	}
+
+	if len(src.Subcommand) > 0 {
+		switch src.Subcommand[0] {
+		case "migrate":
+			err = runMigrate()
+		case "reencrypt":
+			err = runReencrypt()
+		case "dump-meta":
+			err = runDumpMeta(src.Subcommand[1:])
+		case "migrate-memcached":
+			err = runMigrateMemcached()
+		case "export":
+			err = runExport(src.Subcommand[1:])
+		case "import":
+			err = runImport(src.Subcommand[1:])
+		default:
+			err = errors.New("unknown command: " + src.Subcommand[0])
+		}
+		return
 	}
 
 	var addr *net.TCPAddr
@@ -51,7 +253,7 @@ func main() {
 		return
 	}
 
-	log.Println("using addr:", addr.String())
+	logger.Info("using addr", "addr", addr)
 
 	var listener *net.TCPListener
 	if listener, err = net.ListenTCP("tcp", addr); err != nil {
@@ -59,20 +261,158 @@ func main() {
 	}
 
 	var redisOptions *redis.Options
-	if redisOptions, err = redis.ParseURL(optRedisURL); err != nil {
+	if redisOptions, err = newRedisOptions(); err != nil {
 		return
 	}
 
-	log.Println("using redis:", redisOptions.Addr)
+	logger.Info("using redis", "addr", redisOptions.Addr)
+
+	client := redis.NewClient(redisOptions)
+	defer client.Close()
+	client.AddHook(TimingHook{})
+
+	var secondary *Store
+	if optMirrorURL != "" {
+		if secondary, err = newMirrorStore(); err != nil {
+			return
+		}
+		defer secondary.Redis.Close()
+	}
 
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
+	// tracer outlives connections, to export their last spans
+	traceCtx, traceCancel := context.WithCancel(context.Background())
+	var traceDone chan struct{}
+
+	if optTraceEndpoint != "" {
+		tracer = NewTracer(optTraceEndpoint, optTraceServiceName, optTraceSampleRatio)
+		client.AddHook(TracingHook{})
+		if secondary != nil {
+			secondary.Redis.AddHook(TracingHook{})
+		}
+		if shards != nil {
+			for _, c := range shards.Clients() {
+				c.AddHook(TracingHook{})
+			}
+		}
+		traceDone = make(chan struct{})
+		go func() {
+			defer close(traceDone)
+			tracer.Run(traceCtx, time.Second*5)
+		}()
+		logger.Info("using tracing", "endpoint", tracer.Endpoint, "ratio", optTraceSampleRatio)
+	}
+
+	// audit log outlives connections too, to write their last records
+	auditCtx, auditCancel := context.WithCancel(context.Background())
+	var auditDone chan struct{}
+
+	var auditSink AuditSink
+	if auditSink, err = newAuditSink(client); err != nil {
+		traceCancel()
+		auditCancel()
+		return
+	}
+	if auditSink != nil {
+		auditor = NewAuditor(auditSink)
+		auditDone = make(chan struct{})
+		go func() {
+			defer close(auditDone)
+			auditor.Run(auditCtx)
+		}()
+		logger.Info("using audit log", "file", optAuditFile, "stream", optAuditStream)
+	}
+
+	if optL1Size > 0 {
+		var prefixes []string
+		for _, prefix := range strings.Split(optL1Prefixes, ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		cache = NewCache(optL1Size, prefixes)
+		if shards != nil {
+			for _, shard := range shards.All() {
+				go cache.RunInvalidation(ctx, shard.Name, shard.Options)
+			}
+		} else {
+			go cache.RunInvalidation(ctx, "", redisOptions)
+		}
+		logger.Info("using l1 cache", "bytes", optL1Size)
+	}
+
+	if shards != nil && shards.EjectFailures > 0 {
+		go shards.Run(ctx, optRedisShardCheckInterval)
+	}
+
+	if optChunkSize > 0 && optChunkSweepInterval > 0 {
+		go newStore(client).RunChunkSweeper(ctx, optChunkSweepInterval)
+	}
+
+	if optShadowAddr != "" {
+		shadow = NewShadow(optShadowAddr, optShadowConcurrency, optShadowLogRate)
+		go shadow.Run(ctx)
+		logger.Info("using shadow mode", "addr", optShadowAddr)
+	}
+
+	// mirror outlives connections too, to replay their last writes
+	mirrorCtx, mirrorCancel := context.WithCancel(context.Background())
+	var mirrorDone chan struct{}
+
+	if secondary != nil {
+		// the primary store is created before mirror is set, reads of the mirror are neither mirrored nor fallen back
+		mirror = NewMirror(newStore(client), secondary, optMirrorConcurrency, optMirrorQueueSize, optMirrorRetries)
+		mirrorDone = make(chan struct{})
+		go func() {
+			defer close(mirrorDone)
+			mirror.Run(mirrorCtx)
+		}()
+		logger.Info("using mirror", "addr", secondary.Redis.Options().Addr, "read_fallback", optMirrorReadFallback)
+	}
+
 	wg := &sync.WaitGroup{}
 
 	chErr := make(chan error, 1)
+
+	var admin *Admin
+
+	health := &Health{
+		Redis:      client,
+		Shards:     shards,
+		Interval:   optHealthInterval,
+		MaxLatency: optHealthMaxLatency,
+	}
+
+	if optHTTPPort != "" {
+		go health.Run(ctx)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", MetricsHandler(redisPools(client, shards)))
+		mux.HandleFunc("/healthz", health.HandleLive)
+		mux.HandleFunc("/readyz", health.HandleReady)
+		if optAdminToken != "" {
+			admin = &Admin{Token: optAdminToken, Redis: client}
+			mux.Handle("/admin/", admin.Handler())
+		}
+
+		s := &http.Server{Addr: "0.0.0.0:" + optHTTPPort, Handler: mux}
+		defer s.Close()
+
+		logger.Info("using http addr", "addr", s.Addr)
+
+		go func() {
+			if err1 := s.ListenAndServe(); err1 != nil && err1 != http.ErrServerClosed {
+				chErr <- err1
+			}
+		}()
+	}
+
 	chSig := make(chan os.Signal, 1)
+	chHup := make(chan os.Signal, 1)
 
 	signal.Notify(chSig, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(chHup, syscall.SIGHUP)
 
 	go func() {
 		for {
@@ -80,107 +420,307 @@ func main() {
 				chErr <- err1
 				return
 			} else {
+				if !currentACL().AllowConn(conn.RemoteAddr().(*net.TCPAddr).IP) {
+					stats.ACLDeniedConnections.Add(1)
+					logger.Debug("connection denied", "remote", conn.RemoteAddr())
+					_ = conn.Close()
+					continue
+				}
+				// connections are counted here, not in handleConn, so the limit can't be overrun by a burst
+				if max := limits.MaxConnections(); max > 0 && metrics.ConnectionsActive.Load() >= max {
+					rejectConn(conn)
+					continue
+				}
+				metrics.ConnectionsTotal.Add(1)
+				metrics.ConnectionsActive.Add(1)
 				wg.Add(1)
-				go handleConn(ctx, wg, conn)
+				go handleConn(ctx, wg, conn, client)
 			}
 		}
 	}()
 
-	select {
-	case err = <-chErr:
-	case sig := <-chSig:
-		log.Println("signal caught:", sig.String())
+loop:
+	for {
+		select {
+		case err = <-chErr:
+			break loop
+		case sig := <-chSig:
+			logger.Info("signal caught", "signal", sig)
+			break loop
+		case <-chHup:
+			var changed []string
+			if changed, err = ReloadOptions(src); err != nil {
+				logger.Error("failed to reload config", "err", err)
+				err = nil
+				continue
+			}
+			// only reloadable options are applied here, they must be safe to change at runtime
+			logger.SetLevel(logLevel())
+			logConnSampleRate.Store(optLogConnSampleRate)
+			limits.Set(optMaxConnections, optIdleTimeout, optReadTimeout, optWriteTimeout, optTCPKeepAlive)
+			slowlog.Configure(optSlowlogThreshold, optSlowlogMaxLen)
+			hotKeys.Configure(optHotKeysTop, optHotKeysWindow, optHotKeysLogThreshold)
+			for _, name := range changed {
+				if strings.HasPrefix(name, "rate_limit.") {
+					// validated by ReloadOptions, buckets are reset
+					rateLimitConfig, _ = newRateLimitConfig()
+					rateLimiter.Configure(rateLimitConfig)
+					break
+				}
+			}
+			health.SetMaxLatency(optHealthMaxLatency)
+			if admin != nil {
+				admin.SetToken(optAdminToken)
+			}
+			if tracer != nil {
+				tracer.SetRatio(optTraceSampleRatio)
+			}
+			// auth file and tls certificates are reloaded even if their paths are not changed
+			if access, err = newACL(); err != nil {
+				logger.Error("failed to reload acl", "err", err)
+				err = nil
+			} else {
+				setACL(access)
+			}
+			if tlsCerts != nil {
+				if err = tlsCerts.Load(); err != nil {
+					logger.Error("failed to reload tls certificates", "err", err)
+					err = nil
+				}
+			}
+			logger.Info("config reloaded", "changed", strings.Join(changed, ","))
+		}
+	}
+
+	health.SetDraining()
+
+	// a second signal skips the delay and grace period
+	var forced bool
+
+	if err == nil && optShutdownDelay > 0 {
+		logger.Info("waiting for load balancers", "delay", optShutdownDelay)
+		select {
+		case <-time.After(optShutdownDelay):
+		case sig := <-chSig:
+			logger.Warn("signal caught again, forcing exit", "signal", sig)
+			forced = true
+		}
 	}
 
 	_ = listener.Close()
 
+	drainStart := time.Now()
+	active := metrics.ConnectionsActive.Load()
+
+	logger.Info("draining connections", "connections", active, "grace_period", optShutdownGrace)
+	sessions.Drain()
+
+	chDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(chDone)
+	}()
+
+	if !forced {
+		select {
+		case <-chDone:
+		case <-time.After(optShutdownGrace):
+			logger.Warn("grace period exceeded, killing connections")
+		case sig := <-chSig:
+			logger.Warn("signal caught again, forcing exit", "signal", sig)
+		}
+	}
+
+	var killed int
+	select {
+	case <-chDone:
+	default:
+		killed = sessions.KillAll()
+		// abort commands in flight
+		ctxCancel()
+		select {
+		case <-chDone:
+		case <-time.After(time.Second):
+			logger.Warn("connections not exited after killed")
+		}
+	}
+
 	ctxCancel()
 
-	log.Println("waiting for existed connections")
-	wg.Wait()
+	logger.Info(
+		"shutdown summary",
+		"connections", active,
+		"drained", active-int64(killed),
+		"killed", killed,
+		"duration", time.Since(drainStart),
+	)
+
+	mirrorCancel()
+	if mirrorDone != nil {
+		<-mirrorDone
+	}
+
+	auditCancel()
+	if auditDone != nil {
+		<-auditDone
+	}
+
+	traceCancel()
+	if traceDone != nil {
+		<-traceDone
+	}
 }
 
-func handleConn(ctx context.Context, wg *sync.WaitGroup, conn *net.TCPConn) {
-	defer wg.Done()
+func newStore(client *redis.Client) *Store {
+	s := &Store{
+		Redis:      client,
+		RedisLock:  redislock.New(client),
+		Shards:     shards,
+		Namespaces: namespaces,
+
+		CompressThreshold: optCompressThreshold,
+		Keyring:           keyring,
+		ChunkSize:         optChunkSize,
+		Cache:             cache,
+		Mirror:            mirror,
+	}
+	if mirror != nil && optMirrorReadFallback {
+		s.Fallback = mirror.Secondary
+	}
+	return s
+}
+
+// rejectConn replies and closes a connection exceeding max connections
+func rejectConn(conn *net.TCPConn) {
 	defer conn.Close()
+	stats.ConnectionsRejected.Add(1)
+	logger.Debug("connection rejected", "remote", conn.RemoteAddr())
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write([]byte(memwire.CodeServerErr + " too many connections\r\n"))
+}
 
-	log.Println("connected:", conn.RemoteAddr().String())
-	defer log.Println("disconnected:", conn.RemoteAddr().String())
+func handleConn(ctx context.Context, wg *sync.WaitGroup, tcpConn *net.TCPConn, client *redis.Client) {
+	defer wg.Done()
+	defer tcpConn.Close()
+	defer metrics.ConnectionsActive.Add(-1)
+
+	if keepAlive := limits.KeepAlive(); keepAlive > 0 {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(keepAlive)
+	}
+
+	var conn net.Conn = tcpConn
+	var user string
+
+	if tlsConfig != nil {
+		tlsConn := tls.Server(tcpConn, tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Debug("tls handshake failed", "remote", tcpConn.RemoteAddr(), "err", err)
+			return
+		}
+		_ = tlsConn.SetDeadline(time.Time{})
+		user = tlsUser(tlsConn.ConnectionState())
+		conn = tlsConn
+	}
+
+	session := sessions.Add(conn)
+	defer sessions.Remove(session)
+	session.SetUser(user)
+
+	// connection events are sampled, errors are always logged
+	rate := logConnSampleRate.Load().(float64)
+	sampled := rate >= 1 || rand.Float64() < rate
+	if sampled {
+		logger.Info("connected", "conn", session.ID, "remote", session.RemoteAddr)
+	}
 
 	var err error
 	defer func(err *error) {
 		if *err == io.EOF {
 			*err = nil
 		}
+		if *err == ErrIdleTimeout || isTimeout(*err) {
+			stats.ConnectionsTimedOut.Add(1)
+		}
+		if *err == ErrIdleTimeout {
+			logger.Debug("connection idle timeout", "conn", session.ID, "remote", session.RemoteAddr)
+			*err = nil
+		}
 		if *err != nil {
-			log.Println("error:", conn.RemoteAddr().String(), (*err).Error())
+			logger.Warn("connection error", "conn", session.ID, "remote", session.RemoteAddr, "err", *err)
+		}
+		if sampled {
+			logger.Info("disconnected", "conn", session.ID, "remote", session.RemoteAddr, "commands", session.commands.Load())
 		}
 	}(&err)
 
-	var opts *redis.Options
+	store := newStore(client)
 
-	if opts, err = redis.ParseURL(optRedisURL); err != nil {
+	if err = store.Ping(ctx); err != nil {
 		return
 	}
 
-	client := redis.NewClient(opts)
-	defer client.Close()
-
-	rlock := redislock.New(client)
-
-	if err = client.Ping(ctx).Err(); err != nil {
-		return
-	}
-
-	r := bufio.NewReaderSize(conn, 4096)
-	w := bufio.NewWriterSize(conn, 4096)
-
-	go func() {
-		<-ctx.Done()
-		time.Sleep(time.Second)
-		_ = conn.Close()
-	}()
+	r := bufio.NewReaderSize(countingReader{conn}, 4096)
+	w := bufio.NewWriterSize(countingWriter{conn}, 4096)
 
 	for {
+		var draining bool
+		if draining, err = limits.waitRequest(session, r); err != nil {
+			if err == ErrIdleTimeout && session.Draining() {
+				err = nil
+			}
+			return
+		}
+
 		var req *memwire.Request
 		if req, err = memwire.ReadRequest(r); err != nil {
 			if err == io.EOF {
 				return
 			}
-			if optDebug {
-				log.Println("[debug] read error:", conn.RemoteAddr().String(), err.Error())
-			}
+			logger.Debug("read error", "conn", session.ID, "remote", session.RemoteAddr, "err", err)
 			if _, ok := err.(memwire.Error); ok {
+				metrics.ParseErrors.Add(1)
+				recordResult(memwire.CodeErr)
 				if _, err = w.WriteString(memwire.CodeErr + "\r\n"); err != nil {
 					return
 				}
 				if err = w.Flush(); err != nil {
 					return
 				}
+				if session.SetBusy(false) && r.Buffered() == 0 {
+					return
+				}
 				continue
 			} else {
 				return
 			}
 		}
 
-		if ctx.Err() != nil {
+		if draining {
+			// commands arrived after draining started, including pipelined ones, are refused
+			recordResult(memwire.CodeServerErr)
 			if _, err = w.WriteString(memwire.CodeServerErr + " shutting down\r\n"); err != nil {
 				return
 			}
 			if err = w.Flush(); err != nil {
 				return
 			}
-			return
-		}
+		} else {
+			session.Record(req.Command)
 
-		rt := &RoundTripper{
-			Request:        req,
-			Debug:          optDebug,
-			Redis:          client,
-			RedisLock:      rlock,
-			ResponseWriter: w,
+			rt := &RoundTripper{
+				Request:        req,
+				Session:        session,
+				Store:          store,
+				ResponseWriter: w,
+			}
+			if err = rt.Do(ctx); err != nil {
+				return
+			}
 		}
-		if err = rt.Do(ctx); err != nil {
+
+		if session.SetBusy(false) && r.Buffered() == 0 {
 			return
 		}
 	}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis/v8"
+	"go.guoyk.net/redmemd/memwire"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// memcachedBatchSize is the number of keys fetched from memcached at once
+	memcachedBatchSize = 100
+	// memcachedTimeout is the socket timeout of memcached
+	memcachedTimeout = time.Second * 5
+)
+
+// MemcachedSource reads items from a memcached server
+type MemcachedSource struct {
+	Addr   string
+	Client *memcache.Client
+}
+
+// NewMemcachedSource creates a source of memcached server at addr
+func NewMemcachedSource(addr string) *MemcachedSource {
+	client := memcache.New(addr)
+	client.Timeout = memcachedTimeout
+	return &MemcachedSource{Addr: addr, Client: client}
+}
+
+// MetaDump enumerates keys with "lru_crawler metadump all", available since memcached 1.4.31
+func (s *MemcachedSource) MetaDump(ctx context.Context, fn func(m *KeyMeta) error) (err error) {
+	var dialer net.Dialer
+	var conn net.Conn
+	if conn, err = dialer.DialContext(ctx, "tcp", s.Addr); err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// closing connection interrupts reading when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	_ = conn.SetWriteDeadline(deadline(memcachedTimeout))
+	if _, err = conn.Write([]byte("lru_crawler metadump all\r\n")); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for {
+		_ = conn.SetReadDeadline(deadline(memcachedTimeout))
+		if !scanner.Scan() {
+			if err = ctx.Err(); err == nil {
+				if err = scanner.Err(); err == nil {
+					err = errors.New("memcached metadump: unexpected end of response")
+				}
+			}
+			return
+		}
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case line == memwire.CodeEnd:
+			return
+		case strings.HasPrefix(line, "key="):
+			var m *KeyMeta
+			if m, err = ParseKeyMeta(line); err != nil {
+				return
+			}
+			if err = fn(m); err != nil {
+				return
+			}
+		default:
+			// BUSY, ERROR or CLIENT_ERROR
+			err = errors.New("memcached metadump: " + line)
+			return
+		}
+	}
+}
+
+// Fetch reads items of keys as records, with ttl remaining at now, evicted and expired items are omitted
+func (s *MemcachedSource) Fetch(metas []*KeyMeta, now time.Time) (recs []*BackupRecord, err error) {
+	keys := make([]string, 0, len(metas))
+	for _, m := range metas {
+		keys = append(keys, m.Key)
+	}
+	var items map[string]*memcache.Item
+	if items, err = s.Client.GetMulti(keys); err != nil {
+		return
+	}
+	for _, m := range metas {
+		item := items[m.Key]
+		if item == nil {
+			continue
+		}
+		rec := &BackupRecord{Key: m.Key, Flags: strconv.FormatUint(uint64(item.Flags), 10), Value: item.Value}
+		if m.Exp >= 0 {
+			if !time.Unix(m.Exp, 0).After(now) {
+				continue
+			}
+			rec.ExpiresAt = m.Exp * 1000
+		}
+		recs = append(recs, rec)
+	}
+	return
+}
+
+// loadMemcachedCheckpoint loads keys migrated, one url encoded key per line
+func loadMemcachedCheckpoint(file string) (done map[string]bool, err error) {
+	done = map[string]bool{}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		// the last line may be incomplete if interrupted
+		if key, err := url.QueryUnescape(line); err == nil && key != "" {
+			done[key] = true
+		}
+	}
+	return
+}
+
+// openMemcachedCheckpoint opens checkpoint for appending keys migrated, keys in it are loaded if resume is set,
+// otherwise it's truncated, as a checkpoint only covers an unfinished migration
+func openMemcachedCheckpoint(file string, resume bool) (done map[string]bool, f *os.File, err error) {
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if resume {
+		if done, err = loadMemcachedCheckpoint(file); err != nil {
+			return
+		}
+		flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err = os.OpenFile(file, flag, 0644)
+	return
+}
+
+// runMigrateMemcached copies items of a memcached server into store, online
+func runMigrateMemcached() (err error) {
+	if optMemcachedSource == "" {
+		return errors.New("missing option memcached.source")
+	}
+
+	var done map[string]bool
+	var checkpoint *os.File
+	if optMemcachedCheckpoint != "" {
+		if done, checkpoint, err = openMemcachedCheckpoint(optMemcachedCheckpoint, optMemcachedResume); err != nil {
+			return
+		}
+		defer checkpoint.Close()
+		if len(done) > 0 {
+			logger.Info("resuming migration", "checkpoint", optMemcachedCheckpoint, "keys", len(done))
+		}
+	}
+
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx := context.Background()
+	store := newStore(client)
+	source := NewMemcachedSource(optMemcachedSource)
+
+	var bucket *TokenBucket
+	if optMemcachedRate > 0 {
+		bucket = NewTokenBucket(optMemcachedRate, time.Now())
+	}
+
+	var (
+		scanned, migrated, skipped int
+		batch                      []*KeyMeta
+		reported                   = time.Now()
+	)
+
+	flush := func() (err error) {
+		if len(batch) == 0 {
+			return
+		}
+		var recs []*BackupRecord
+		if recs, err = source.Fetch(batch, time.Now()); err != nil {
+			return
+		}
+		batch = batch[:0]
+		var lines []string
+		for _, rec := range recs {
+			var ok bool
+			if ok, err = store.ImportRecord(ctx, rec, optMemcachedOverwrite); err != nil {
+				if err != ErrInvalidFlags {
+					return
+				}
+				logger.Warn("skipped", "key", rec.Key, "err", err)
+				err = nil
+			}
+			if ok {
+				migrated++
+			} else {
+				skipped++
+			}
+			lines = append(lines, url.QueryEscape(rec.Key)+"\n")
+		}
+		if checkpoint != nil && len(lines) > 0 {
+			if _, err = checkpoint.WriteString(strings.Join(lines, "")); err != nil {
+				return
+			}
+		}
+		if time.Since(reported) >= optMemcachedProgressInterval {
+			reported = time.Now()
+			logger.Info("migrating", "scanned", scanned, "migrated", migrated, "skipped", skipped)
+		}
+		return
+	}
+
+	if err = source.MetaDump(ctx, func(m *KeyMeta) error {
+		scanned++
+		if done[m.Key] || isInternalKey(m.Key) {
+			return nil
+		}
+		if bucket != nil {
+			if wait := bucket.Reserve(1, time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		batch = append(batch, m)
+		if len(batch) < memcachedBatchSize {
+			return nil
+		}
+		return flush()
+	}); err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		return
+	}
+
+	if checkpoint != nil {
+		if err = os.Remove(optMemcachedCheckpoint); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+	}
+
+	logger.Info("migrated", "scanned", scanned, "migrated", migrated, "skipped", skipped)
+	return
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMemcachedItem struct {
+	value []byte
+	flags uint32
+	exp   int64
+}
+
+// fakeMemcached serves "get", "gets", "set" and "lru_crawler metadump all"
+type fakeMemcached struct {
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]fakeMemcachedItem
+	// keys are in metadump order
+	keys []string
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMemcached{listener: l, items: map[string]fakeMemcachedItem{}}
+	go s.serve()
+	return s
+}
+
+func (s *fakeMemcached) Set(key string, value string, flags uint32, exp int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, flags, exp)
+}
+
+func (s *fakeMemcached) set(key string, value string, flags uint32, exp int64) {
+	if _, ok := s.items[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.items[key] = fakeMemcachedItem{value: []byte(value), flags: flags, exp: exp}
+}
+
+func (s *fakeMemcached) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMemcached) Close() {
+	_ = s.listener.Close()
+}
+
+func (s *fakeMemcached) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		var data []byte
+		if len(args) == 5 && args[0] == "set" {
+			size, _ := strconv.Atoi(args[4])
+			data = make([]byte, size+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+		s.mu.Lock()
+		switch {
+		case len(args) == 3 && args[0] == "lru_crawler" && args[1] == "metadump" && args[2] == "all":
+			for i, key := range s.keys {
+				item := s.items[key]
+				_, _ = w.WriteString("key=" + url.QueryEscape(key) + " exp=" + strconv.FormatInt(item.exp, 10) +
+					" la=1622534400 cas=" + strconv.Itoa(i+1) + " fetch=no cls=1 size=" + strconv.Itoa(len(item.value)+48) + "\n")
+			}
+			_, _ = w.WriteString("END\r\n")
+		case len(args) > 1 && (args[0] == "get" || args[0] == "gets"):
+			for _, key := range args[1:] {
+				item, ok := s.items[key]
+				if !ok {
+					continue
+				}
+				_, _ = w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(item.flags), 10) + " " + strconv.Itoa(len(item.value)) + " 1\r\n")
+				_, _ = w.Write(item.value)
+				_, _ = w.WriteString("\r\n")
+			}
+			_, _ = w.WriteString("END\r\n")
+		case data != nil:
+			flags, _ := strconv.ParseUint(args[2], 10, 32)
+			s.set(args[1], string(data), uint32(flags), -1)
+			_, _ = w.WriteString("STORED\r\n")
+		default:
+			_, _ = w.WriteString("ERROR\r\n")
+		}
+		s.mu.Unlock()
+		if err = w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestParseKeyMeta(t *testing.T) {
+	m, err := ParseKeyMeta("key=user%3A1+a exp=1622538000 la=1622534400 cas=7 fetch=no cls=1 size=63")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Key != "user:1 a" || m.Exp != 1622538000 || m.LastAccess != 1622534400 || m.Cas != "7" || m.Size != 63 || m.Flags != "0" {
+		t.Errorf("bad meta: %+v", m)
+	}
+	// round trip of KeyMeta.String
+	if m, err = ParseKeyMeta((&KeyMeta{Key: "a", Exp: -1, Cas: "1", Size: 2, Flags: "3"}).String()); err != nil || m.Exp != -1 || m.Flags != "3" {
+		t.Errorf("bad meta: %+v, %v", m, err)
+	}
+	if _, err = ParseKeyMeta("exp=-1 la=0"); err == nil {
+		t.Error("missing key should fail")
+	}
+	if _, err = ParseKeyMeta("key=a exp=x"); err == nil {
+		t.Error("invalid exp should fail")
+	}
+}
+
+func TestMemcachedSource(t *testing.T) {
+	now := time.Now()
+	fake := newFakeMemcached(t)
+	defer fake.Close()
+	fake.Set("a", "hello", 42, -1)
+	fake.Set("b", "world", 0, now.Add(time.Minute).Unix())
+	fake.Set("expired", "x", 0, now.Add(-time.Second).Unix())
+
+	source := NewMemcachedSource(fake.Addr())
+	var metas []*KeyMeta
+	if err := source.MetaDump(context.Background(), func(m *KeyMeta) error {
+		metas = append(metas, m)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// evicted after enumerated
+	metas = append(metas, &KeyMeta{Key: "evicted", Exp: -1})
+	if len(metas) != 4 || metas[0].Key != "a" || metas[1].Key != "b" {
+		t.Fatalf("bad metadump: %+v", metas)
+	}
+
+	recs, err := source.Fetch(metas, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("bad records: %+v", recs)
+	}
+	if rec := recs[0]; rec.Key != "a" || string(rec.Value) != "hello" || rec.Flags != "42" || rec.ExpiresAt != 0 {
+		t.Errorf("bad record: %+v", rec)
+	}
+	if rec := recs[1]; rec.Key != "b" || string(rec.Value) != "world" || rec.ExpiresAt != now.Add(time.Minute).Unix()*1000 {
+		t.Errorf("bad record: %+v", rec)
+	}
+}
+
+func TestLoadMemcachedCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redmemd-memcached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoint")
+	done, err := loadMemcachedCheckpoint(file)
+	if err != nil || len(done) != 0 {
+		t.Errorf("should be empty: %v, %v", done, err)
+	}
+	if err = ioutil.WriteFile(file, []byte("a\nuser%3A1\nb%"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if done, err = loadMemcachedCheckpoint(file); err != nil || len(done) != 2 || !done["a"] || !done["user:1"] {
+		t.Errorf("bad checkpoint: %v, %v", done, err)
+	}
+}
+
+func TestOpenMemcachedCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redmemd-memcached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoint")
+	if err = ioutil.WriteFile(file, []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done, f, err := openMemcachedCheckpoint(file, true)
+	if err != nil || len(done) != 1 || !done["a"] {
+		t.Fatalf("bad checkpoint: %v, %v", done, err)
+	}
+	_, _ = f.WriteString("b\n")
+	f.Close()
+	if done, _ = loadMemcachedCheckpoint(file); len(done) != 2 {
+		t.Errorf("keys should be appended: %v", done)
+	}
+
+	// not resuming starts over
+	if done, f, err = openMemcachedCheckpoint(file, false); err != nil || len(done) != 0 {
+		t.Fatalf("bad checkpoint: %v, %v", done, err)
+	}
+	f.Close()
+	if done, _ = loadMemcachedCheckpoint(file); len(done) != 0 {
+		t.Errorf("checkpoint should be truncated: %v", done)
+	}
+}
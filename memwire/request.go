@@ -248,9 +248,11 @@ func ReadRequest(r *bufio.Reader) (*Request, error) {
 		// version\r\n
 		// quit\r\n
 		return &Request{Command: arr[0]}, nil
-	case "stats":
+	case "stats", "watch", "lru_crawler":
 		// stats\r\n
 		// stats <args>\r\n
+		// watch <args>\r\n
+		// lru_crawler <args>\r\n
 		req := &Request{Command: arr[0]}
 		if len(arr) > 1 {
 			req.Keys = arr[1:]
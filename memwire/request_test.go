@@ -49,6 +49,20 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestWatch(t *testing.T) {
+	ret, err := testReq("watch fetchers key=user:\r\n", t)
+	if err != nil {
+		t.Fatalf("ReadRequest %+v", err)
+	}
+
+	if ret.Command != "watch" {
+		t.Errorf("Command %s", ret.Command)
+	}
+	if !reflect.DeepEqual(ret.Keys, []string{"fetchers", "key=user:"}) {
+		t.Errorf("Keys %v", ret.Keys)
+	}
+}
+
 func TestCas(t *testing.T) {
 	ret, err := testReq("cas KEY 0 0 10 UNIQ\r\n1234567890\r\n", t)
 	if err != nil {
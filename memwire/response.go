@@ -28,21 +28,7 @@ func (r Response) String() string {
 	var b bytes.Buffer
 
 	for i := range r.Values {
-		//b.WriteString(fmt.Sprintf("VALUE %s %s %d\r\n", r.Values[i].Key, r.Values[i].Flags, len(r.Values[i].Data)))
-		b.WriteString("VALUE ")
-		b.WriteString(r.Values[i].Key)
-		b.WriteString(" ")
-		b.WriteString(r.Values[i].Flags)
-		b.WriteString(" ")
-		b.WriteString(strconv.Itoa(len(r.Values[i].Data)))
-
-		if r.Values[i].Cas != "" {
-			b.WriteString(" ")
-			b.WriteString(r.Values[i].Cas)
-		}
-
-		b.WriteString("\r\n")
-
+		b.WriteString(ValueHeader(r.Values[i].Key, r.Values[i].Flags, len(r.Values[i].Data), r.Values[i].Cas))
 		b.Write(r.Values[i].Data)
 		b.WriteString("\r\n")
 	}
@@ -52,3 +38,27 @@ func (r Response) String() string {
 
 	return b.String()
 }
+
+// ValueHeader returns the header line of a value, for data to be sent separately.
+func ValueHeader(key, flags string, size int, cas string) string {
+	// format:
+	// VALUE <key> <flags> <bytes> [<cas unique>]\r\n
+
+	var b bytes.Buffer
+
+	b.WriteString("VALUE ")
+	b.WriteString(key)
+	b.WriteString(" ")
+	b.WriteString(flags)
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(size))
+
+	if cas != "" {
+		b.WriteString(" ")
+		b.WriteString(cas)
+	}
+
+	b.WriteString("\r\n")
+
+	return b.String()
+}
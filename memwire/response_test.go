@@ -51,3 +51,12 @@ func TestRespMultipleValue(t *testing.T) {
 		t.Errorf("%v", r)
 	}
 }
+
+func TestValueHeader(t *testing.T) {
+	if h := ValueHeader("k1", "f1", 3, ""); h != "VALUE k1 f1 3\r\n" {
+		t.Errorf("%v", h)
+	}
+	if h := ValueHeader("k1", "f1", 3, "42"); h != "VALUE k1 f1 3 42\r\n" {
+		t.Errorf("%v", h)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"go.guoyk.net/redmemd/memwire"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MetaDumpJSONL = "jsonl"
+	MetaDumpCSV   = "csv"
+)
+
+// KeyMeta is metadata of an item, like a line of memcached lru_crawler metadump
+type KeyMeta struct {
+	Key string `json:"key"`
+	// Exp is the expiration in unix seconds, -1 if never expires
+	Exp int64 `json:"exp"`
+	// LastAccess is the last access in unix seconds, 0 if unknown
+	LastAccess int64  `json:"la"`
+	Cas        string `json:"cas"`
+	Size       int    `json:"size"`
+	Flags      string `json:"flags"`
+}
+
+// String formats metadata as memcached metadump, key is url encoded
+func (m *KeyMeta) String() string {
+	return "key=" + url.QueryEscape(m.Key) +
+		" exp=" + strconv.FormatInt(m.Exp, 10) +
+		" la=" + strconv.FormatInt(m.LastAccess, 10) +
+		" cas=" + m.Cas +
+		" size=" + strconv.Itoa(m.Size) +
+		" flags=" + m.Flags
+}
+
+// ParseKeyMeta parses a line of memcached metadump, unknown fields are ignored
+func ParseKeyMeta(line string) (m *KeyMeta, err error) {
+	m = &KeyMeta{Exp: -1, Flags: "0"}
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "key":
+			m.Key, err = url.QueryUnescape(kv[1])
+		case "exp":
+			m.Exp, err = strconv.ParseInt(kv[1], 10, 64)
+		case "la":
+			m.LastAccess, err = strconv.ParseInt(kv[1], 10, 64)
+		case "cas":
+			m.Cas = kv[1]
+		case "size":
+			m.Size, err = strconv.Atoi(kv[1])
+		case "flags":
+			m.Flags = kv[1]
+		}
+		if err != nil {
+			err = errors.New("invalid metadump line: " + line)
+			return
+		}
+	}
+	if m.Key == "" {
+		err = errors.New("invalid metadump line: " + line)
+	}
+	return
+}
+
+// Meta returns metadata of key, or ErrNotFound, size is the size of value as stored, value is never read
+func (s *Store) Meta(ctx context.Context, key string) (m *KeyMeta, err error) {
+	// idle time is read before the item, reading the item resets it
+	var ttl, idle *redis.DurationCmd
+	_, _ = s.client(key).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		ttl = pipe.PTTL(ctx, key)
+		idle = pipe.ObjectIdleTime(ctx, key)
+		return nil
+	})
+	if err = ttl.Err(); err != nil {
+		return
+	}
+	var (
+		item *Item
+		size int
+	)
+	if item, size, err = s.Peek(ctx, key); err != nil {
+		return
+	}
+	now := time.Now()
+	m = &KeyMeta{Key: key, Exp: -1, Cas: item.Token, Flags: item.Flags, Size: size}
+	if item.Encoding == EncodingChunked {
+		var manifest *Manifest
+		if manifest, err = ParseManifest(item.Value); err != nil {
+			return
+		}
+		m.Size = manifest.Size
+	}
+	if d := ttl.Val(); d > 0 {
+		m.Exp = now.Add(d).Unix()
+	}
+	// idle time is unavailable with lfu eviction policies
+	if d, err := idle.Result(); err == nil {
+		m.LastAccess = now.Add(-d).Unix()
+	}
+	return
+}
+
+// MetaDump invokes fn with metadata of every key with prefix, at most rate keys per second, unlimited if rate is 0
+func MetaDump(ctx context.Context, store *Store, prefix string, rate float64, fn func(m *KeyMeta) error) (scanned int, dumped int, err error) {
+	var bucket *TokenBucket
+	if rate > 0 {
+		bucket = NewTokenBucket(rate, time.Now())
+	}
+	var match string
+	if prefix != "" {
+		match = escapeGlob(prefix) + "*"
+	}
+	return scanKeys(ctx, store, match, func(key string) (bool, error) {
+		if bucket != nil {
+			if wait := bucket.Reserve(1, time.Now()); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return false, ctx.Err()
+				}
+			}
+		}
+		m, err := store.Meta(ctx, key)
+		if err != nil {
+			if err == ErrNotFound {
+				// expired or deleted after scanned
+				err = nil
+			}
+			return false, err
+		}
+		return true, fn(m)
+	})
+}
+
+// metaDumpWriter writes metadata in jsonl or csv
+type metaDumpWriter struct {
+	format string
+	json   *json.Encoder
+	csv    *csv.Writer
+}
+
+func newMetaDumpWriter(w io.Writer, format string) (mw *metaDumpWriter, err error) {
+	mw = &metaDumpWriter{format: format}
+	switch format {
+	case MetaDumpJSONL:
+		mw.json = json.NewEncoder(w)
+	case MetaDumpCSV:
+		mw.csv = csv.NewWriter(w)
+		err = mw.csv.Write([]string{"key", "exp", "la", "cas", "size", "flags"})
+	default:
+		err = errors.New("invalid metadump format: " + format)
+	}
+	return
+}
+
+func (mw *metaDumpWriter) Write(m *KeyMeta) error {
+	if mw.json != nil {
+		return mw.json.Encode(m)
+	}
+	return mw.csv.Write([]string{
+		m.Key,
+		strconv.FormatInt(m.Exp, 10),
+		strconv.FormatInt(m.LastAccess, 10),
+		m.Cas,
+		strconv.Itoa(m.Size),
+		m.Flags,
+	})
+}
+
+func (mw *metaDumpWriter) Flush() error {
+	if mw.csv != nil {
+		mw.csv.Flush()
+		return mw.csv.Error()
+	}
+	return nil
+}
+
+// runDumpMeta writes metadata of keys with an optional prefix to output file or stdout
+func runDumpMeta(args []string) (err error) {
+	var prefix string
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	var out io.Writer = os.Stdout
+	if optMetaDumpOutput != "" {
+		var f *os.File
+		if f, err = os.Create(optMetaDumpOutput); err != nil {
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+
+	var mw *metaDumpWriter
+	if mw, err = newMetaDumpWriter(out, optMetaDumpFormat); err != nil {
+		return
+	}
+
+	var scanned, dumped int
+	if scanned, dumped, err = MetaDump(context.Background(), newStore(client), prefix, optMetaDumpRate, mw.Write); err != nil {
+		return
+	}
+	if err = mw.Flush(); err != nil {
+		return
+	}
+
+	logger.Info("dumped", "dumped", dumped, "scanned", scanned)
+	return
+}
+
+// metaDump handles "lru_crawler metadump all", streaming metadata of all keys
+func (rt *RoundTripper) metaDump(ctx context.Context) (err error) {
+	if strings.Join(rt.Keys, " ") != "metadump all" {
+		return rt.ReplyCode(memwire.CodeClientErr, "only metadump all is supported")
+	}
+	rt.recordResult(memwire.CodeEnd)
+	w := rt.ResponseWriter
+	conn := rt.Session.conn
+	// a failure here leaves the response incomplete, the connection must be closed
+	if _, _, err = MetaDump(ctx, rt.Store, "", optMetaDumpRate, func(m *KeyMeta) (err error) {
+		_ = conn.SetWriteDeadline(deadline(limits.WriteTimeout()))
+		_, err = w.WriteString(m.String() + "\n")
+		return
+	}); err != nil {
+		return
+	}
+	if _, err = w.WriteString(memwire.CodeEnd + "\r\n"); err != nil {
+		return
+	}
+	return w.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/bsm/redislock"
+	"testing"
+)
+
+func TestKeyMetaString(t *testing.T) {
+	m := &KeyMeta{Key: "user:1 a", Exp: -1, LastAccess: 1622534400, Cas: "123", Size: 5, Flags: "42"}
+	if s := m.String(); s != "key=user%3A1+a exp=-1 la=1622534400 cas=123 size=5 flags=42" {
+		t.Errorf("String %s", s)
+	}
+}
+
+func TestMetaDumpWriter(t *testing.T) {
+	m := &KeyMeta{Key: "a,b", Exp: 1622534400, Cas: "123", Size: 5, Flags: "0"}
+
+	var buf bytes.Buffer
+	mw, err := newMetaDumpWriter(&buf, MetaDumpCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if err = mw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "key,exp,la,cas,size,flags\n\"a,b\",1622534400,0,123,5,0\n" {
+		t.Errorf("csv %q", s)
+	}
+
+	buf.Reset()
+	if mw, err = newMetaDumpWriter(&buf, MetaDumpJSONL); err != nil {
+		t.Fatal(err)
+	}
+	_ = mw.Write(m)
+	_ = mw.Write(m)
+	if s := buf.String(); s != `{"key":"a,b","exp":1622534400,"la":0,"cas":"123","size":5,"flags":"0"}`+"\n"+`{"key":"a,b","exp":1622534400,"la":0,"cas":"123","size":5,"flags":"0"}`+"\n" {
+		t.Errorf("jsonl %q", s)
+	}
+
+	if _, err = newMetaDumpWriter(&buf, "xml"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestStoreMeta(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := &Store{Redis: client, RedisLock: redislock.New(client), ChunkSize: 16}
+	s.Namespaces, _ = ParseNamespaces("", "c:=compact")
+
+	for _, key := range []string{"h:1", "c:1"} {
+		if err := s.Set(ctx, key, &Item{Value: []byte("hello"), Flags: "3", Token: "7"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Set(ctx, key+":chunked", &Item{Value: bytes.Repeat([]byte("x"), 100), Flags: "0", Token: "8"}, 0); err != nil {
+			t.Fatal(err)
+		}
+		m, err := s.Meta(ctx, key)
+		if err != nil || m.Size != 5 || m.Flags != "3" || m.Cas != "7" || m.Exp != -1 {
+			t.Errorf("bad meta of %s: %+v, %v", key, m, err)
+		}
+		if m, err = s.Meta(ctx, key+":chunked"); err != nil || m.Size != 100 || m.Cas != "8" {
+			t.Errorf("bad meta of chunked %s: %+v, %v", key, m, err)
+		}
+		if _, err = s.Meta(ctx, key+":missing"); err != ErrNotFound {
+			t.Errorf("should not be found: %v", err)
+		}
+	}
+}
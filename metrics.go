@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are histogram buckets in seconds
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Histogram is an atomic histogram with fixed buckets
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     uint64 // bits of float64
+}
+
+// NewHistogram creates a new histogram
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// CounterVec is a set of counters partitioned by a label
+type CounterVec struct {
+	mu sync.RWMutex
+	m  map[string]*Counter
+}
+
+// With returns counter of label value
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.RLock()
+	c := v.m[value]
+	v.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = map[string]*Counter{}
+	}
+	if c = v.m[value]; c == nil {
+		c = new(Counter)
+		v.m[value] = c
+	}
+	return c
+}
+
+// HistogramVec is a set of histograms partitioned by a label
+type HistogramVec struct {
+	mu sync.RWMutex
+	m  map[string]*Histogram
+}
+
+// With returns histogram of label value
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.RLock()
+	h := v.m[value]
+	v.mu.RUnlock()
+	if h != nil {
+		return h
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.m == nil {
+		v.m = map[string]*Histogram{}
+	}
+	if h = v.m[value]; h == nil {
+		h = NewHistogram(DefaultBuckets)
+		v.m[value] = h
+	}
+	return h
+}
+
+// Metrics is server-wide metrics exposed in prometheus format
+type Metrics struct {
+	Commands          CounterVec
+	CommandDuration   HistogramVec
+	Results           CounterVec
+	Hits              Counter
+	Misses            Counter
+	BytesRead         Counter
+	BytesWritten      Counter
+	ConnectionsActive Counter
+	ConnectionsTotal  Counter
+	ParseErrors       Counter
+	LockDuration      *Histogram
+	ShadowMismatches  CounterVec
+}
+
+var metrics = &Metrics{
+	LockDuration: NewHistogram(DefaultBuckets),
+}
+
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) header(name, typ, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+func (mw *metricsWriter) counter(name, help string, v int64) {
+	mw.header(name, "counter", help)
+	mw.printf("%s %d\n", name, v)
+}
+
+func (mw *metricsWriter) gauge(name, help string, v int64) {
+	mw.header(name, "gauge", help)
+	mw.printf("%s %d\n", name, v)
+}
+
+// poolStats writes a pool stat of each pool, labeled by shard if sharded
+func (mw *metricsWriter) poolStats(name, typ, help string, pools []RedisPool, ps []*redis.PoolStats, v func(s *redis.PoolStats) uint32) {
+	mw.header(name, typ, help)
+	for i, pool := range pools {
+		if pool.Shard == "" {
+			mw.printf("%s %d\n", name, v(ps[i]))
+		} else {
+			mw.printf("%s{shard=%q} %d\n", name, pool.Shard, v(ps[i]))
+		}
+	}
+}
+
+func (mw *metricsWriter) counterVec(name, help, label string, v *CounterVec) {
+	mw.header(name, "counter", help)
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make([]string, 0, len(v.m))
+	for value := range v.m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		mw.printf("%s{%s=%q} %d\n", name, label, value, v.m[value].Load())
+	}
+}
+
+func (mw *metricsWriter) histogram(name, labels string, h *Histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		mw.printf("%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	count := atomic.LoadUint64(&h.count)
+	mw.printf("%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	mw.printf("%s_sum%s %s\n", name, labels, strconv.FormatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum)), 'g', -1, 64))
+	mw.printf("%s_count%s %d\n", name, labels, count)
+}
+
+func (mw *metricsWriter) histogramVec(name, help, label string, v *HistogramVec) {
+	mw.header(name, "histogram", help)
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	values := make([]string, 0, len(v.m))
+	for value := range v.m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		mw.histogram(name, fmt.Sprintf("%s=%q", label, value), v.m[value])
+	}
+}
+
+// WriteTo writes metrics in prometheus text format, including pool stats of redis pools
+func (m *Metrics) WriteTo(w io.Writer, pools []RedisPool) error {
+	mw := &metricsWriter{w: w}
+	mw.counterVec("redmemd_commands_total", "Number of commands processed.", "command", &m.Commands)
+	mw.histogramVec("redmemd_command_duration_seconds", "Duration of commands.", "command", &m.CommandDuration)
+	mw.counterVec("redmemd_results_total", "Number of replies by result code.", "code", &m.Results)
+	mw.counter("redmemd_hits_total", "Number of keys found by get commands.", m.Hits.Load())
+	mw.counter("redmemd_misses_total", "Number of keys not found by get commands.", m.Misses.Load())
+	mw.counter("redmemd_read_bytes_total", "Number of bytes read from clients.", m.BytesRead.Load())
+	mw.counter("redmemd_written_bytes_total", "Number of bytes written to clients.", m.BytesWritten.Load())
+	mw.gauge("redmemd_connections_active", "Number of active connections.", m.ConnectionsActive.Load())
+	mw.counter("redmemd_connections_total", "Number of accepted connections.", m.ConnectionsTotal.Load())
+	mw.counter("redmemd_parse_errors_total", "Number of malformed requests.", m.ParseErrors.Load())
+	mw.header("redmemd_lock_duration_seconds", "histogram", "Duration of lock acquisitions.")
+	mw.histogram("redmemd_lock_duration_seconds", "", m.LockDuration)
+	if shards != nil {
+		mw.header("redmemd_shard_healthy", "gauge", "Whether a shard is in the consistent hash ring.")
+		healthy := shards.Healthy()
+		for _, shard := range shards.All() {
+			var v int
+			if healthy[shard.Name] {
+				v = 1
+			}
+			mw.printf("redmemd_shard_healthy{shard=%q} %d\n", shard.Name, v)
+		}
+	}
+	if mirror != nil {
+		mw.header("redmemd_mirror_lag_seconds", "gauge", "Age of the oldest write being replayed to the secondary redis.")
+		mw.printf("redmemd_mirror_lag_seconds %s\n", strconv.FormatFloat(mirror.Lag(time.Now()).Seconds(), 'g', -1, 64))
+		mw.gauge("redmemd_mirror_queue_length", "Number of writes queued for the secondary redis.", int64(mirror.Pending()))
+	}
+	mw.counterVec("redmemd_shadow_mismatches_total", "Number of responses differing from reference memcached in shadow mode.", "command", &m.ShadowMismatches)
+	read, write := hotKeys.Top()
+	mw.header("redmemd_hot_key_rate", "gauge", "Requests per second of the hottest keys over the window.")
+	for _, k := range read {
+		mw.printf("redmemd_hot_key_rate{op=\"read\",key=%q} %s\n", k.Key, strconv.FormatFloat(k.Rate, 'g', -1, 64))
+	}
+	for _, k := range write {
+		mw.printf("redmemd_hot_key_rate{op=\"write\",key=%q} %s\n", k.Key, strconv.FormatFloat(k.Rate, 'g', -1, 64))
+	}
+	for _, line := range stats.Report() {
+		fields := strings.Fields(line)
+		mw.header("redmemd_"+fields[0], "untyped", "Statistics "+fields[0]+".")
+		mw.printf("redmemd_%s %s\n", fields[0], fields[1])
+	}
+	if len(pools) > 0 {
+		ps := make([]*redis.PoolStats, len(pools))
+		for i, pool := range pools {
+			ps[i] = pool.Client.PoolStats()
+		}
+		mw.poolStats("redmemd_redis_pool_hits_total", "counter", "Number of times a free connection was found in the pool.", pools, ps, func(s *redis.PoolStats) uint32 { return s.Hits })
+		mw.poolStats("redmemd_redis_pool_misses_total", "counter", "Number of times a free connection was not found in the pool.", pools, ps, func(s *redis.PoolStats) uint32 { return s.Misses })
+		mw.poolStats("redmemd_redis_pool_timeouts_total", "counter", "Number of times a wait timeout occurred.", pools, ps, func(s *redis.PoolStats) uint32 { return s.Timeouts })
+		mw.poolStats("redmemd_redis_pool_connections", "gauge", "Number of connections in the pool.", pools, ps, func(s *redis.PoolStats) uint32 { return s.TotalConns })
+		mw.poolStats("redmemd_redis_pool_idle_connections", "gauge", "Number of idle connections in the pool.", pools, ps, func(s *redis.PoolStats) uint32 { return s.IdleConns })
+		mw.poolStats("redmemd_redis_pool_stale_connections_total", "counter", "Number of stale connections removed from the pool.", pools, ps, func(s *redis.PoolStats) uint32 { return s.StaleConns })
+	}
+	return mw.err
+}
+
+// RedisPool is a redis client whose pool stats are reported, Shard is empty if not sharded
+type RedisPool struct {
+	Shard  string
+	Client *redis.Client
+}
+
+// redisPools returns pools of client, or pools of all shards if sharded
+func redisPools(client *redis.Client, s *Shards) []RedisPool {
+	if s == nil {
+		return []RedisPool{{Client: client}}
+	}
+	var pools []RedisPool
+	for _, shard := range s.All() {
+		pools = append(pools, RedisPool{Shard: shard.Name, Client: shard.Client})
+	}
+	return pools
+}
+
+// sumPoolStats returns the sum of pool stats of pools
+func sumPoolStats(pools []RedisPool) *redis.PoolStats {
+	sum := &redis.PoolStats{}
+	for _, pool := range pools {
+		ps := pool.Client.PoolStats()
+		sum.Hits += ps.Hits
+		sum.Misses += ps.Misses
+		sum.Timeouts += ps.Timeouts
+		sum.TotalConns += ps.TotalConns
+		sum.IdleConns += ps.IdleConns
+		sum.StaleConns += ps.StaleConns
+	}
+	return sum
+}
+
+// MetricsHandler serves metrics in prometheus text format
+func MetricsHandler(pools []RedisPool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = metrics.WriteTo(rw, pools)
+	})
+}
+
+// countingReader counts bytes read from clients
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	metrics.BytesRead.Add(int64(n))
+	return
+}
+
+// countingWriter counts bytes written to clients
+type countingWriter struct {
+	io.Writer
+}
+
+func (w countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	metrics.BytesWritten.Add(int64(n))
+	return
+}
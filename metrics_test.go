@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	m := &Metrics{LockDuration: NewHistogram([]float64{0.1, 1})}
+	m.LockDuration.Observe(0.05)
+	m.LockDuration.Observe(0.5)
+	m.LockDuration.Observe(5)
+	m.Commands.With("get").Add(2)
+
+	var buf bytes.Buffer
+	if err := m.WriteTo(&buf, nil); err != nil {
+		t.Fatalf("WriteTo %+v", err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`redmemd_commands_total{command="get"} 2`,
+		`redmemd_lock_duration_seconds_bucket{le="0.1"} 1`,
+		`redmemd_lock_duration_seconds_bucket{le="1"} 2`,
+		`redmemd_lock_duration_seconds_bucket{le="+Inf"} 3`,
+		`redmemd_lock_duration_seconds_sum 5.55`,
+		`redmemd_lock_duration_seconds_count 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+}
+
+func TestRecordResult(t *testing.T) {
+	end, serverErr := metrics.Results.With("END").Load(), metrics.Results.With("SERVER_ERROR").Load()
+	recordResult("STAT a 1\r\nEND")
+	recordResult("SERVER_ERROR shutting down")
+	if metrics.Results.With("END").Load()-end != 1 || metrics.Results.With("SERVER_ERROR").Load()-serverErr != 1 {
+		t.Errorf("Results %+v", metrics.Results.m)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	all := newTestShards(2)
+	for _, shard := range all {
+		shard.Client = redis.NewClient(&redis.Options{Addr: shard.Addr})
+		defer shard.Client.Close()
+	}
+	pools := redisPools(nil, NewShards(all, 0))
+	var buf bytes.Buffer
+	if err := (&Metrics{LockDuration: NewHistogram(nil)}).WriteTo(&buf, pools); err != nil {
+		t.Fatalf("WriteTo %+v", err)
+	}
+	for _, shard := range all {
+		if line := `redmemd_redis_pool_connections{shard="` + shard.Name + `"} 0`; !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if sum := sumPoolStats(pools); sum.TotalConns != 0 {
+		t.Errorf("bad sum: %+v", sum)
+	}
+}
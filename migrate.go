@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+)
+
+// scanKeys invokes fn on every key matching pattern except locks and chunks, any key if pattern is empty, fn returns whether the key is processed
+func scanKeys(ctx context.Context, store *Store, match string, fn func(key string) (bool, error)) (scanned int, processed int, err error) {
+	err = store.Scan(ctx, match, func(key string) (err error) {
+		scanned++
+		var ok bool
+		if ok, err = fn(key); err != nil {
+			if err == ErrInvalidFlags || err == ErrCorruptedValue || err == ErrUnknownKey {
+				logger.Warn("skipped", "key", key, "err", err)
+				err = nil
+			}
+			return
+		}
+		if ok {
+			processed++
+		}
+		return
+	})
+	return
+}
+
+// runMigrate converts existing items to the layout of their namespaces, online
+func runMigrate() (err error) {
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	store := newStore(client)
+
+	var scanned, converted int
+	if scanned, converted, err = scanKeys(ctx, store, "", func(key string) (bool, error) {
+		return migrateKey(ctx, store, key)
+	}); err != nil {
+		return
+	}
+
+	logger.Info("migrated", "converted", converted, "scanned", scanned)
+	return
+}
+
+// migrateKey converts a single key if it's not in the layout of its namespace
+func migrateKey(ctx context.Context, store *Store, key string) (ok bool, err error) {
+	layout := store.Namespaces.Layout(key)
+	err = store.WithLock(ctx, key, func(ctx context.Context) (err error) {
+		var typ string
+		if typ, err = store.client(key).Type(ctx, key).Result(); err != nil {
+			return
+		}
+		switch {
+		case typ == "hash" && layout == LayoutCompact:
+		case typ == "string" && layout == LayoutHash:
+		default:
+			return
+		}
+		var item *Item
+		if item, err = store.Get(ctx, key); err != nil {
+			if err == ErrNotFound {
+				err = nil
+			}
+			return
+		}
+		if item.Token == "" {
+			item.Token = NewToken()
+		}
+		if err = store.Update(ctx, key, item); err != nil {
+			return
+		}
+		ok = true
+		return
+	})
+	return
+}
+
+// runReencrypt encrypts existing items with the current key, online
+func runReencrypt() (err error) {
+	if keyring == nil {
+		err = ErrUnknownKey
+		return
+	}
+
+	var opts *redis.Options
+	if opts, err = newRedisOptions(); err != nil {
+		return
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	ctx := context.Background()
+
+	store := newStore(client)
+
+	var scanned, encrypted int
+	if scanned, encrypted, err = scanKeys(ctx, store, "", func(key string) (bool, error) {
+		return reencryptKey(ctx, store, key)
+	}); err != nil {
+		return
+	}
+
+	logger.Info("re-encrypted", "encrypted", encrypted, "scanned", scanned, "key_id", keyring.Current)
+	return
+}
+
+// reencryptKey encrypts a single key with the current key, if it's not yet
+func reencryptKey(ctx context.Context, store *Store, key string) (ok bool, err error) {
+	err = store.WithLock(ctx, key, func(ctx context.Context) (err error) {
+		var typ string
+		if typ, err = store.client(key).Type(ctx, key).Result(); err != nil {
+			return
+		}
+		if typ != "hash" && typ != "string" {
+			return
+		}
+		var item *Item
+		if item, err = store.Load(ctx, key); err != nil {
+			if err == ErrNotFound {
+				err = nil
+			}
+			return
+		}
+		if item.KeyID == store.Keyring.Current {
+			return
+		}
+		if item, err = store.Get(ctx, key); err != nil {
+			return
+		}
+		if err = store.Update(ctx, key, item); err != nil {
+			return
+		}
+		ok = true
+		return
+	})
+	return
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mirrorRetryBackoff is the wait before the first retry, doubled for each retry
+	mirrorRetryBackoff = time.Millisecond * 100
+	// mirrorDrainTimeout is the max time to replay writes still queued on shutdown
+	mirrorDrainTimeout = time.Second * 10
+	// mirrorDirtySize is the max number of keys tracked as not replayed, read fallback is disabled beyond it
+	mirrorDirtySize = 1 << 20
+	// mirrorFlushKey tracks flush_all as a key, memcached keys never contain spaces
+	mirrorFlushKey = " flush_all"
+)
+
+// mirrorEntry is a write to replay, the key is copied as it is in the primary store when replayed
+type mirrorEntry struct {
+	key string
+	// flush is a flush_all queued on every worker instead of a key
+	flush *mirrorFlush
+	// arrived is whether the worker has reached flush
+	arrived bool
+	queued  time.Time
+	// seq is the sequence of the write of key
+	seq uint64
+}
+
+// mirrorFlush is a barrier of workers, flush_all is replayed once all workers have reached it,
+// writes queued after it wait until it's replayed
+type mirrorFlush struct {
+	reached sync.WaitGroup
+	done    chan struct{}
+}
+
+// Mirror replays writes of the primary store to a secondary store asynchronously
+type Mirror struct {
+	Primary   *Store
+	Secondary *Store
+	// Retries is the number of retries of a failed replay before it's given up
+	Retries int
+
+	workers []*mirrorWorker
+
+	// dirty is the sequence of the latest write of keys not known to be replayed, including dropped and failed ones
+	dirtyMu  sync.Mutex
+	dirty    map[string]uint64
+	seq      uint64
+	overflow bool
+}
+
+var mirror *Mirror
+
+// NewMirror creates a mirror of concurrency workers, each queues at most queueSize writes
+func NewMirror(primary, secondary *Store, concurrency, queueSize, retries int) *Mirror {
+	m := &Mirror{Primary: primary, Secondary: secondary, Retries: retries, dirty: map[string]uint64{}}
+	for i := 0; i < concurrency; i++ {
+		m.workers = append(m.workers, &mirrorWorker{m: m, queue: make(chan *mirrorEntry, queueSize)})
+	}
+	return m
+}
+
+// Send queues a write of key without blocking, writes of the same key are replayed in order
+func (m *Mirror) Send(key string) {
+	m.send(m.workerOf(key), &mirrorEntry{key: key, queued: time.Now(), seq: m.mark(key)})
+}
+
+func (m *Mirror) workerOf(key string) *mirrorWorker {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.workers[int(h.Sum32()%uint32(len(m.workers)))]
+}
+
+// SendFlush queues a flush_all on every worker without blocking, it's replayed after writes queued before it
+func (m *Mirror) SendFlush() {
+	f := &mirrorFlush{done: make(chan struct{})}
+	now := time.Now()
+	seq := m.mark(mirrorFlushKey)
+	var queued int
+	for _, w := range m.workers {
+		f.reached.Add(1)
+		if m.send(w, &mirrorEntry{flush: f, queued: now, seq: seq}) {
+			queued++
+		} else {
+			f.reached.Done()
+		}
+	}
+	if queued == 0 {
+		return
+	}
+	go func() {
+		defer close(f.done)
+		f.reached.Wait()
+		m.replay(context.Background(), &mirrorEntry{flush: f, queued: now, seq: seq}, m.Retries, int64(queued))
+	}()
+}
+
+func (m *Mirror) send(w *mirrorWorker, e *mirrorEntry) bool {
+	select {
+	case w.queue <- e:
+		stats.MirrorQueued.Add(1)
+		return true
+	default:
+		stats.MirrorDropped.Add(1)
+		return false
+	}
+}
+
+// mark records a write of key, returns its sequence
+func (m *Mirror) mark(key string) uint64 {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	m.seq++
+	if _, ok := m.dirty[key]; !ok && len(m.dirty) >= mirrorDirtySize {
+		if !m.overflow {
+			m.overflow = true
+			logger.Warn("too many keys not replayed, read fallback disabled", "keys", len(m.dirty))
+		}
+		return m.seq
+	}
+	m.dirty[key] = m.seq
+	return m.seq
+}
+
+// replayed records a write of key replayed, key is in sync unless written again since
+func (m *Mirror) replayed(key string, seq uint64) {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	if m.dirty[key] == seq {
+		delete(m.dirty, key)
+	}
+}
+
+// Synced returns whether key is known to be the same in the secondary store,
+// false if a write of key or a flush_all is not replayed yet, or was dropped or failed
+func (m *Mirror) Synced(key string) bool {
+	m.dirtyMu.Lock()
+	defer m.dirtyMu.Unlock()
+	if m.overflow {
+		return false
+	}
+	if _, ok := m.dirty[mirrorFlushKey]; ok {
+		return false
+	}
+	_, ok := m.dirty[key]
+	return !ok
+}
+
+// Lag returns age of the oldest write being replayed, zero if all writes are replayed
+func (m *Mirror) Lag(now time.Time) (lag time.Duration) {
+	for _, w := range m.workers {
+		queued := atomic.LoadInt64(&w.current)
+		if queued == 0 {
+			continue
+		}
+		if d := now.Sub(time.Unix(0, queued)); d > lag {
+			lag = d
+		}
+	}
+	return
+}
+
+// Pending returns number of writes queued
+func (m *Mirror) Pending() (n int) {
+	for _, w := range m.workers {
+		n += len(w.queue)
+	}
+	return
+}
+
+// Run replays writes until ctx is done, writes queued by then are replayed once without retries
+func (m *Mirror) Run(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+	for _, w := range m.workers {
+		wg.Add(1)
+		go func(w *mirrorWorker) {
+			defer wg.Done()
+			w.run(ctx)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// apply copies key from the primary store to the secondary store, or deletes it from the secondary store if missing
+func (m *Mirror) apply(ctx context.Context, e *mirrorEntry) (err error) {
+	if e.flush != nil {
+		return m.Secondary.Flush(ctx)
+	}
+	var rec *BackupRecord
+	if rec, err = m.Primary.ExportRecord(ctx, e.key); err != nil {
+		if err == ErrNotFound {
+			_, err = m.Secondary.Delete(ctx, e.key)
+		}
+		return
+	}
+	_, err = m.Secondary.ImportRecord(ctx, rec, true)
+	return
+}
+
+type mirrorWorker struct {
+	m     *Mirror
+	queue chan *mirrorEntry
+	// current is the queued time of the write being replayed in unix nanoseconds, zero if idle
+	current int64
+}
+
+func (w *mirrorWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			w.drain(nil)
+			return
+		case e := <-w.queue:
+			if !w.replay(ctx, e, w.m.Retries) {
+				w.drain(e)
+				return
+			}
+		}
+	}
+}
+
+// drain replays an interrupted write if any, then writes left in queue
+func (w *mirrorWorker) drain(interrupted *mirrorEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorDrainTimeout)
+	defer cancel()
+	if interrupted != nil {
+		w.replay(ctx, interrupted, 0)
+	}
+	for {
+		select {
+		case e := <-w.queue:
+			w.replay(ctx, e, 0)
+		default:
+			return
+		}
+	}
+}
+
+// replay applies write with retries, or waits for flush to be replayed, done is false if interrupted by ctx
+func (w *mirrorWorker) replay(ctx context.Context, e *mirrorEntry, retries int) (done bool) {
+	atomic.StoreInt64(&w.current, e.queued.UnixNano())
+	defer atomic.StoreInt64(&w.current, 0)
+	if e.flush == nil {
+		return w.m.replay(ctx, e, retries, 1)
+	}
+	if !e.arrived {
+		e.arrived = true
+		e.flush.reached.Done()
+	}
+	select {
+	case <-e.flush.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// replay applies write with retries, counted as n entries queued, done is false if interrupted by ctx
+func (m *Mirror) replay(ctx context.Context, e *mirrorEntry, retries int, n int64) (done bool) {
+	backoff := mirrorRetryBackoff
+	for i := 0; ; i++ {
+		err := m.apply(ctx, e)
+		if err == nil {
+			stats.MirrorApplied.Add(n)
+			if e.flush != nil {
+				m.replayed(mirrorFlushKey, e.seq)
+			} else {
+				m.replayed(e.key, e.seq)
+			}
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if i >= retries {
+			stats.MirrorFailed.Add(n)
+			logger.Warn("mirror failed", "key", e.key, "flush", e.flush != nil, "err", err)
+			return true
+		}
+		stats.MirrorRetries.Add(1)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		backoff *= 2
+	}
+}
+
+// newMirrorStore creates the secondary store of option mirror.url, with the same layouts, compression, encryption and chunking
+func newMirrorStore() (s *Store, err error) {
+	var opts *redis.Options
+	if opts, err = newRedisOptionsFromURL(optMirrorURL); err != nil {
+		return
+	}
+	client := redis.NewClient(opts)
+	client.AddHook(TimingHook{})
+	s = &Store{
+		Redis:      client,
+		RedisLock:  redislock.New(client),
+		Namespaces: namespaces,
+
+		CompressThreshold: optCompressThreshold,
+		Keyring:           keyring,
+		ChunkSize:         optChunkSize,
+	}
+	return
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newUnreachableStore creates a store of a redis refusing connections
+func newUnreachableStore() *Store {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: time.Second})
+	return &Store{Redis: client, RedisLock: redislock.New(client)}
+}
+
+func TestMirrorSend(t *testing.T) {
+	m := NewMirror(newUnreachableStore(), newUnreachableStore(), 2, 1, 0)
+	queued, dropped := stats.MirrorQueued.Load(), stats.MirrorDropped.Load()
+	m.Send("a")
+	// the same key goes to the same full worker
+	m.Send("a")
+	if n := m.Pending(); n != 1 {
+		t.Errorf("bad pending: %d", n)
+	}
+	if n := stats.MirrorQueued.Load() - queued; n != 1 {
+		t.Errorf("bad queued: %d", n)
+	}
+	if n := stats.MirrorDropped.Load() - dropped; n != 1 {
+		t.Errorf("bad dropped: %d", n)
+	}
+}
+
+func TestMirrorLag(t *testing.T) {
+	m := NewMirror(newUnreachableStore(), newUnreachableStore(), 2, 1, 0)
+	now := time.Now()
+	if lag := m.Lag(now); lag != 0 {
+		t.Errorf("idle mirror should have no lag: %v", lag)
+	}
+	atomic.StoreInt64(&m.workers[0].current, now.Add(-time.Second).UnixNano())
+	atomic.StoreInt64(&m.workers[1].current, now.Add(-time.Second*3).UnixNano())
+	if lag := m.Lag(now); lag != time.Second*3 {
+		t.Errorf("bad lag: %v", lag)
+	}
+}
+
+func TestMirrorRetries(t *testing.T) {
+	m := NewMirror(newUnreachableStore(), newUnreachableStore(), 1, 10, 2)
+	retries, failed, applied := stats.MirrorRetries.Load(), stats.MirrorFailed.Load(), stats.MirrorApplied.Load()
+	m.Send("a")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	deadline := time.Now().Add(time.Second * 5)
+	for stats.MirrorFailed.Load()-failed < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("write not given up")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	cancel()
+	<-done
+	if n := stats.MirrorRetries.Load() - retries; n != 2 {
+		t.Errorf("bad retries: %d", n)
+	}
+
+	// writes queued on shutdown are replayed once
+	m.Send("b")
+	m.Run(ctx)
+	if n := stats.MirrorRetries.Load() - retries; n != 2 {
+		t.Errorf("bad retries: %d", n)
+	}
+	if n := stats.MirrorFailed.Load() - failed; n != 2 {
+		t.Errorf("bad failed: %d", n)
+	}
+	if n := stats.MirrorApplied.Load() - applied; n != 0 {
+		t.Errorf("bad applied: %d", n)
+	}
+	if n := m.Pending(); n != 0 {
+		t.Errorf("bad pending: %d", n)
+	}
+}
+
+func TestMirrorFlushBarrier(t *testing.T) {
+	m := NewMirror(newUnreachableStore(), newUnreachableStore(), 2, 10, 1)
+	// a key of another worker than key a
+	var other string
+	for _, key := range []string{"b", "c", "d", "e", "f"} {
+		if m.workerOf("a") != m.workerOf(key) {
+			other = key
+			break
+		}
+	}
+	retries, failed := stats.MirrorRetries.Load(), stats.MirrorFailed.Load()
+	m.SendFlush()
+	m.Send(other)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	// the flush is waiting for its retry, the key written after it waits too
+	time.Sleep(time.Millisecond * 50)
+	if n := stats.MirrorRetries.Load() - retries; n != 1 {
+		t.Errorf("bad retries: %d", n)
+	}
+	if n := stats.MirrorFailed.Load() - failed; n != 0 {
+		t.Errorf("bad failed: %d", n)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	// the flush counts for both workers
+	for stats.MirrorFailed.Load()-failed < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("writes not given up")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMirrorSynced(t *testing.T) {
+	m := NewMirror(newUnreachableStore(), newUnreachableStore(), 1, 1, 0)
+	if !m.Synced("a") {
+		t.Error("key never written should be synced")
+	}
+	m.Send("a")
+	// dropped, the queue is full
+	m.Send("a")
+	if m.Synced("a") || !m.Synced("b") {
+		t.Error("key written should not be synced")
+	}
+	e := <-m.workers[0].queue
+	// replayed before the dropped write
+	m.replayed(e.key, e.seq)
+	if m.Synced("a") {
+		t.Error("key of dropped write should not be synced")
+	}
+	m.Send("a")
+	e = <-m.workers[0].queue
+	m.replayed(e.key, e.seq)
+	if !m.Synced("a") {
+		t.Error("key of latest write replayed should be synced")
+	}
+
+	m.SendFlush()
+	if m.Synced("b") {
+		t.Error("no key should be synced before flush_all replayed")
+	}
+	e = <-m.workers[0].queue
+	m.replayed(mirrorFlushKey, e.seq)
+	if !m.Synced("b") {
+		t.Error("key should be synced after flush_all replayed")
+	}
+}
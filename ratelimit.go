@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitReject = "reject"
+	RateLimitDelay  = "delay"
+
+	// rateBucketIdle is how long an unused client bucket is kept
+	rateBucketIdle = time.Minute
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// Budget is the number of read and write requests per second, zero means unlimited
+type Budget struct {
+	Read  float64
+	Write float64
+}
+
+// ParseBudget parses a budget in form of "read/write", an empty string means unlimited
+func ParseBudget(s string) (b Budget, err error) {
+	if s = strings.TrimSpace(s); s == "" {
+		return
+	}
+	splits := strings.Split(s, "/")
+	if len(splits) != 2 {
+		err = errors.New("invalid budget, should be read/write: " + s)
+		return
+	}
+	if b.Read, err = strconv.ParseFloat(strings.TrimSpace(splits[0]), 64); err != nil {
+		return
+	}
+	if b.Write, err = strconv.ParseFloat(strings.TrimSpace(splits[1]), 64); err != nil {
+		return
+	}
+	if b.Read < 0 || b.Write < 0 {
+		err = errors.New("invalid budget, should not be negative: " + s)
+	}
+	return
+}
+
+// IsZero returns whether budget is unlimited
+func (b Budget) IsZero() bool {
+	return b.Read == 0 && b.Write == 0
+}
+
+// BudgetOverride is the per ip budget for ips in a network
+type BudgetOverride struct {
+	Network *net.IPNet
+	Budget  Budget
+}
+
+// ParseBudgetOverrides parses overrides in form of "cidr=read/write,..."
+func ParseBudgetOverrides(s string) (overrides []BudgetOverride, err error) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		splits := strings.SplitN(item, "=", 2)
+		if len(splits) != 2 {
+			err = errors.New("invalid budget override, should be cidr=read/write: " + item)
+			return
+		}
+		var o BudgetOverride
+		if _, o.Network, err = net.ParseCIDR(strings.TrimSpace(splits[0])); err != nil {
+			return
+		}
+		if o.Budget, err = ParseBudget(splits[1]); err != nil {
+			return
+		}
+		overrides = append(overrides, o)
+	}
+	return
+}
+
+// RateLimitConfig configures a rate limiter
+type RateLimitConfig struct {
+	// Mode is either reject or delay
+	Mode string
+	// MaxDelay is the longest delay in delay mode, requests are rejected beyond it
+	MaxDelay  time.Duration
+	Global    Budget
+	PerIP     Budget
+	PerUser   Budget
+	Overrides []BudgetOverride
+}
+
+// IsZero returns whether nothing is limited
+func (c RateLimitConfig) IsZero() bool {
+	return c.Global.IsZero() && c.PerIP.IsZero() && c.PerUser.IsZero() && len(c.Overrides) == 0
+}
+
+// budgetForIP returns the budget of ip, the longest matched override wins
+func (c RateLimitConfig) budgetForIP(ip net.IP) Budget {
+	budget, size := c.PerIP, -1
+	for _, o := range c.Overrides {
+		if ones, _ := o.Network.Mask.Size(); ones > size && o.Network.Contains(ip) {
+			budget, size = o.Budget, ones
+		}
+	}
+	return budget
+}
+
+// TokenBucket is a token bucket holding one second of tokens
+type TokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket
+func NewTokenBucket(rate float64, now time.Time) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *TokenBucket) burst() float64 {
+	if b.rate < 1 {
+		return 1
+	}
+	return b.rate
+}
+
+// Reserve takes n tokens, allowing debt, returns how long to wait until the debt is paid
+func (b *TokenBucket) Reserve(n float64, now time.Time) time.Duration {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if burst := b.burst(); b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+	// a request larger than burst would never pass
+	if burst := b.burst(); n > burst {
+		n = burst
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Cancel gives back n tokens of a reservation
+func (b *TokenBucket) Cancel(n float64) {
+	if burst := b.burst(); n > burst {
+		n = burst
+	}
+	b.tokens += n
+}
+
+// full returns whether bucket would be full at now
+func (b *TokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst()
+}
+
+type rateBuckets struct {
+	read  *TokenBucket
+	write *TokenBucket
+}
+
+func newRateBuckets(budget Budget, now time.Time) *rateBuckets {
+	bs := &rateBuckets{}
+	if budget.Read > 0 {
+		bs.read = NewTokenBucket(budget.Read, now)
+	}
+	if budget.Write > 0 {
+		bs.write = NewTokenBucket(budget.Write, now)
+	}
+	return bs
+}
+
+func (bs *rateBuckets) get(write bool) *TokenBucket {
+	if write {
+		return bs.write
+	}
+	return bs.read
+}
+
+func (bs *rateBuckets) full(now time.Time) bool {
+	return (bs.read == nil || bs.read.full(now)) && (bs.write == nil || bs.write.full(now))
+}
+
+// RateLimiter limits requests globally, per client ip and per user
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    RateLimitConfig
+	global    *rateBuckets
+	ips       map[string]*rateBuckets
+	users     map[string]*rateBuckets
+	lastSweep time.Time
+}
+
+var rateLimiter = &RateLimiter{}
+
+// Configure replaces configuration, all buckets are reset
+func (rl *RateLimiter) Configure(config RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.config = config
+	rl.global = newRateBuckets(config.Global, now)
+	rl.ips = map[string]*rateBuckets{}
+	rl.users = map[string]*rateBuckets{}
+	rl.lastSweep = now
+}
+
+// sweep removes idle client buckets, they are full again anyway
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateBucketIdle {
+		return
+	}
+	rl.lastSweep = now
+	for k, bs := range rl.ips {
+		if bs.full(now) {
+			delete(rl.ips, k)
+		}
+	}
+	for k, bs := range rl.users {
+		if bs.full(now) {
+			delete(rl.users, k)
+		}
+	}
+}
+
+// reserve takes n tokens from all applicable buckets, returns the reserved buckets and the longest wait
+func (rl *RateLimiter) reserve(ip net.IP, user string, write bool, n float64) (buckets []*TokenBucket, wait time.Duration, config RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	config = rl.config
+	if config.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	rl.sweep(now)
+
+	all := []*rateBuckets{rl.global}
+	if ip != nil {
+		key := ip.String()
+		bs := rl.ips[key]
+		if bs == nil {
+			bs = newRateBuckets(config.budgetForIP(ip), now)
+			rl.ips[key] = bs
+		}
+		all = append(all, bs)
+	}
+	if user != "" {
+		bs := rl.users[user]
+		if bs == nil {
+			bs = newRateBuckets(config.PerUser, now)
+			rl.users[user] = bs
+		}
+		all = append(all, bs)
+	}
+	for _, bs := range all {
+		if b := bs.get(write); b != nil {
+			if w := b.Reserve(n, now); w > wait {
+				wait = w
+			}
+			buckets = append(buckets, b)
+		}
+	}
+	return
+}
+
+func (rl *RateLimiter) cancel(buckets []*TokenBucket, n float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, b := range buckets {
+		b.Cancel(n)
+	}
+}
+
+// Wait takes n read or write tokens for a client, it delays the request or returns ErrRateLimited if budget is exceeded
+func (rl *RateLimiter) Wait(ctx context.Context, ip net.IP, user string, write bool, n int) error {
+	buckets, wait, config := rl.reserve(ip, user, write, float64(n))
+	if wait <= 0 {
+		return nil
+	}
+	if config.Mode != RateLimitDelay || wait > config.MaxDelay {
+		rl.cancel(buckets, float64(n))
+		stats.RateLimitRejected.Add(1)
+		return ErrRateLimited
+	}
+	stats.RateLimitDelayed.Add(1)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// commandCost returns whether command is a write and how many tokens it takes, zero for unlimited commands
+func commandCost(command string, keys int) (write bool, n int) {
+	switch command {
+	case "get", "gets":
+		return false, keys
+	case "set", "cas", "add", "replace", "append", "prepend", "incr", "decr", "delete", "touch", "flush_all":
+		return true, 1
+	}
+	return false, 0
+}
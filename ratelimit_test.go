@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBudget(t *testing.T) {
+	b, err := ParseBudget("100/20.5")
+	if err != nil || b.Read != 100 || b.Write != 20.5 {
+		t.Errorf("bad budget: %+v %v", b, err)
+	}
+	if b, err = ParseBudget(""); err != nil || !b.IsZero() {
+		t.Errorf("empty budget should be unlimited: %+v %v", b, err)
+	}
+	for _, s := range []string{"100", "a/1", "1/-1"} {
+		if _, err = ParseBudget(s); err == nil {
+			t.Errorf("should fail: %s", s)
+		}
+	}
+}
+
+func TestBudgetOverrides(t *testing.T) {
+	overrides, err := ParseBudgetOverrides("10.0.0.0/8=100/10, 10.1.0.0/16=0/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := RateLimitConfig{PerIP: Budget{Read: 5, Write: 1}, Overrides: overrides}
+	if b := c.budgetForIP(net.ParseIP("10.2.0.1")); b.Read != 100 {
+		t.Errorf("bad budget: %+v", b)
+	}
+	if b := c.budgetForIP(net.ParseIP("10.1.0.1")); !b.IsZero() {
+		t.Errorf("longest prefix should win: %+v", b)
+	}
+	if b := c.budgetForIP(net.ParseIP("192.168.0.1")); b.Read != 5 {
+		t.Errorf("bad default budget: %+v", b)
+	}
+	if _, err = ParseBudgetOverrides("10.0.0.0=1/1"); err == nil {
+		t.Error("should fail")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(10, now)
+	for i := 0; i < 10; i++ {
+		if w := b.Reserve(1, now); w != 0 {
+			t.Fatalf("should pass: %d", i)
+		}
+	}
+	if w := b.Reserve(1, now); w != time.Millisecond*100 {
+		t.Errorf("bad wait: %s", w)
+	}
+	b.Cancel(1)
+	if w := b.Reserve(1, now.Add(time.Millisecond*100)); w != 0 {
+		t.Errorf("should be refilled: %s", w)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := &RateLimiter{}
+	rl.Configure(RateLimitConfig{Mode: RateLimitReject, PerIP: Budget{Read: 2}})
+	ip, other := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := rl.Wait(ctx, ip, "", false, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rl.Wait(ctx, ip, "", false, 1); err != ErrRateLimited {
+		t.Errorf("should be rate limited: %v", err)
+	}
+	if err := rl.Wait(ctx, ip, "", true, 1); err != nil {
+		t.Errorf("write should be unlimited: %v", err)
+	}
+	if err := rl.Wait(ctx, other, "", false, 1); err != nil {
+		t.Errorf("other ip should pass: %v", err)
+	}
+
+	rl.Configure(RateLimitConfig{Mode: RateLimitDelay, MaxDelay: time.Second, Global: Budget{Write: 20}})
+	start := time.Now()
+	for i := 0; i < 21; i++ {
+		if err := rl.Wait(ctx, ip, "", true, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < time.Millisecond*40 {
+		t.Errorf("should be delayed: %s", d)
+	}
+}
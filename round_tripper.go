@@ -4,12 +4,9 @@ import (
 	"bufio"
 	"context"
 	"errors"
-	"github.com/bsm/redislock"
 	"github.com/go-redis/redis/v8"
 	"go.guoyk.net/redmemd/memwire"
 	"io"
-	"log"
-	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -25,26 +22,48 @@ const (
 	KeyValue = "value"
 	KeyToken = "token"
 	KeyFlags = "flags"
+	// KeyEncoding is absent for uncompressed values
+	KeyEncoding = "encoding"
+	// KeyKeyID is absent for plaintext values
+	KeyKeyID = "key_id"
 )
 
 type RoundTripper struct {
 	*memwire.Request
-	Debug          bool
-	Redis          *redis.Client
-	RedisLock      *redislock.Client
+	Session        *Session
+	Store          *Store
 	ResponseWriter *bufio.Writer
+
+	code string
+	err  error
+	// valueSize is the size of values replied
+	valueSize int
+	// authAttempt is set if request is an authentication, it carries credentials
+	authAttempt bool
+	// wireKeys are keys as sent by client, if any of them carries trace context
+	wireKeys []string
+	// checked is set once request passes access control and rate limit
+	checked bool
+	// shadowValues are values replied, recorded in shadow mode
+	shadowValues []ShadowValue
+}
+
+// recordShadowValue records a value replied in shadow mode, key is the key store was queried with
+func (rt *RoundTripper) recordShadowValue(key string, v memwire.Value, data []byte) {
+	if shadow == nil {
+		return
+	}
+	rt.shadowValues = append(rt.shadowValues, newShadowValue(key, v.Flags, data, v.Cas))
 }
 
 func (rt *RoundTripper) Reply(res *memwire.Response) (err error) {
+	rt.recordResult(res.Response)
+	for _, v := range res.Values {
+		rt.valueSize += len(v.Data)
+	}
 	if rt.Noreply {
-		if rt.Debug {
-			log.Println("[debug] noreply")
-		}
 		return
 	}
-	if rt.Debug {
-		log.Println("[debug] reply:", res.Response, res.Values)
-	}
 	if _, err = rt.ResponseWriter.WriteString(res.String()); err != nil {
 		return
 	}
@@ -54,12 +73,80 @@ func (rt *RoundTripper) Reply(res *memwire.Response) (err error) {
 	return
 }
 
+// ReplyChunked replies values, streaming chunks of chunked items, keys and items are in the same order as res.Values,
+// keys are the keys store was queried with
+func (rt *RoundTripper) ReplyChunked(ctx context.Context, res *memwire.Response, keys []string, items []*Item) (err error) {
+	var chunked bool
+	for _, item := range items {
+		if item.Manifest != nil {
+			chunked = true
+		}
+	}
+	if !chunked {
+		for i, v := range res.Values {
+			rt.recordShadowValue(keys[i], v, v.Data)
+		}
+		return rt.Reply(res)
+	}
+	rt.recordResult(res.Response)
+	w := rt.ResponseWriter
+	for i, v := range res.Values {
+		if items[i].Manifest == nil {
+			rt.valueSize += len(v.Data)
+			rt.recordShadowValue(keys[i], v, v.Data)
+			if _, err = w.WriteString(memwire.ValueHeader(v.Key, v.Flags, len(v.Data), v.Cas)); err != nil {
+				return
+			}
+			if _, err = w.Write(v.Data); err != nil {
+				return
+			}
+		} else {
+			rt.valueSize += items[i].Manifest.Size
+			if _, err = w.WriteString(memwire.ValueHeader(v.Key, v.Flags, items[i].Manifest.Size, v.Cas)); err != nil {
+				return
+			}
+			// a failure here leaves the response incomplete, the connection must be closed
+			var data []byte
+			if err = rt.Store.ReadChunks(ctx, keys[i], items[i], func(chunk []byte) (err error) {
+				if shadow != nil {
+					data = append(data, chunk...)
+				}
+				_, err = w.Write(chunk)
+				return
+			}); err != nil {
+				return
+			}
+			rt.recordShadowValue(keys[i], v, data)
+		}
+		if _, err = w.WriteString("\r\n"); err != nil {
+			return
+		}
+	}
+	if _, err = w.WriteString(res.Response + "\r\n"); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
 func (rt *RoundTripper) ReplyCode(code ...string) error {
 	return rt.Reply(&memwire.Response{
 		Response: strings.Join(code, " "),
 	})
 }
 
+func (rt *RoundTripper) ReplyStats(lines []string) error {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString("STAT ")
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	b.WriteString(memwire.CodeEnd)
+	return rt.Reply(&memwire.Response{
+		Response: b.String(),
+	})
+}
+
 func (rt *RoundTripper) ReplyError(err error) error {
 	if err == ErrExists {
 		return rt.ReplyCode(memwire.CodeExists)
@@ -70,120 +157,307 @@ func (rt *RoundTripper) ReplyError(err error) error {
 	if err == ErrNotFound {
 		return rt.ReplyCode(memwire.CodeNotFound)
 	}
+	if err == ErrUnauthenticated || err == ErrPermissionDenied {
+		return rt.ReplyCode(memwire.CodeClientErr, err.Error())
+	}
+	rt.err = err
 	return rt.ReplyCode(memwire.CodeServerErr, err.Error())
 }
 
-func (rt *RoundTripper) WithLock(ctx context.Context, key string, fn func(ctx context.Context) error) error {
-	obtain, err := rt.RedisLock.Obtain(ctx, "__LOCK."+key, time.Second, &redislock.Options{
-		RetryStrategy: redislock.LinearBackoff(time.Millisecond * 100),
-	})
-	if err != nil {
-		return err
+// resultCode returns result code, which is the first word of the last line of response
+func resultCode(response string) string {
+	line := response[strings.LastIndex(response, "\n")+1:]
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+	return line
+}
+
+// recordResult counts result code of response
+func recordResult(response string) string {
+	code := resultCode(response)
+	metrics.Results.With(code).Add(1)
+	return code
+}
+
+func (rt *RoundTripper) recordResult(response string) {
+	rt.code = recordResult(response)
+}
+
+// parseTraceKeys strips trace context from keys, returns the first trace context found
+func (rt *RoundTripper) parseTraceKeys() (traceID TraceID, parentID SpanID) {
+	var ok bool
+	if rt.Key != "" {
+		rt.Key, traceID, parentID, ok = ParseTraceKey(rt.Key)
+	}
+	for i, key := range rt.Keys {
+		stripped, tid, pid, found := ParseTraceKey(key)
+		if !found {
+			continue
+		}
+		if rt.wireKeys == nil {
+			rt.wireKeys = append([]string{}, rt.Keys...)
+			rt.Keys = append([]string{}, rt.Keys...)
+		}
+		rt.Keys[i] = stripped
+		if !ok {
+			traceID, parentID, ok = tid, pid, true
+		}
+	}
+	return
+}
+
+// wireKey returns i-th key as sent by client
+func (rt *RoundTripper) wireKey(i int) string {
+	if rt.wireKeys != nil {
+		return rt.wireKeys[i]
 	}
-	defer obtain.Release(ctx)
-	return fn(ctx)
+	return rt.Keys[i]
 }
 
 func (rt *RoundTripper) Do(ctx context.Context) error {
-	if rt.Debug {
-		log.Println("[debug] request:", rt.Command, rt.Key, strings.Join(rt.Keys, ","), rt.Exptime)
+	start := time.Now()
+	var (
+		traceID  TraceID
+		parentID SpanID
+	)
+	// keys are taken as they are unless tracing is enabled
+	if tracer != nil {
+		traceID, parentID = rt.parseTraceKeys()
+	}
+	ctx, span := tracer.Start(ctx, "memcached "+rt.Command, traceID, parentID)
+	ctx, timings := withCommandTimings(ctx)
+	err := rt.do(ctx)
+	latency := time.Since(start)
+	metrics.Commands.With(rt.Command).Add(1)
+	metrics.CommandDuration.With(rt.Command).Observe(latency.Seconds())
+	// streaming commands are expected to be long
+	if !isStreamingCommand(rt.Command) && slowlog.IsSlow(latency) {
+		slowlog.Add(SlowEntry{
+			Time:      start,
+			Conn:      rt.Session.ID,
+			Remote:    rt.Session.RemoteAddr,
+			User:      rt.Session.User,
+			Command:   rt.Command,
+			Keys:      rt.keys(),
+			ValueSize: len(rt.Data) + rt.valueSize,
+			LockWait:  float64(timings.LockWait().Microseconds()) / 1000,
+			Redis:     float64(timings.Redis().Microseconds()) / 1000,
+			Latency:   float64(latency.Microseconds()) / 1000,
+			Result:    rt.code,
+		})
+	}
+	if !rt.authAttempt && rt.Command != "watch" {
+		watchers.Publish(rt.Command, rt.keys(), rt.Session.IP, func() string {
+			return rt.watchLine(start, latency)
+		})
+		// requests denied never reach redis
+		if rt.checked {
+			hotKeys.Record(rt.Command, rt.keys())
+		}
+		if auditor != nil && isMutatingCommand(rt.Command) {
+			rt.audit(start)
+		}
+		if shadow != nil && rt.checked && isShadowCommand(rt.Command) {
+			rt.shadow()
+		}
+	}
+	if span == nil && !logger.Enabled(LevelDebug) {
+		return err
+	}
+	key := strings.Join(rt.keys(), ",")
+	kvs := []interface{}{
+		"conn", rt.Session.ID,
+		"remote", rt.Session.RemoteAddr,
+		"command", rt.Command,
+		"key", key,
+		"code", rt.code,
+		"latency_ms", float64(latency.Microseconds()) / 1000,
+	}
+	if span != nil {
+		span.SetAttr("memcached.command", rt.Command)
+		span.SetAttr("memcached.key", key)
+		span.SetAttr("memcached.result", rt.code)
+		span.SetAttr("net.sock.peer.addr", rt.Session.RemoteAddr)
+		span.SetAttr("redmemd.conn", rt.Session.ID)
+		if err != nil {
+			span.Finish(err)
+		} else {
+			span.Finish(rt.err)
+		}
+		kvs = append(kvs, "trace_id", span.TraceID)
+	}
+	logger.Debug("command", kvs...)
+	return err
+}
+
+// isStreamingCommand returns whether command streams its response for a long time
+func isStreamingCommand(command string) bool {
+	return command == "watch" || command == "lru_crawler"
+}
+
+// keys returns keys of request
+func (rt *RoundTripper) keys() []string {
+	if rt.Key != "" {
+		return []string{rt.Key}
+	}
+	return rt.Keys
+}
+
+// audit queues audit record of a mutating command
+func (rt *RoundTripper) audit(start time.Time) {
+	r := &AuditRecord{
+		Time:      start,
+		Conn:      rt.Session.ID,
+		Remote:    rt.Session.RemoteAddr,
+		User:      rt.Session.User,
+		Command:   rt.Command,
+		Key:       strings.Join(rt.keys(), ","),
+		ValueSize: len(rt.Data),
+		Exptime:   rt.Exptime,
+		Result:    rt.code,
+	}
+	switch rt.Command {
+	case "set", "cas", "add", "replace", "append", "prepend":
+		r.ValueHash = hashValue(rt.Data)
+	case "incr", "decr":
+		r.Delta = rt.Value
+	}
+	auditor.Log(r)
+}
+
+// shadow queues request and its result to be replayed against reference memcached
+func (rt *RoundTripper) shadow() {
+	req := &ShadowRequest{
+		Request: *rt.Request,
+		Result:  ShadowResult{Code: rt.code, Values: rt.shadowValues},
+	}
+	req.Noreply = false
+	shadow.Send(req)
+}
+
+// authenticate handles memcached ascii authentication, a set command with data "<user> <password>"
+func (rt *RoundTripper) authenticate(a *ACL) error {
+	if rt.Command != "set" {
+		return rt.ReplyError(ErrUnauthenticated)
+	}
+	rt.authAttempt = true
+	splits := strings.SplitN(string(rt.Data), " ", 2)
+	if len(splits) != 2 || !a.Authenticate(splits[0], splits[1]) {
+		stats.AuthFailures.Add(1)
+		kvs := []interface{}{"conn", rt.Session.ID, "remote", rt.Session.RemoteAddr}
+		// a single token may be the whole credential, never log it
+		if len(splits) == 2 {
+			kvs = append(kvs, "user", splits[0])
+		}
+		logger.Warn("authentication failed", kvs...)
+		return rt.ReplyCode(memwire.CodeClientErr, "authentication failure")
+	}
+	rt.Session.SetUser(splits[0])
+	return rt.ReplyCode(memwire.CodeStored)
+}
+
+func (rt *RoundTripper) do(ctx context.Context) error {
+	a := currentACL()
+	principal := rt.Session.Principal()
+	if a.AuthRequired() && principal.User == "" {
+		return rt.authenticate(a)
+	}
+	if err := a.Check(principal, rt.Command, rt.keys()); err != nil {
+		stats.ACLDeniedCommands.Add(1)
+		return rt.ReplyError(err)
 	}
+	if write, n := commandCost(rt.Command, len(rt.Keys)); n > 0 {
+		if err := rateLimiter.Wait(ctx, rt.Session.IP, rt.Session.User, write, n); err != nil {
+			return rt.ReplyError(err)
+		}
+	}
+	rt.checked = true
 	switch rt.Command {
 	case "set", "cas", "add", "replace":
-		if err := rt.WithLock(ctx, rt.Key, func(ctx context.Context) error {
-			var err error
+		if err := rt.Store.WithLock(ctx, rt.Key, func(ctx context.Context) error {
 			switch rt.Command {
 			case "cas", "add", "replace":
-				var val map[string]string
-				if val, err = rt.Redis.HGetAll(ctx, rt.Key).Result(); err != nil {
-					return err
+				if item, err := rt.Store.Get(ctx, rt.Key); err != nil {
+					if err != ErrNotFound {
+						return err
+					}
+					switch rt.Command {
+					case "cas":
+						return err
+					case "add":
+						// no-op
+					case "replace":
+						return ErrNotStored
+					}
 				} else {
-					if len(val) == 0 {
-						switch rt.Command {
-						case "cas":
-							return err
-						case "add":
-							// no-op
-						case "replace":
-							return ErrNotStored
-						}
-					} else {
-						switch rt.Command {
-						case "cas":
-							if val[KeyToken] != rt.Cas {
-								return ErrExists
-							}
-						case "add":
-							return ErrNotStored
-						case "replace":
-							// no-op
+					switch rt.Command {
+					case "cas":
+						if item.Token != rt.Cas {
+							return ErrExists
 						}
+					case "add":
+						return ErrNotStored
+					case "replace":
+						// no-op
 					}
 				}
 			}
-			if err = rt.Redis.HSet(
+			return rt.Store.Set(
 				ctx,
 				rt.Key,
-				KeyValue, string(rt.Data),
-				KeyFlags, rt.Flags,
-				KeyToken, strconv.FormatInt(rand.Int63(), 10),
-			).Err(); err != nil {
-				return err
-			}
-			if rt.Exptime != 0 {
-				if err = rt.Redis.Expire(
-					ctx,
-					rt.Key,
-					time.Second*time.Duration(rt.Exptime),
-				).Err(); err != nil {
-					return err
-				}
-			}
-			return nil
+				&Item{
+					Value: rt.Data,
+					Flags: rt.Flags,
+					Token: NewToken(),
+				},
+				time.Second*time.Duration(rt.Exptime),
+			)
 		}); err != nil {
 			return rt.ReplyError(err)
 		}
 		return rt.ReplyCode(memwire.CodeStored)
 	case "get", "gets":
+		found, err := rt.Store.OpenCachedMulti(ctx, rt.Keys)
+		if err != nil {
+			return rt.ReplyError(err)
+		}
 		res := &memwire.Response{}
-		for _, key := range rt.Keys {
-			var (
-				err error
-				val map[string]string
-				flg string
-				tkn string
-			)
-			if val, err = rt.Redis.HGetAll(ctx, key).Result(); err != nil {
-				if err == redis.Nil {
-					continue
-				} else {
-					return rt.ReplyError(err)
-				}
+		var (
+			keys  []string
+			items []*Item
+		)
+		for i, item := range found {
+			if item == nil {
+				metrics.Misses.Add(1)
+				continue
 			}
-			flg = val[KeyFlags]
+			metrics.Hits.Add(1)
+			flg := item.Flags
 			if flg == "" {
 				flg = "0"
 			}
+			var tkn string
 			if rt.Command == "gets" {
-				tkn = val[KeyToken]
+				tkn = item.Token
 			}
 			res.Values = append(res.Values, memwire.Value{
-				Key:   key,
+				Key:   rt.wireKey(i),
 				Flags: flg,
-				Data:  []byte(val[KeyValue]),
+				Data:  item.Value,
 				Cas:   tkn,
 			})
+			keys = append(keys, rt.Keys[i])
+			items = append(items, item)
 		}
 		res.Response = memwire.CodeEnd
-		return rt.Reply(res)
+		return rt.ReplyChunked(ctx, res, keys, items)
 	case "delete":
 		var count int
 		for _, key := range rt.Keys {
-			if err := rt.Redis.Del(ctx, key).Err(); err != nil {
-				if err != redis.Nil {
-					return rt.ReplyError(err)
-				}
-			} else {
+			if ok, err := rt.Store.Delete(ctx, key); err != nil {
+				return rt.ReplyError(err)
+			} else if ok {
 				count++
 			}
 		}
@@ -193,11 +467,12 @@ func (rt *RoundTripper) Do(ctx context.Context) error {
 			return rt.ReplyCode(memwire.CodeDeleted)
 		}
 	case "incr", "decr", "append", "prepend":
-		if err := rt.WithLock(ctx, rt.Key, func(ctx context.Context) (err error) {
-			var val string
-			if val, err = rt.Redis.HGet(ctx, rt.Key, KeyValue).Result(); err != nil {
+		if err := rt.Store.WithLock(ctx, rt.Key, func(ctx context.Context) (err error) {
+			var item *Item
+			if item, err = rt.Store.Get(ctx, rt.Key); err != nil {
 				return
 			}
+			val := string(item.Value)
 			switch rt.Command {
 			case "incr", "decr":
 				var i int64
@@ -216,7 +491,8 @@ func (rt *RoundTripper) Do(ctx context.Context) error {
 			case "prepend":
 				val = string(rt.Data) + val
 			}
-			if err = rt.Redis.HSet(ctx, rt.Key, KeyValue, val).Err(); err != nil {
+			item.Value = []byte(val)
+			if err = rt.Store.Update(ctx, rt.Key, item); err != nil {
 				return
 			}
 			return
@@ -225,14 +501,36 @@ func (rt *RoundTripper) Do(ctx context.Context) error {
 		}
 		return rt.ReplyCode(memwire.CodeStored)
 	case "touch":
-		if err := rt.Redis.Expire(ctx, rt.Key, time.Second*time.Duration(rt.Exptime)).Err(); err != nil {
+		if err := rt.Store.Touch(ctx, rt.Key, time.Second*time.Duration(rt.Exptime)); err != nil {
 			return rt.ReplyError(err)
 		}
 		return rt.ReplyCode(memwire.CodeTouched)
+	case "stats":
+		switch strings.Join(rt.Keys, " ") {
+		case "":
+			return rt.ReplyStats(stats.Report())
+		case "slowlog":
+			return rt.ReplyStats(slowlog.Report())
+		case "slowlog reset":
+			slowlog.Reset()
+			return rt.ReplyCode("RESET")
+		case "hotkeys":
+			return rt.ReplyStats(hotKeys.Report())
+		case "shards":
+			if shards == nil {
+				return rt.ReplyStats(nil)
+			}
+			return rt.ReplyStats(shards.Report())
+		}
+		return rt.ReplyCode(memwire.CodeErr)
+	case "watch":
+		return rt.watch(ctx)
+	case "lru_crawler":
+		return rt.metaDump(ctx)
 	case "version":
 		return rt.ReplyCode("VERSION", "1")
 	case "flush_all":
-		if err := rt.Redis.FlushDB(ctx).Err(); err != nil {
+		if err := rt.Store.Flush(ctx); err != nil {
 			return rt.ReplyError(err)
 		}
 		return rt.ReplyCode(memwire.CodeOK)
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is an active client connection
+type Session struct {
+	ID          int64
+	RemoteAddr  string
+	ConnectedAt time.Time
+	// IP is the client ip, nil if remote address is not tcp
+	IP net.IP
+	// User is the authenticated user, or common name of tls client certificate, empty if unknown
+	User string
+
+	conn        net.Conn
+	commands    Counter
+	lastCommand atomic.Value
+
+	mu       sync.Mutex
+	busy     bool
+	draining bool
+}
+
+// SessionInfo is a snapshot of a session
+type SessionInfo struct {
+	ID          int64     `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	User        string    `json:"user,omitempty"`
+	Commands    int64     `json:"commands"`
+	LastCommand string    `json:"last_command"`
+}
+
+// Record records a command processed by session
+func (s *Session) Record(command string) {
+	s.commands.Add(1)
+	s.lastCommand.Store(command)
+}
+
+// Info returns a snapshot of session
+func (s *Session) Info() SessionInfo {
+	last, _ := s.lastCommand.Load().(string)
+	s.mu.Lock()
+	user := s.User
+	s.mu.Unlock()
+	return SessionInfo{
+		ID:          s.ID,
+		RemoteAddr:  s.RemoteAddr,
+		ConnectedAt: s.ConnectedAt,
+		User:        user,
+		Commands:    s.commands.Load(),
+		LastCommand: last,
+	}
+}
+
+// SetUser sets the authenticated user, it must be called by the connection goroutine
+func (s *Session) SetUser(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.User = user
+}
+
+// Principal returns identity of session
+func (s *Session) Principal() Principal {
+	return Principal{IP: s.IP, User: s.User}
+}
+
+// Drain marks session as draining, an idle session is woken up to exit,
+// a busy one exits after the command in flight
+func (s *Session) Drain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	if !s.busy {
+		_ = s.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Draining returns whether session is draining
+func (s *Session) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// SetBusy marks whether a command is in flight, returns whether session is draining
+func (s *Session) SetBusy(busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = busy
+	return s.draining
+}
+
+// Begin marks a command in flight and sets deadlines of its request and response, returns whether session is draining,
+// it's atomic with Drain, a drain started before is seen and one started after waits for the command
+func (s *Session) Begin(read, write time.Time) (draining bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.busy = true
+	if err = s.conn.SetReadDeadline(read); err != nil {
+		return
+	}
+	if err = s.conn.SetWriteDeadline(write); err != nil {
+		return
+	}
+	draining = s.draining
+	return
+}
+
+// SetIdleDeadline sets read deadline for waiting next command, it expires immediately if session is draining
+func (s *Session) SetIdleDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		t = time.Now()
+	}
+	return s.conn.SetReadDeadline(t)
+}
+
+// Kill closes connection of session
+func (s *Session) Kill() error {
+	return s.conn.Close()
+}
+
+// Sessions is the registry of active sessions
+type Sessions struct {
+	mu       sync.Mutex
+	nextID   int64
+	items    map[int64]*Session
+	draining bool
+}
+
+var sessions = &Sessions{items: map[int64]*Session{}}
+
+// Add registers a new session for conn
+func (ss *Sessions) Add(conn net.Conn) *Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.nextID++
+	s := &Session{
+		ID:          ss.nextID,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		ConnectedAt: time.Now(),
+		conn:        conn,
+		draining:    ss.draining,
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		s.IP = addr.IP
+	}
+	ss.items[s.ID] = s
+	return s
+}
+
+// Remove unregisters a session
+func (ss *Sessions) Remove(s *Session) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.items, s.ID)
+}
+
+// Get returns session by id
+func (ss *Sessions) Get(id int64) *Session {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.items[id]
+}
+
+// Drain drains all sessions, including ones added later
+func (ss *Sessions) Drain() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.draining = true
+	for _, s := range ss.items {
+		s.Drain()
+	}
+}
+
+// KillAll kills all sessions, returns number of sessions killed
+func (ss *Sessions) KillAll() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, s := range ss.items {
+		_ = s.Kill()
+	}
+	return len(ss.items)
+}
+
+// List returns snapshots of all sessions, ordered by id
+func (ss *Sessions) List() (infos []SessionInfo) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	infos = make([]SessionInfo, 0, len(ss.items))
+	for _, s := range ss.items {
+		infos = append(infos, s.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return
+}
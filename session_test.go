@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionDrain(t *testing.T) {
+	ss := &Sessions{items: map[int64]*Session{}}
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	s := ss.Add(server)
+	r := bufio.NewReader(server)
+
+	l := &Limits{}
+	chErr := make(chan error, 1)
+	go func() {
+		_, err := l.waitRequest(s, r)
+		chErr <- err
+	}()
+	time.Sleep(time.Millisecond * 20)
+	ss.Drain()
+
+	select {
+	case err := <-chErr:
+		if err != ErrIdleTimeout {
+			t.Errorf("idle session should be woken up: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle session not woken up")
+	}
+
+	// a request arrived right before the drain is refused
+	if draining, err := s.Begin(time.Time{}, time.Time{}); err != nil || !draining {
+		t.Errorf("session should be draining: %v", err)
+	}
+
+	later, _ := net.Pipe()
+	defer later.Close()
+	if !ss.Add(later).Draining() {
+		t.Error("session added after drain should be draining")
+	}
+	if n := ss.KillAll(); n != 2 {
+		t.Errorf("bad killed count: %d", n)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"go.guoyk.net/redmemd/memwire"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// shadowQueueSize is the number of requests queued for a shadow worker, requests are dropped beyond it
+	shadowQueueSize = 1024
+	// shadowTimeout is the timeout of dialing and each round trip to reference memcached
+	shadowTimeout = time.Second
+	// shadowCasSize is the max number of cas uniques translated, the translation is reset beyond it
+	shadowCasSize = 65536
+)
+
+// ShadowValue is a value replied, values are compared by flags, size and hash of data
+type ShadowValue struct {
+	Key   string
+	Flags string
+	Size  int
+	Hash  uint64
+	// Cas is not compared, cas uniques of redmemd and memcached never match
+	Cas string
+}
+
+func newShadowValue(key, flags string, data []byte, cas string) ShadowValue {
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return ShadowValue{Key: key, Flags: flags, Size: len(data), Hash: h.Sum64(), Cas: cas}
+}
+
+// ShadowResult is a response of redmemd or reference memcached
+type ShadowResult struct {
+	// Code is the first word of the last line of response
+	Code   string
+	Values []ShadowValue
+}
+
+// Diff describes the first difference from ref, empty if they match
+func (r *ShadowResult) Diff(ref *ShadowResult) string {
+	if r.Code != ref.Code {
+		return "code " + r.Code + " != " + ref.Code
+	}
+	refValues := map[string]ShadowValue{}
+	for _, v := range ref.Values {
+		refValues[v.Key] = v
+	}
+	for _, v := range r.Values {
+		rv, ok := refValues[v.Key]
+		if !ok {
+			return "key " + v.Key + " missing in reference"
+		}
+		delete(refValues, v.Key)
+		if v.Flags != rv.Flags {
+			return "key " + v.Key + " flags " + v.Flags + " != " + rv.Flags
+		}
+		if v.Size != rv.Size {
+			return "key " + v.Key + " size " + strconv.Itoa(v.Size) + " != " + strconv.Itoa(rv.Size)
+		}
+		if v.Hash != rv.Hash {
+			return "key " + v.Key + " value differs"
+		}
+	}
+	for _, v := range ref.Values {
+		if _, ok := refValues[v.Key]; ok {
+			return "key " + v.Key + " missing in redmemd"
+		}
+	}
+	return ""
+}
+
+// ShadowRequest is a request processed by redmemd and its result, to be replayed against reference memcached
+type ShadowRequest struct {
+	memwire.Request
+	Result ShadowResult
+}
+
+// isShadowCommand returns whether command is forwarded to reference memcached
+func isShadowCommand(command string) bool {
+	return command == "get" || command == "gets" || isMutatingCommand(command)
+}
+
+// formatShadowRequest formats request in memcached text protocol, always with a reply
+func formatShadowRequest(req *memwire.Request, cas string) []byte {
+	var b strings.Builder
+	b.WriteString(req.Command)
+	switch req.Command {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		b.WriteString(" " + req.Key + " " + req.Flags + " " + strconv.FormatInt(req.Exptime, 10) + " " + strconv.Itoa(len(req.Data)))
+		if req.Command == "cas" {
+			b.WriteString(" " + cas)
+		}
+		b.WriteString("\r\n")
+		b.Write(req.Data)
+	case "get", "gets":
+		b.WriteString(" " + strings.Join(req.Keys, " "))
+	case "delete":
+		if len(req.Keys) > 0 {
+			b.WriteString(" " + req.Keys[0])
+		}
+	case "incr", "decr":
+		b.WriteString(" " + req.Key + " " + strconv.FormatInt(req.Value, 10))
+	case "touch":
+		b.WriteString(" " + req.Key + " " + strconv.FormatInt(req.Exptime, 10))
+	case "flush_all":
+		if req.Exptime != 0 {
+			b.WriteString(" " + strconv.FormatInt(req.Exptime, 10))
+		}
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// readShadowResult reads a response of memcached text protocol
+func readShadowResult(r *bufio.Reader) (res *ShadowResult, err error) {
+	res = &ShadowResult{}
+	for {
+		var line string
+		if line, err = r.ReadString('\n'); err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, "VALUE ") {
+			res.Code = resultCode(line)
+			return
+		}
+		// VALUE <key> <flags> <bytes> [<cas unique>]
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			err = errors.New("invalid value line: " + line)
+			return
+		}
+		var size int
+		if size, err = strconv.Atoi(fields[3]); err != nil {
+			return
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+		var cas string
+		if len(fields) > 4 {
+			cas = fields[4]
+		}
+		res.Values = append(res.Values, newShadowValue(fields[1], fields[2], data[:size], cas))
+	}
+}
+
+// Shadow replays requests against a reference memcached asynchronously and compares the results
+type Shadow struct {
+	Addr string
+
+	workers []*shadowWorker
+
+	logMu     sync.Mutex
+	logBucket *TokenBucket
+
+	// cas translates cas uniques of redmemd to reference memcached, by key and cas unique
+	casMu sync.Mutex
+	cas   map[string]string
+}
+
+var shadow *Shadow
+
+// NewShadow creates a shadow of concurrency workers, logging at most logRate mismatches per second
+func NewShadow(addr string, concurrency int, logRate float64) *Shadow {
+	s := &Shadow{Addr: addr, cas: map[string]string{}}
+	if logRate > 0 {
+		s.logBucket = NewTokenBucket(logRate, time.Now())
+	}
+	for i := 0; i < concurrency; i++ {
+		s.workers = append(s.workers, &shadowWorker{s: s, queue: make(chan *ShadowRequest, shadowQueueSize)})
+	}
+	return s
+}
+
+func (s *Shadow) workerOf(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.workers)))
+}
+
+// Send queues request without blocking, requests of the same key are replayed in order,
+// a multiget is split by worker of keys, so that each key is ordered with its writes
+func (s *Shadow) Send(req *ShadowRequest) {
+	if len(req.Keys) < 2 {
+		key := req.Key
+		if len(req.Keys) > 0 {
+			key = req.Keys[0]
+		}
+		s.send(s.workers[s.workerOf(key)], req)
+		return
+	}
+	var parts []*ShadowRequest
+	byWorker := map[int]*ShadowRequest{}
+	for _, key := range req.Keys {
+		i := s.workerOf(key)
+		part := byWorker[i]
+		if part == nil {
+			part = &ShadowRequest{Request: req.Request, Result: ShadowResult{Code: req.Result.Code}}
+			part.Keys = nil
+			byWorker[i] = part
+			parts = append(parts, part)
+		}
+		part.Keys = append(part.Keys, key)
+	}
+	if len(parts) == 1 {
+		s.send(s.workers[s.workerOf(req.Keys[0])], req)
+		return
+	}
+	for _, v := range req.Result.Values {
+		part := byWorker[s.workerOf(v.Key)]
+		part.Result.Values = append(part.Result.Values, v)
+	}
+	for _, part := range parts {
+		s.send(s.workers[s.workerOf(part.Keys[0])], part)
+	}
+}
+
+func (s *Shadow) send(w *shadowWorker, req *ShadowRequest) {
+	select {
+	case w.queue <- req:
+	default:
+		stats.ShadowDropped.Add(1)
+	}
+}
+
+// Run replays requests until ctx is done
+func (s *Shadow) Run(ctx context.Context) {
+	wg := &sync.WaitGroup{}
+	for _, w := range s.workers {
+		wg.Add(1)
+		go func(w *shadowWorker) {
+			defer wg.Done()
+			w.run(ctx)
+		}(w)
+	}
+	wg.Wait()
+}
+
+func casKey(key, cas string) string {
+	return key + " " + cas
+}
+
+// translateCas returns cas unique of reference memcached for a cas unique replied by redmemd
+func (s *Shadow) translateCas(key, cas string) (ref string, ok bool) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+	ref, ok = s.cas[casKey(key, cas)]
+	return
+}
+
+// learnCas records cas uniques of the same values replied by both
+func (s *Shadow) learnCas(res, ref *ShadowResult) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+	for _, v := range res.Values {
+		for _, rv := range ref.Values {
+			if v.Key != rv.Key || v.Cas == "" || rv.Cas == "" {
+				continue
+			}
+			if len(s.cas) >= shadowCasSize {
+				s.cas = map[string]string{}
+			}
+			s.cas[casKey(v.Key, v.Cas)] = rv.Cas
+		}
+	}
+}
+
+// compare records result of reference memcached
+func (s *Shadow) compare(req *ShadowRequest, ref *ShadowResult) {
+	stats.ShadowRequests.Add(1)
+	if req.Command == "gets" {
+		s.learnCas(&req.Result, ref)
+	}
+	diff := req.Result.Diff(ref)
+	if diff == "" {
+		return
+	}
+	stats.ShadowMismatches.Add(1)
+	metrics.ShadowMismatches.With(req.Command).Add(1)
+	if s.logBucket != nil {
+		s.logMu.Lock()
+		sampled := s.logBucket.Reserve(1, time.Now()) <= 0
+		if !sampled {
+			s.logBucket.Cancel(1)
+		}
+		s.logMu.Unlock()
+		if !sampled {
+			return
+		}
+	}
+	key := req.Key
+	if key == "" {
+		key = strings.Join(req.Keys, ",")
+	}
+	logger.Warn("shadow mismatch", "command", req.Command, "key", key, "diff", diff, "code", req.Result.Code, "reference_code", ref.Code)
+}
+
+type shadowWorker struct {
+	s     *Shadow
+	queue chan *ShadowRequest
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (w *shadowWorker) run(ctx context.Context) {
+	defer w.close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-w.queue:
+			cas := req.Cas
+			if req.Command == "cas" {
+				var ok bool
+				if cas, ok = w.s.translateCas(req.Key, req.Cas); !ok {
+					// the value was never fetched from reference
+					stats.ShadowSkipped.Add(1)
+					continue
+				}
+			}
+			ref, err := w.do(formatShadowRequest(&req.Request, cas))
+			if err != nil {
+				stats.ShadowErrors.Add(1)
+				logger.Debug("shadow failed", "addr", w.s.Addr, "command", req.Command, "err", err)
+				w.close()
+				continue
+			}
+			w.s.compare(req, ref)
+		}
+	}
+}
+
+func (w *shadowWorker) do(buf []byte) (res *ShadowResult, err error) {
+	if w.conn == nil {
+		if w.conn, err = net.DialTimeout("tcp", w.s.Addr, shadowTimeout); err != nil {
+			return
+		}
+		w.r = bufio.NewReader(w.conn)
+	}
+	_ = w.conn.SetDeadline(time.Now().Add(shadowTimeout))
+	if _, err = w.conn.Write(buf); err != nil {
+		return
+	}
+	return readShadowResult(w.r)
+}
+
+func (w *shadowWorker) close() {
+	if w.conn != nil {
+		_ = w.conn.Close()
+		w.conn, w.r = nil, nil
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"go.guoyk.net/redmemd/memwire"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowResultDiff(t *testing.T) {
+	a := newShadowValue("a", "0", []byte("hello"), "123")
+	b := newShadowValue("b", "0", []byte("world"), "")
+	res := &ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{a, b}}
+	for _, c := range []struct {
+		ref  *ShadowResult
+		diff string
+	}{
+		// cas uniques are not compared
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{b, newShadowValue("a", "0", []byte("hello"), "1")}}, ""},
+		{&ShadowResult{Code: memwire.CodeServerErr}, "code END != SERVER_ERROR"},
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{a}}, "key b missing in reference"},
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{a, b, newShadowValue("c", "0", nil, "")}}, "key c missing in redmemd"},
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{newShadowValue("a", "1", []byte("hello"), ""), b}}, "key a flags 0 != 1"},
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{newShadowValue("a", "0", []byte("hell"), ""), b}}, "key a size 5 != 4"},
+		{&ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{newShadowValue("a", "0", []byte("jello"), ""), b}}, "key a value differs"},
+	} {
+		if diff := res.Diff(c.ref); diff != c.diff {
+			t.Errorf("diff %q, expected %q", diff, c.diff)
+		}
+	}
+}
+
+func TestFormatShadowRequest(t *testing.T) {
+	for _, c := range []struct {
+		req memwire.Request
+		cas string
+		out string
+	}{
+		{memwire.Request{Command: "set", Key: "a", Flags: "1", Exptime: 60, Data: []byte("hi"), Noreply: true}, "", "set a 1 60 2\r\nhi\r\n"},
+		{memwire.Request{Command: "cas", Key: "a", Flags: "0", Data: []byte("hi"), Cas: "999"}, "7", "cas a 0 0 2 7\r\nhi\r\n"},
+		{memwire.Request{Command: "gets", Keys: []string{"a", "b"}}, "", "gets a b\r\n"},
+		{memwire.Request{Command: "delete", Keys: []string{"a", "noreply"}}, "", "delete a\r\n"},
+		{memwire.Request{Command: "incr", Key: "a", Value: 5}, "", "incr a 5\r\n"},
+		{memwire.Request{Command: "touch", Key: "a", Exptime: 10}, "", "touch a 10\r\n"},
+		{memwire.Request{Command: "flush_all"}, "", "flush_all\r\n"},
+		{memwire.Request{Command: "flush_all", Exptime: 30}, "", "flush_all 30\r\n"},
+	} {
+		if out := string(formatShadowRequest(&c.req, c.cas)); out != c.out {
+			t.Errorf("format %q, expected %q", out, c.out)
+		}
+	}
+}
+
+func TestReadShadowResult(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("VALUE a 1 5 10\r\nhe\r\no\r\nVALUE b 0 0\r\n\r\nEND\r\nNOT_FOUND\r\n6\r\n"))
+	res, err := readShadowResult(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != memwire.CodeEnd || len(res.Values) != 2 || res.Values[0].Cas != "10" || res.Values[1].Size != 0 {
+		t.Errorf("bad result: %+v", res)
+	}
+	if res.Values[0] != newShadowValue("a", "1", []byte("he\r\no"), "10") {
+		t.Errorf("bad value: %+v", res.Values[0])
+	}
+	if res, err = readShadowResult(r); err != nil || res.Code != memwire.CodeNotFound || len(res.Values) != 0 {
+		t.Errorf("bad result: %+v, %v", res, err)
+	}
+	if res, err = readShadowResult(r); err != nil || res.Code != "6" {
+		t.Errorf("bad result: %+v, %v", res, err)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	fake := newFakeMemcached(t)
+	defer fake.Close()
+
+	s := NewShadow(fake.Addr(), 2, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	requests, mismatches, skipped := stats.ShadowRequests.Load(), stats.ShadowMismatches.Load(), stats.ShadowSkipped.Load()
+
+	s.Send(&ShadowRequest{
+		Request: memwire.Request{Command: "set", Key: "a", Flags: "3", Data: []byte("hello")},
+		Result:  ShadowResult{Code: memwire.CodeStored},
+	})
+	s.Send(&ShadowRequest{
+		Request: memwire.Request{Command: "gets", Keys: []string{"a"}},
+		Result:  ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{newShadowValue("a", "3", []byte("hello"), "555")}},
+	})
+	// value differs
+	s.Send(&ShadowRequest{
+		Request: memwire.Request{Command: "get", Keys: []string{"a"}},
+		Result:  ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{newShadowValue("a", "3", []byte("jello"), "")}},
+	})
+	// cas unique never fetched from reference
+	s.Send(&ShadowRequest{
+		Request: memwire.Request{Command: "cas", Key: "a", Flags: "0", Cas: "556", Data: []byte("x")},
+		Result:  ShadowResult{Code: memwire.CodeStored},
+	})
+
+	deadline := time.Now().Add(time.Second * 5)
+	for stats.ShadowRequests.Load()-requests < 3 || stats.ShadowSkipped.Load()-skipped < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests not replayed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := stats.ShadowMismatches.Load() - mismatches; n != 1 {
+		t.Errorf("bad mismatches: %d", n)
+	}
+	if cas, ok := s.translateCas("a", "555"); !ok || cas != "1" {
+		t.Errorf("bad cas translation: %s, %v", cas, ok)
+	}
+}
+
+func TestShadowMultiget(t *testing.T) {
+	fake := newFakeMemcached(t)
+	defer fake.Close()
+
+	s := NewShadow(fake.Addr(), 2, 0)
+	// keys of different workers
+	keys := []string{"a"}
+	for i := 0; len(keys) < 2; i++ {
+		if key := "k" + strconv.Itoa(i); s.workerOf(key) != s.workerOf("a") {
+			keys = append(keys, key)
+		}
+	}
+	fake.Set(keys[0], "x", 0, -1)
+	fake.Set(keys[1], "y", 0, -1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	requests, mismatches := stats.ShadowRequests.Load(), stats.ShadowMismatches.Load()
+	s.Send(&ShadowRequest{
+		Request: memwire.Request{Command: "get", Keys: keys},
+		Result: ShadowResult{Code: memwire.CodeEnd, Values: []ShadowValue{
+			newShadowValue(keys[0], "0", []byte("x"), ""),
+			newShadowValue(keys[1], "0", []byte("y"), ""),
+		}},
+	})
+
+	deadline := time.Now().Add(time.Second * 5)
+	for stats.ShadowRequests.Load()-requests < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests not replayed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := stats.ShadowMismatches.Load() - mismatches; n != 0 {
+		t.Errorf("bad mismatches: %d", n)
+	}
+}
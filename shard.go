@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ketamaPointsPerServer is the number of points of a server of average weight, the same as libmemcached and twemproxy
+	ketamaPointsPerServer = 160
+	// ketamaPointsPerHash is the number of points taken from a md5 digest
+	ketamaPointsPerHash = 4
+)
+
+var ErrNoShard = errors.New("no healthy shard")
+
+// Shard is a redis backend of a consistent hash ring
+type Shard struct {
+	// Name identifies the shard on the ring, keys stay if a shard is replaced with the same name
+	Name    string
+	Addr    string
+	Weight  int
+	Options *redis.Options
+	Client  *redis.Client
+	Lock    *redislock.Client
+
+	// healthy and failures are guarded by mutex of Shards
+	healthy  bool
+	failures int
+}
+
+// ParseShard parses a shard of "<redis url>[ weight=<weight>][ name=<name>]", name defaults to host:port
+func ParseShard(s string) (shard *Shard, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		err = errors.New("invalid shard: empty")
+		return
+	}
+	var opts *redis.Options
+	if opts, err = newRedisOptionsFromURL(fields[0]); err != nil {
+		return
+	}
+	shard = &Shard{Name: opts.Addr, Addr: opts.Addr, Weight: 1, Options: opts, healthy: true}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			err = errors.New("invalid shard: " + s)
+			return
+		}
+		switch kv[0] {
+		case "weight":
+			if shard.Weight, err = strconv.Atoi(kv[1]); err != nil || shard.Weight < 1 {
+				err = errors.New("invalid shard weight: " + s)
+				return
+			}
+		case "name":
+			shard.Name = kv[1]
+		default:
+			err = errors.New("invalid shard: " + s)
+			return
+		}
+	}
+	return
+}
+
+// ketamaHash returns the alignment-th 32 bits of md5 digest in little endian, as libketama
+func ketamaHash(digest [md5.Size]byte, alignment int) uint32 {
+	return uint32(digest[3+alignment*4])<<24 |
+		uint32(digest[2+alignment*4])<<16 |
+		uint32(digest[1+alignment*4])<<8 |
+		uint32(digest[alignment*4])
+}
+
+type ketamaPoint struct {
+	hash  uint32
+	shard *Shard
+}
+
+// Ring is a ketama consistent hash ring
+type Ring struct {
+	points []ketamaPoint
+}
+
+// NewRing creates a ring of shards, shards get points in proportion to their weights
+func NewRing(shards []*Shard) *Ring {
+	var total int
+	for _, shard := range shards {
+		total += shard.Weight
+	}
+	r := &Ring{}
+	for _, shard := range shards {
+		pct := float64(shard.Weight) / float64(total)
+		n := int(math.Floor(pct*ketamaPointsPerServer/ketamaPointsPerHash*float64(len(shards))+0.0000000001)) * ketamaPointsPerHash
+		for i := 0; i < n/ketamaPointsPerHash; i++ {
+			digest := md5.Sum([]byte(shard.Name + "-" + strconv.Itoa(i)))
+			for x := 0; x < ketamaPointsPerHash; x++ {
+				r.points = append(r.points, ketamaPoint{hash: ketamaHash(digest, x), shard: shard})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// Get returns shard of key, nil if ring is empty
+func (r *Ring) Get(key string) *Shard {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := ketamaHash(md5.Sum([]byte(key)), 0)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// Points returns number of points of each shard
+func (r *Ring) Points() map[*Shard]int {
+	m := map[*Shard]int{}
+	for _, p := range r.points {
+		m[p.shard]++
+	}
+	return m
+}
+
+// Shards distributes keys over redis backends with a ring of healthy shards
+type Shards struct {
+	// EjectFailures is the number of consecutive failed checks to eject a shard, never ejected if 0
+	EjectFailures int
+
+	all  []*Shard
+	ring atomic.Value // *Ring
+	mu   sync.Mutex
+}
+
+var shards *Shards
+
+// NewShards creates shards, all of them healthy
+func NewShards(all []*Shard, ejectFailures int) *Shards {
+	s := &Shards{all: all, EjectFailures: ejectFailures}
+	s.ring.Store(NewRing(all))
+	return s
+}
+
+// Get returns shard of key
+func (s *Shards) Get(key string) *Shard {
+	return s.ring.Load().(*Ring).Get(key)
+}
+
+// All returns all shards, including ejected ones
+func (s *Shards) All() []*Shard {
+	return s.all
+}
+
+// Clients returns clients of all shards
+func (s *Shards) Clients() []*redis.Client {
+	clients := make([]*redis.Client, 0, len(s.all))
+	for _, shard := range s.all {
+		clients = append(clients, shard.Client)
+	}
+	return clients
+}
+
+// Ping pings every shard, latency is the highest of reachable shards, it fails if any shard is unreachable,
+// or if all shards are unreachable when ejection is enabled
+func (s *Shards) Ping(ctx context.Context) (latency time.Duration, err error) {
+	errs := make([]error, len(s.all))
+	latencies := make([]time.Duration, len(s.all))
+	wg := &sync.WaitGroup{}
+	for i, shard := range s.all {
+		wg.Add(1)
+		go func(i int, shard *Shard) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = shard.Client.Ping(ctx).Err()
+			latencies[i] = time.Since(start)
+		}(i, shard)
+	}
+	wg.Wait()
+	var reachable int
+	for i, shard := range s.all {
+		if errs[i] != nil {
+			if s.EjectFailures == 0 {
+				err = errors.New("shard " + shard.Name + ": " + errs[i].Error())
+			}
+			continue
+		}
+		reachable++
+		if latencies[i] > latency {
+			latency = latencies[i]
+		}
+	}
+	if err == nil && reachable == 0 {
+		err = ErrNoShard
+	}
+	return
+}
+
+// Record records a health check of shard, shard is ejected after EjectFailures consecutive failures and re-added once succeeded
+func (s *Shards) Record(shard *Shard, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		shard.failures = 0
+		if !shard.healthy {
+			shard.healthy = true
+			logger.Info("shard re-added", "shard", shard.Name, "addr", shard.Addr)
+			s.rebuild()
+		}
+		return
+	}
+	shard.failures++
+	if shard.healthy && s.EjectFailures > 0 && shard.failures >= s.EjectFailures {
+		shard.healthy = false
+		logger.Warn("shard ejected", "shard", shard.Name, "addr", shard.Addr, "failures", shard.failures, "err", err)
+		s.rebuild()
+	}
+}
+
+// rebuild replaces ring with healthy shards, or all shards if none is healthy
+func (s *Shards) rebuild() {
+	var healthy []*Shard
+	for _, shard := range s.all {
+		if shard.healthy {
+			healthy = append(healthy, shard)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = s.all
+	}
+	s.ring.Store(NewRing(healthy))
+}
+
+// Run checks every shard each interval, until ctx is done
+func (s *Shards) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		wg := &sync.WaitGroup{}
+		for _, shard := range s.all {
+			wg.Add(1)
+			go func(shard *Shard) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(ctx, interval)
+				defer cancel()
+				s.Record(shard, shard.Client.Ping(ctx).Err())
+			}(shard)
+		}
+		wg.Wait()
+	}
+}
+
+// Report returns ring layout as stats lines of "shard:<name> addr=<addr> weight=<weight> points=<points> share=<percent> healthy=<0 or 1>"
+func (s *Shards) Report() []string {
+	points := s.ring.Load().(*Ring).Points()
+	var total int
+	for _, n := range points {
+		total += n
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines []string
+	for _, shard := range s.all {
+		var share float64
+		if total > 0 {
+			share = float64(points[shard]) * 100 / float64(total)
+		}
+		healthy := "0"
+		if shard.healthy {
+			healthy = "1"
+		}
+		lines = append(lines, "shard:"+shard.Name+
+			" addr="+shard.Addr+
+			" weight="+strconv.Itoa(shard.Weight)+
+			" points="+strconv.Itoa(points[shard])+
+			" share="+strconv.FormatFloat(share, 'f', 2, 64)+
+			" healthy="+healthy)
+	}
+	return lines
+}
+
+// Healthy returns whether each shard is in the ring
+func (s *Shards) Healthy() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := map[string]bool{}
+	for _, shard := range s.all {
+		m[shard.Name] = shard.healthy
+	}
+	return m
+}
+
+// Close closes clients of all shards
+func (s *Shards) Close() {
+	for _, shard := range s.all {
+		_ = shard.Client.Close()
+	}
+}
+
+// newShards creates shards of option redis.shards, nil if not sharded
+func newShards() (s *Shards, err error) {
+	if strings.TrimSpace(optRedisShards) == "" {
+		return
+	}
+	var all []*Shard
+	names := map[string]bool{}
+	for _, item := range strings.Split(optRedisShards, ",") {
+		var shard *Shard
+		if shard, err = ParseShard(item); err != nil {
+			return
+		}
+		if names[shard.Name] {
+			err = errors.New("duplicated shard: " + shard.Name)
+			return
+		}
+		names[shard.Name] = true
+		all = append(all, shard)
+	}
+	for _, shard := range all {
+		shard.Client = redis.NewClient(shard.Options)
+		shard.Client.AddHook(TimingHook{})
+		shard.Lock = redislock.New(shard.Client)
+	}
+	s = NewShards(all, optRedisShardEjectFailures)
+	return
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestShards(n int) []*Shard {
+	var all []*Shard
+	for i := 0; i < n; i++ {
+		name := "10.0.0." + strconv.Itoa(i+1) + ":6379"
+		all = append(all, &Shard{Name: name, Addr: name, Weight: 1, healthy: true})
+	}
+	return all
+}
+
+func TestParseShard(t *testing.T) {
+	shard, err := ParseShard("redis://10.0.0.1:6380/2 weight=3 name=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shard.Name != "a" || shard.Addr != "10.0.0.1:6380" || shard.Weight != 3 || shard.Options.DB != 2 || !shard.healthy {
+		t.Errorf("bad shard: %+v", shard)
+	}
+	if shard, err = ParseShard(" redis://10.0.0.1:6379 "); err != nil || shard.Name != "10.0.0.1:6379" || shard.Weight != 1 {
+		t.Errorf("bad shard: %+v, %v", shard, err)
+	}
+	for _, s := range []string{"", "redis://10.0.0.1 weight=0", "redis://10.0.0.1 weight", "redis://10.0.0.1 foo=bar"} {
+		if _, err = ParseShard(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
+
+func TestRing(t *testing.T) {
+	all := newTestShards(3)
+	all[2].Weight = 2
+	r := NewRing(all)
+	points := r.Points()
+	if points[all[0]] != 120 || points[all[1]] != 120 || points[all[2]] != 240 {
+		t.Errorf("bad points: %d, %d, %d", points[all[0]], points[all[1]], points[all[2]])
+	}
+	counts := map[*Shard]int{}
+	for i := 0; i < 10000; i++ {
+		counts[r.Get("key:"+strconv.Itoa(i))]++
+	}
+	if counts[all[2]] < 4000 || counts[all[2]] > 6000 {
+		t.Errorf("bad distribution: %v", counts)
+	}
+	if NewRing(nil).Get("a") != nil {
+		t.Error("empty ring should return nil")
+	}
+}
+
+func TestRingAddShard(t *testing.T) {
+	all := newTestShards(5)
+	before := NewRing(all[:4])
+	after := NewRing(all)
+	var moved int
+	for i := 0; i < 10000; i++ {
+		key := "key:" + strconv.Itoa(i)
+		if s := after.Get(key); s != before.Get(key) {
+			if s != all[4] {
+				t.Fatalf("key %s moved between existing shards", key)
+			}
+			moved++
+		}
+	}
+	// about 1/5 of keys move to the new shard
+	if moved < 1500 || moved > 2500 {
+		t.Errorf("bad moved keys: %d", moved)
+	}
+}
+
+func TestShardsRecord(t *testing.T) {
+	all := newTestShards(2)
+	s := NewShards(all, 2)
+	var key string
+	for i := 0; ; i++ {
+		if key = "key:" + strconv.Itoa(i); s.Get(key) == all[0] {
+			break
+		}
+	}
+	failure := errors.New("connection refused")
+	s.Record(all[0], failure)
+	if s.Get(key) != all[0] {
+		t.Error("should not be ejected after one failure")
+	}
+	s.Record(all[0], failure)
+	if s.Get(key) != all[1] || s.Healthy()[all[0].Name] {
+		t.Error("should be ejected after two failures")
+	}
+	if lines := s.Report(); len(lines) != 2 || !strings.HasPrefix(lines[0], "shard:10.0.0.1:6379 addr=10.0.0.1:6379 weight=1 points=0 share=0.00 healthy=0") {
+		t.Errorf("bad report: %v", lines)
+	}
+	// the ring falls back to all shards if none is healthy
+	s.Record(all[1], failure)
+	s.Record(all[1], failure)
+	if s.Get(key) != all[0] {
+		t.Error("should fall back to all shards")
+	}
+	s.Record(all[0], nil)
+	s.Record(all[1], nil)
+	if s.Get(key) != all[0] || !s.Healthy()[all[0].Name] {
+		t.Error("should be re-added")
+	}
+	if lines := s.Report(); !strings.HasSuffix(lines[1], "points=160 share=50.00 healthy=1") {
+		t.Errorf("bad report: %v", lines)
+	}
+}
+
+func TestShardsPing(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a closed listener is an unreachable redis
+	down := l.Addr().String()
+	_ = l.Close()
+
+	all := newTestShards(2)
+	all[0].Client = fake.Client()
+	all[1].Client = redis.NewClient(&redis.Options{Addr: down, MaxRetries: -1})
+	defer all[0].Client.Close()
+	defer all[1].Client.Close()
+	ctx := context.Background()
+
+	// shards are pinged whether checked by Run or not
+	s := NewShards(all, 0)
+	if _, err = s.Ping(ctx); err == nil || !strings.Contains(err.Error(), all[1].Name) {
+		t.Errorf("should fail with a shard unreachable: %v", err)
+	}
+	s = NewShards(all, 2)
+	if latency, err := s.Ping(ctx); err != nil || latency <= 0 {
+		t.Errorf("should succeed with a shard reachable: %v, %v", latency, err)
+	}
+	s = NewShards(all[1:], 2)
+	if _, err = s.Ping(ctx); err != ErrNoShard {
+		t.Errorf("should fail with no shard reachable: %v", err)
+	}
+}
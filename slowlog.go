@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowEntry is a command slower than the slowlog threshold
+type SlowEntry struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Conn      int64     `json:"conn"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"`
+	Command   string    `json:"command"`
+	Keys      []string  `json:"keys,omitempty"`
+	ValueSize int       `json:"value_size"`
+	LockWait  float64   `json:"lock_wait_ms"`
+	Redis     float64   `json:"redis_ms"`
+	Latency   float64   `json:"latency_ms"`
+	Result    string    `json:"result"`
+}
+
+// String formats entry as a stats line of "id fields..."
+func (e SlowEntry) String() string {
+	ms := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+	return strings.Join([]string{
+		strconv.FormatInt(e.ID, 10),
+		"time=" + e.Time.UTC().Format(time.RFC3339Nano),
+		"conn=" + strconv.FormatInt(e.Conn, 10),
+		"remote=" + e.Remote,
+		"user=" + e.User,
+		"command=" + e.Command,
+		"keys=" + strings.Join(e.Keys, ","),
+		"value_size=" + strconv.Itoa(e.ValueSize),
+		"lock_wait_ms=" + ms(e.LockWait),
+		"redis_ms=" + ms(e.Redis),
+		"latency_ms=" + ms(e.Latency),
+		"result=" + e.Result,
+	}, " ")
+}
+
+// SlowLog keeps the latest commands slower than threshold in memory
+type SlowLog struct {
+	threshold int64
+
+	mu      sync.Mutex
+	maxLen  int
+	nextID  int64
+	entries []SlowEntry
+}
+
+var slowlog = &SlowLog{}
+
+// Configure changes threshold and max length, disabled if threshold is 0, existing entries beyond max length are dropped
+func (l *SlowLog) Configure(threshold time.Duration, maxLen int) {
+	atomic.StoreInt64(&l.threshold, int64(threshold))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxLen = maxLen
+	if len(l.entries) > maxLen {
+		l.entries = append([]SlowEntry{}, l.entries[len(l.entries)-maxLen:]...)
+	}
+}
+
+// Threshold returns the threshold, 0 if disabled
+func (l *SlowLog) Threshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.threshold))
+}
+
+// IsSlow returns whether a command of latency should be logged
+func (l *SlowLog) IsSlow(latency time.Duration) bool {
+	threshold := l.Threshold()
+	return threshold > 0 && latency >= threshold
+}
+
+// Add adds an entry, ID is assigned
+func (l *SlowLog) Add(e SlowEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxLen <= 0 {
+		return
+	}
+	l.nextID++
+	e.ID = l.nextID
+	if len(l.entries) >= l.maxLen {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:len(l.entries)-1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+// Entries returns entries, newest first
+func (l *SlowLog) Entries() []SlowEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]SlowEntry, 0, len(l.entries))
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entries = append(entries, l.entries[i])
+	}
+	return entries
+}
+
+// Report returns entries as stats lines, newest first
+func (l *SlowLog) Report() []string {
+	entries := l.Entries()
+	lines := make([]string, 0, len(entries))
+	for _, e := range entries {
+		lines = append(lines, e.String())
+	}
+	return lines
+}
+
+// Reset removes all entries
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = nil
+}
+
+// commandTimings accumulates time spent by a command waiting for lock and redis
+type commandTimings struct {
+	lockWait int64
+	redis    int64
+}
+
+type commandTimingsContextKey struct{}
+
+func withCommandTimings(ctx context.Context) (context.Context, *commandTimings) {
+	t := &commandTimings{}
+	return context.WithValue(ctx, commandTimingsContextKey{}, t), t
+}
+
+// withoutCommandTimings stops accumulating redis time, for calls counted elsewhere
+func withoutCommandTimings(ctx context.Context) context.Context {
+	if commandTimingsFromContext(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, commandTimingsContextKey{}, (*commandTimings)(nil))
+}
+
+func commandTimingsFromContext(ctx context.Context) *commandTimings {
+	t, _ := ctx.Value(commandTimingsContextKey{}).(*commandTimings)
+	return t
+}
+
+// AddLockWait adds time spent obtaining lock, t is nil-safe
+func (t *commandTimings) AddLockWait(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.lockWait, int64(d))
+	}
+}
+
+// AddRedis adds time spent in redis calls, t is nil-safe
+func (t *commandTimings) AddRedis(d time.Duration) {
+	if t != nil {
+		atomic.AddInt64(&t.redis, int64(d))
+	}
+}
+
+// LockWait returns total time spent obtaining lock
+func (t *commandTimings) LockWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.lockWait))
+}
+
+// Redis returns total time spent in redis calls
+func (t *commandTimings) Redis() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.redis))
+}
+
+// TimingHook accumulates duration of redis calls into command timings of context
+type TimingHook struct{}
+
+var _ redis.Hook = TimingHook{}
+
+type redisStartContextKey struct{}
+
+func (TimingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if commandTimingsFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, redisStartContextKey{}, time.Now()), nil
+}
+
+func (TimingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(redisStartContextKey{}).(time.Time); ok {
+		commandTimingsFromContext(ctx).AddRedis(time.Since(start))
+	}
+	return nil
+}
+
+func (h TimingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.BeforeProcess(ctx, nil)
+}
+
+func (h TimingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return h.AfterProcess(ctx, nil)
+}
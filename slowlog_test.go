@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := &SlowLog{}
+	if l.IsSlow(time.Hour) {
+		t.Error("should be disabled by default")
+	}
+	l.Configure(time.Millisecond*10, 2)
+	if l.IsSlow(time.Millisecond) || !l.IsSlow(time.Millisecond*10) {
+		t.Error("bad threshold")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		l.Add(SlowEntry{Command: "set", Keys: []string{key}, Result: "STORED"})
+	}
+	entries := l.Entries()
+	if len(entries) != 2 || entries[0].ID != 3 || entries[0].Keys[0] != "c" || entries[1].Keys[0] != "b" {
+		t.Errorf("bad entries: %+v", entries)
+	}
+	lines := l.Report()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "3 ") || !strings.Contains(lines[0], " keys=c ") || !strings.HasSuffix(lines[0], " result=STORED") {
+		t.Errorf("bad report: %v", lines)
+	}
+
+	l.Configure(time.Millisecond*10, 1)
+	if entries = l.Entries(); len(entries) != 1 || entries[0].ID != 3 {
+		t.Errorf("bad entries after shrink: %+v", entries)
+	}
+	l.Reset()
+	if entries = l.Entries(); len(entries) != 0 {
+		t.Errorf("bad entries after reset: %+v", entries)
+	}
+	l.Add(SlowEntry{})
+	if entries = l.Entries(); len(entries) != 1 || entries[0].ID != 4 {
+		t.Errorf("id should not be reused: %+v", entries)
+	}
+}
+
+func TestCommandTimings(t *testing.T) {
+	ctx, timings := withCommandTimings(context.Background())
+	commandTimingsFromContext(ctx).AddRedis(time.Millisecond)
+	commandTimingsFromContext(ctx).AddLockWait(time.Millisecond * 2)
+	commandTimingsFromContext(withoutCommandTimings(ctx)).AddRedis(time.Second)
+	commandTimingsFromContext(context.Background()).AddRedis(time.Second)
+	if timings.Redis() != time.Millisecond || timings.LockWait() != time.Millisecond*2 {
+		t.Errorf("bad timings: %v %v", timings.Redis(), timings.LockWait())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Counter is an atomic counter
+type Counter int64
+
+// Add adds n to counter
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64((*int64)(c), n)
+}
+
+// Load returns current value of counter
+func (c *Counter) Load() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// Stats is server-wide statistics
+type Stats struct {
+	CompressedItems    Counter
+	CompressedBytesIn  Counter
+	CompressedBytesOut Counter
+	L1Hits             Counter
+	L1Misses           Counter
+	L1Evictions        Counter
+	L1Invalidations    Counter
+	L1Purges           Counter
+	TraceSpansExported Counter
+	TraceSpansDropped  Counter
+
+	ConnectionsRejected Counter
+	ConnectionsTimedOut Counter
+
+	RateLimitRejected Counter
+	RateLimitDelayed  Counter
+
+	ACLDeniedConnections Counter
+	ACLDeniedCommands    Counter
+	AuthFailures         Counter
+
+	AuditRecords Counter
+	AuditDropped Counter
+
+	WatchLinesDropped Counter
+
+	ShadowRequests   Counter
+	ShadowMismatches Counter
+	ShadowErrors     Counter
+	ShadowDropped    Counter
+	ShadowSkipped    Counter
+
+	MirrorQueued       Counter
+	MirrorApplied      Counter
+	MirrorRetries      Counter
+	MirrorFailed       Counter
+	MirrorDropped      Counter
+	MirrorFallbackHits Counter
+}
+
+var stats = &Stats{}
+
+// Report returns statistics as lines of "name value"
+func (s *Stats) Report() []string {
+	in, out := s.CompressedBytesIn.Load(), s.CompressedBytesOut.Load()
+	ratio := 1.0
+	if out > 0 {
+		ratio = float64(in) / float64(out)
+	}
+	return []string{
+		"compressed_items " + strconv.FormatInt(s.CompressedItems.Load(), 10),
+		"compressed_bytes_in " + strconv.FormatInt(in, 10),
+		"compressed_bytes_out " + strconv.FormatInt(out, 10),
+		"compression_ratio " + strconv.FormatFloat(ratio, 'f', 2, 64),
+		"l1_hits " + strconv.FormatInt(s.L1Hits.Load(), 10),
+		"l1_misses " + strconv.FormatInt(s.L1Misses.Load(), 10),
+		"l1_evictions " + strconv.FormatInt(s.L1Evictions.Load(), 10),
+		"l1_invalidations " + strconv.FormatInt(s.L1Invalidations.Load(), 10),
+		"l1_purges " + strconv.FormatInt(s.L1Purges.Load(), 10),
+		"trace_spans_exported " + strconv.FormatInt(s.TraceSpansExported.Load(), 10),
+		"trace_spans_dropped " + strconv.FormatInt(s.TraceSpansDropped.Load(), 10),
+		"connections_rejected " + strconv.FormatInt(s.ConnectionsRejected.Load(), 10),
+		"connections_timed_out " + strconv.FormatInt(s.ConnectionsTimedOut.Load(), 10),
+		"rate_limit_rejected " + strconv.FormatInt(s.RateLimitRejected.Load(), 10),
+		"rate_limit_delayed " + strconv.FormatInt(s.RateLimitDelayed.Load(), 10),
+		"acl_denied_connections " + strconv.FormatInt(s.ACLDeniedConnections.Load(), 10),
+		"acl_denied_commands " + strconv.FormatInt(s.ACLDeniedCommands.Load(), 10),
+		"auth_failures " + strconv.FormatInt(s.AuthFailures.Load(), 10),
+		"audit_records " + strconv.FormatInt(s.AuditRecords.Load(), 10),
+		"audit_dropped " + strconv.FormatInt(s.AuditDropped.Load(), 10),
+		"watch_lines_dropped " + strconv.FormatInt(s.WatchLinesDropped.Load(), 10),
+		"shadow_requests " + strconv.FormatInt(s.ShadowRequests.Load(), 10),
+		"shadow_mismatches " + strconv.FormatInt(s.ShadowMismatches.Load(), 10),
+		"shadow_errors " + strconv.FormatInt(s.ShadowErrors.Load(), 10),
+		"shadow_dropped " + strconv.FormatInt(s.ShadowDropped.Load(), 10),
+		"shadow_skipped " + strconv.FormatInt(s.ShadowSkipped.Load(), 10),
+		"mirror_queued " + strconv.FormatInt(s.MirrorQueued.Load(), 10),
+		"mirror_applied " + strconv.FormatInt(s.MirrorApplied.Load(), 10),
+		"mirror_retries " + strconv.FormatInt(s.MirrorRetries.Load(), 10),
+		"mirror_failed " + strconv.FormatInt(s.MirrorFailed.Load(), 10),
+		"mirror_dropped " + strconv.FormatInt(s.MirrorDropped.Load(), 10),
+		"mirror_fallback_hits " + strconv.FormatInt(s.MirrorFallbackHits.Load(), 10),
+	}
+}
@@ -0,0 +1,732 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout is the way an item is persisted in redis
+type Layout string
+
+const (
+	// LayoutHash stores an item as a redis hash with value, flags and token fields
+	LayoutHash Layout = "hash"
+	// LayoutCompact stores an item as a single redis string, a binary header followed by the value
+	LayoutCompact Layout = "compact"
+)
+
+const (
+	compactVersion1 = 1
+	compactVersion2 = 2
+	compactVersion3 = 3
+
+	compactHeaderSize1 = 1 + 4 + 8
+	compactHeaderSize2 = 1 + 1 + 4 + 8
+	// compactHeaderSize3 excludes the variable length key id
+	compactHeaderSize3 = 1 + 1 + 1 + 4 + 8
+)
+
+var compactEncodings = []string{EncodingNone, EncodingSnappy, EncodingChunked}
+
+var (
+	ErrInvalidLayout  = errors.New("invalid layout")
+	ErrInvalidFlags   = errors.New("invalid flags")
+	ErrCorruptedValue = errors.New("corrupted value")
+)
+
+// ParseLayout parses a layout name
+func ParseLayout(s string) (Layout, error) {
+	switch Layout(s) {
+	case LayoutHash, LayoutCompact:
+		return Layout(s), nil
+	}
+	return "", ErrInvalidLayout
+}
+
+// Namespace is a key prefix with a dedicated layout
+type Namespace struct {
+	Prefix string
+	Layout Layout
+}
+
+// Namespaces selects layout for keys, longest prefix wins
+type Namespaces struct {
+	Default Layout
+	Items   []Namespace
+}
+
+// ParseNamespaces parses namespaces in format "prefix1=layout1,prefix2=layout2"
+func ParseNamespaces(def string, s string) (ns Namespaces, err error) {
+	if def == "" {
+		ns.Default = LayoutHash
+	} else if ns.Default, err = ParseLayout(def); err != nil {
+		return
+	}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			err = errors.New("invalid namespace: " + item)
+			return
+		}
+		n := Namespace{Prefix: item[:i]}
+		if n.Layout, err = ParseLayout(strings.TrimSpace(item[i+1:])); err != nil {
+			return
+		}
+		ns.Items = append(ns.Items, n)
+	}
+	return
+}
+
+// Layout returns layout for key
+func (ns Namespaces) Layout(key string) Layout {
+	layout, matched := ns.Default, -1
+	for _, n := range ns.Items {
+		if len(n.Prefix) > matched && strings.HasPrefix(key, n.Prefix) {
+			layout, matched = n.Layout, len(n.Prefix)
+		}
+	}
+	return layout
+}
+
+// Item is a memcached item
+type Item struct {
+	Value    []byte
+	Flags    string
+	Token    string
+	Encoding string
+	// KeyID is the id of encryption key, empty for plaintext values
+	KeyID string
+	// Manifest is set when Value is left in chunks
+	Manifest *Manifest
+}
+
+// NewToken creates a new cas token
+func NewToken() string {
+	return strconv.FormatInt(rand.Int63(), 10)
+}
+
+// EncodeCompact encodes item with compact layout
+func EncodeCompact(item *Item) ([]byte, error) {
+	var (
+		err   error
+		flags uint64
+		token uint64
+	)
+	if item.Flags != "" {
+		if flags, err = strconv.ParseUint(item.Flags, 10, 32); err != nil {
+			return nil, ErrInvalidFlags
+		}
+	}
+	if item.Token != "" {
+		if token, err = strconv.ParseUint(item.Token, 10, 64); err != nil {
+			return nil, ErrCorruptedValue
+		}
+	}
+	encoding := -1
+	for i, e := range compactEncodings {
+		if e == item.Encoding {
+			encoding = i
+		}
+	}
+	if encoding < 0 || len(item.KeyID) > 255 {
+		return nil, ErrCorruptedValue
+	}
+	buf := make([]byte, compactHeaderSize3+len(item.KeyID)+len(item.Value))
+	buf[0] = compactVersion3
+	buf[1] = byte(encoding)
+	buf[2] = byte(len(item.KeyID))
+	n := 3 + copy(buf[3:], item.KeyID)
+	binary.BigEndian.PutUint32(buf[n:], uint32(flags))
+	binary.BigEndian.PutUint64(buf[n+4:], token)
+	copy(buf[n+12:], item.Value)
+	return buf, nil
+}
+
+// DecodeCompact decodes item with compact layout
+func DecodeCompact(buf []byte) (*Item, error) {
+	item := &Item{}
+	switch {
+	case len(buf) >= compactHeaderSize1 && buf[0] == compactVersion1:
+		item.Flags = strconv.FormatUint(uint64(binary.BigEndian.Uint32(buf[1:])), 10)
+		item.Token = strconv.FormatUint(binary.BigEndian.Uint64(buf[5:]), 10)
+		item.Value = buf[compactHeaderSize1:]
+	case len(buf) >= compactHeaderSize2 && buf[0] == compactVersion2:
+		if int(buf[1]) >= len(compactEncodings) {
+			return nil, ErrCorruptedValue
+		}
+		item.Encoding = compactEncodings[buf[1]]
+		item.Flags = strconv.FormatUint(uint64(binary.BigEndian.Uint32(buf[2:])), 10)
+		item.Token = strconv.FormatUint(binary.BigEndian.Uint64(buf[6:]), 10)
+		item.Value = buf[compactHeaderSize2:]
+	case len(buf) >= compactHeaderSize3 && buf[0] == compactVersion3:
+		if int(buf[1]) >= len(compactEncodings) || len(buf) < compactHeaderSize3+int(buf[2]) {
+			return nil, ErrCorruptedValue
+		}
+		item.Encoding = compactEncodings[buf[1]]
+		n := 3 + int(buf[2])
+		item.KeyID = string(buf[3:n])
+		item.Flags = strconv.FormatUint(uint64(binary.BigEndian.Uint32(buf[n:])), 10)
+		item.Token = strconv.FormatUint(binary.BigEndian.Uint64(buf[n+4:]), 10)
+		item.Value = buf[n+12:]
+	default:
+		return nil, ErrCorruptedValue
+	}
+	return item, nil
+}
+
+// isInternalKey returns whether key is a lock or a chunk, instead of an item
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, "__LOCK.") || strings.HasPrefix(key, "__CHUNK.")
+}
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+// Store reads and writes items in redis, accepting both layouts on read
+type Store struct {
+	Redis     *redis.Client
+	RedisLock *redislock.Client
+	// Shards distributes keys over redis backends instead of Redis, nil if not sharded
+	Shards     *Shards
+	Namespaces Namespaces
+	// CompressThreshold is the value size above which values are compressed, zero disables compression
+	CompressThreshold int
+	// Keyring encrypts values with its current key, nil disables encryption
+	Keyring *Keyring
+	// ChunkSize is the value size above which values are split into chunks of this size, zero disables chunking
+	ChunkSize int
+	// Cache is the shared in-memory cache, nil disables caching
+	Cache *Cache
+	// Mirror replays writes to a secondary store, nil disables mirroring
+	Mirror *Mirror
+	// Fallback serves get commands of keys missing in the store, nil disables fallback
+	Fallback *Store
+}
+
+// client returns redis client of key
+func (s *Store) client(key string) *redis.Client {
+	if s.Shards != nil {
+		return s.Shards.Get(key).Client
+	}
+	return s.Redis
+}
+
+// locker returns lock client of key, locks live with their keys
+func (s *Store) locker(key string) *redislock.Client {
+	if s.Shards != nil {
+		return s.Shards.Get(key).Lock
+	}
+	return s.RedisLock
+}
+
+// Clients returns redis clients of all backends
+func (s *Store) Clients() []*redis.Client {
+	if s.Shards != nil {
+		return s.Shards.Clients()
+	}
+	return []*redis.Client{s.Redis}
+}
+
+// Ping checks redis is reachable, or shards are reachable if sharded
+func (s *Store) Ping(ctx context.Context) error {
+	if s.Shards != nil {
+		_, err := s.Shards.Ping(ctx)
+		return err
+	}
+	return s.Redis.Ping(ctx).Err()
+}
+
+// ShardOf returns shard name of key, empty if not sharded
+func (s *Store) ShardOf(key string) string {
+	if s.Shards != nil {
+		return s.Shards.Get(key).Name
+	}
+	return ""
+}
+
+// Scan invokes fn with every key matching pattern in all backends, internal keys are skipped
+func (s *Store) Scan(ctx context.Context, match string, fn func(key string) error) (err error) {
+	for _, client := range s.Clients() {
+		var (
+			cursor uint64
+			keys   []string
+		)
+		for {
+			if keys, cursor, err = client.Scan(ctx, cursor, match, 100).Result(); err != nil {
+				return
+			}
+			for _, key := range keys {
+				if isInternalKey(key) {
+					continue
+				}
+				if err = fn(key); err != nil {
+					return
+				}
+			}
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// WithLock executes fn with a distributed lock on key
+func (s *Store) WithLock(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	lockCtx, span := StartSpan(ctx, "lock", SpanKindInternal)
+	// redis calls of lock are counted as lock wait
+	obtain, err := s.locker(key).Obtain(withoutCommandTimings(lockCtx), "__LOCK."+key, time.Second, &redislock.Options{
+		RetryStrategy: redislock.LinearBackoff(time.Millisecond * 100),
+	})
+	span.Finish(err)
+	wait := time.Since(start)
+	metrics.LockDuration.Observe(wait.Seconds())
+	commandTimingsFromContext(ctx).AddLockWait(wait)
+	if err != nil {
+		return err
+	}
+	defer obtain.Release(ctx)
+	return fn(ctx)
+}
+
+func (s *Store) getHash(ctx context.Context, key string) (*Item, error) {
+	val, err := s.client(key).HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, ErrNotFound
+	}
+	return &Item{
+		Value:    []byte(val[KeyValue]),
+		Flags:    val[KeyFlags],
+		Token:    val[KeyToken],
+		Encoding: val[KeyEncoding],
+		KeyID:    val[KeyKeyID],
+	}, nil
+}
+
+func (s *Store) getCompact(ctx context.Context, key string) (*Item, error) {
+	buf, err := s.client(key).Get(ctx, key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCompact(buf)
+}
+
+// Load returns item of key as stored, without decryption or decompression
+func (s *Store) Load(ctx context.Context, key string) (item *Item, err error) {
+	if s.Namespaces.Layout(key) == LayoutCompact {
+		if item, err = s.getCompact(ctx, key); isWrongType(err) {
+			item, err = s.getHash(ctx, key)
+		}
+	} else {
+		if item, err = s.getHash(ctx, key); isWrongType(err) {
+			item, err = s.getCompact(ctx, key)
+		}
+	}
+	return
+}
+
+// compactPeekSize is the size of the longest compact header, with a key id of 255 bytes
+const compactPeekSize = compactHeaderSize3 + 255
+
+// Peek returns item of key as stored without its value and size of the value as stored, or ErrNotFound,
+// value of chunked item is its manifest
+func (s *Store) Peek(ctx context.Context, key string) (item *Item, size int, err error) {
+	if s.Namespaces.Layout(key) == LayoutCompact {
+		if item, size, err = s.peekCompact(ctx, key); isWrongType(err) {
+			item, size, err = s.peekHash(ctx, key)
+		}
+	} else {
+		if item, size, err = s.peekHash(ctx, key); isWrongType(err) {
+			item, size, err = s.peekCompact(ctx, key)
+		}
+	}
+	return
+}
+
+func (s *Store) peekHash(ctx context.Context, key string) (item *Item, size int, err error) {
+	client := s.client(key)
+	var (
+		fields *redis.SliceCmd
+		length *redis.Cmd
+	)
+	if _, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HMGet(ctx, key, KeyFlags, KeyToken, KeyEncoding, KeyKeyID)
+		// go-redis has no hstrlen
+		length = pipe.Do(ctx, "hstrlen", key, KeyValue)
+		return nil
+	}); err != nil {
+		return
+	}
+	vals := make([]string, 4)
+	var found bool
+	for i, v := range fields.Val() {
+		if str, ok := v.(string); ok {
+			vals[i], found = str, true
+		}
+	}
+	if !found {
+		err = ErrNotFound
+		return
+	}
+	item = &Item{Flags: vals[0], Token: vals[1], Encoding: vals[2], KeyID: vals[3]}
+	n, _ := length.Int64()
+	size = int(n)
+	if item.Encoding == EncodingChunked {
+		if item.Value, err = client.HGet(ctx, key, KeyValue).Bytes(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *Store) peekCompact(ctx context.Context, key string) (item *Item, size int, err error) {
+	client := s.client(key)
+	var (
+		header *redis.StringCmd
+		length *redis.IntCmd
+	)
+	if _, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		header = pipe.GetRange(ctx, key, 0, compactPeekSize-1)
+		length = pipe.StrLen(ctx, key)
+		return nil
+	}); err != nil {
+		return
+	}
+	// a compact item is never empty
+	if length.Val() == 0 {
+		err = ErrNotFound
+		return
+	}
+	buf, _ := header.Bytes()
+	if item, err = DecodeCompact(buf); err != nil {
+		return
+	}
+	size = int(length.Val()) - (len(buf) - len(item.Value))
+	if item.Encoding == EncodingChunked {
+		if len(buf) < int(length.Val()) {
+			return s.peekCompactFull(ctx, key)
+		}
+		return
+	}
+	item.Value = nil
+	return
+}
+
+// peekCompactFull is peekCompact of a manifest longer than the header read
+func (s *Store) peekCompactFull(ctx context.Context, key string) (item *Item, size int, err error) {
+	if item, err = s.getCompact(ctx, key); err != nil {
+		return
+	}
+	size = len(item.Value)
+	return
+}
+
+// Open returns item of key, or ErrNotFound, value of chunked item is left in chunks to be read with ReadChunks
+func (s *Store) Open(ctx context.Context, key string) (item *Item, err error) {
+	_, item, err = s.LoadOpen(ctx, key)
+	return
+}
+
+// LoadOpen returns item of key both as stored and opened from a single read, or ErrNotFound
+func (s *Store) LoadOpen(ctx context.Context, key string) (raw *Item, item *Item, err error) {
+	if raw, err = s.Load(ctx, key); err != nil {
+		return
+	}
+	item, err = s.open(key, raw)
+	return
+}
+
+// open decrypts and decompresses item of key as stored, or parses its manifest if chunked
+func (s *Store) open(key string, item *Item) (*Item, error) {
+	if item.Encoding == EncodingChunked {
+		m, err := ParseManifest(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		out := *item
+		out.Value = nil
+		out.Manifest = m
+		return &out, nil
+	}
+	if item.KeyID != "" {
+		var err error
+		if item, err = s.Keyring.Decrypt(key, item); err != nil {
+			return nil, err
+		}
+	}
+	return Decompress(item)
+}
+
+// OpenCached is Open served from the in-memory cache if possible, or read from Fallback if missing, the returned item must not be modified
+func (s *Store) OpenCached(ctx context.Context, key string) (item *Item, err error) {
+	// a key deleted with the deletion not replayed is never read from fallback
+	if item, err = s.openCached(ctx, key); err == ErrNotFound && s.Fallback != nil && (s.Mirror == nil || s.Mirror.Synced(key)) {
+		// chunks are read from fallback here, they can't be read from the store later
+		if item, err = s.Fallback.Get(ctx, key); err == nil {
+			stats.MirrorFallbackHits.Add(1)
+		}
+	}
+	return
+}
+
+func (s *Store) openCached(ctx context.Context, key string) (item *Item, err error) {
+	if s.Cache == nil || !s.Cache.Cacheable(key) {
+		return s.Open(ctx, key)
+	}
+	shard := s.ShardOf(key)
+	if item = s.Cache.Get(shard, key); item != nil {
+		return
+	}
+	gen := s.Cache.Generation()
+	if item, err = s.Open(ctx, key); err != nil {
+		return
+	}
+	if item.Manifest == nil {
+		s.Cache.Put(shard, key, item, gen)
+	}
+	return
+}
+
+// OpenCachedMulti is OpenCached of keys, items are in order of keys and nil if not found, shards are read concurrently
+func (s *Store) OpenCachedMulti(ctx context.Context, keys []string) (items []*Item, err error) {
+	items = make([]*Item, len(keys))
+	// indexes of keys grouped by shard
+	groups := map[string][]int{}
+	for i, key := range keys {
+		shard := s.ShardOf(key)
+		groups[shard] = append(groups[shard], i)
+	}
+	open := func(indexes []int) error {
+		for _, i := range indexes {
+			item, err := s.OpenCached(ctx, keys[i])
+			if err != nil {
+				if err == ErrNotFound {
+					continue
+				}
+				return err
+			}
+			items[i] = item
+		}
+		return nil
+	}
+	if len(groups) < 2 {
+		for _, indexes := range groups {
+			err = open(indexes)
+		}
+		return
+	}
+	var (
+		wg = &sync.WaitGroup{}
+		mu = &sync.Mutex{}
+	)
+	for _, indexes := range groups {
+		wg.Add(1)
+		go func(indexes []int) {
+			defer wg.Done()
+			if err1 := open(indexes); err1 != nil {
+				mu.Lock()
+				err = err1
+				mu.Unlock()
+			}
+		}(indexes)
+	}
+	wg.Wait()
+	return
+}
+
+// Get returns item of key, or ErrNotFound
+func (s *Store) Get(ctx context.Context, key string) (item *Item, err error) {
+	if item, err = s.Open(ctx, key); err != nil {
+		return
+	}
+	if item.Manifest == nil {
+		return
+	}
+	buf := make([]byte, 0, item.Manifest.Size)
+	if err = s.ReadChunks(ctx, key, item, func(chunk []byte) error {
+		buf = append(buf, chunk...)
+		return nil
+	}); err != nil {
+		return
+	}
+	out := *item
+	out.Value = buf
+	out.Encoding = EncodingNone
+	out.KeyID = ""
+	out.Manifest = nil
+	item = &out
+	return
+}
+
+// loadManifest returns manifest of key if it's a chunked item, chunking must be enabled
+func (s *Store) loadManifest(ctx context.Context, key string) *Manifest {
+	if s.ChunkSize <= 0 {
+		return nil
+	}
+	item, err := s.Load(ctx, key)
+	if err != nil || item.Encoding != EncodingChunked {
+		return nil
+	}
+	m, _ := ParseManifest(item.Value)
+	return m
+}
+
+func (s *Store) write(ctx context.Context, pipe redis.Pipeliner, key string, item *Item, ttl time.Duration) error {
+	if s.Namespaces.Layout(key) == LayoutCompact {
+		buf, err := EncodeCompact(item)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, key, buf, ttl)
+		return nil
+	}
+	pipe.Del(ctx, key)
+	pipe.HSet(
+		ctx,
+		key,
+		KeyValue, item.Value,
+		KeyFlags, item.Flags,
+		KeyToken, item.Token,
+	)
+	if item.Encoding != EncodingNone {
+		pipe.HSet(ctx, key, KeyEncoding, item.Encoding)
+	}
+	if item.KeyID != "" {
+		pipe.HSet(ctx, key, KeyKeyID, item.KeyID)
+	}
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	return nil
+}
+
+// Set replaces item of key with the layout of its namespace, zero ttl means no expiration
+func (s *Store) Set(ctx context.Context, key string, item *Item, ttl time.Duration) (err error) {
+	defer s.invalidate(key)
+	defer s.mirror(key)
+	if ttl < 0 {
+		// negative value is redis.KeepTTL
+		ttl = 0
+	}
+	stale := s.loadManifest(ctx, key)
+	if s.ChunkSize > 0 && len(item.Value) > s.ChunkSize {
+		return s.setChunked(ctx, key, item, ttl, stale)
+	}
+	item = Compress(item, s.CompressThreshold)
+	if s.Keyring != nil {
+		if item, err = s.Keyring.Encrypt(key, item); err != nil {
+			return
+		}
+	}
+	_, err = s.client(key).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if err := s.write(ctx, pipe, key, item, ttl); err != nil {
+			return err
+		}
+		if stale != nil {
+			expireChunks(ctx, pipe, key, stale, chunkGrace)
+		}
+		return nil
+	})
+	return
+}
+
+// Update replaces item of key and keeps the existing expiration, or ErrNotFound if key is gone
+func (s *Store) Update(ctx context.Context, key string, item *Item) error {
+	ttl, err := s.client(key).PTTL(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	switch ttl {
+	case -2:
+		// expired or deleted since read, never resurrect it
+		return ErrNotFound
+	case -1:
+		ttl = 0
+	}
+	return s.Set(ctx, key, item, ttl)
+}
+
+// Delete deletes item of key, returns whether the item existed
+func (s *Store) Delete(ctx context.Context, key string) (ok bool, err error) {
+	defer s.invalidate(key)
+	defer s.mirror(key)
+	stale := s.loadManifest(ctx, key)
+	var del *redis.IntCmd
+	if _, err = s.client(key).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, key)
+		if stale != nil {
+			expireChunks(ctx, pipe, key, stale, chunkGrace)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	ok = del.Val() > 0
+	return
+}
+
+// Touch updates expiration of item of key, or ErrNotFound
+func (s *Store) Touch(ctx context.Context, key string, ttl time.Duration) (err error) {
+	defer s.invalidate(key)
+	defer s.mirror(key)
+	m := s.loadManifest(ctx, key)
+	var expire *redis.BoolCmd
+	if _, err = s.client(key).TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		expire = pipe.Expire(ctx, key, ttl)
+		if m != nil {
+			expireChunks(ctx, pipe, key, m, ttl+chunkGrace)
+		}
+		return nil
+	}); err != nil {
+		return
+	}
+	if !expire.Val() {
+		err = ErrNotFound
+	}
+	return
+}
+
+// Flush deletes all items
+func (s *Store) Flush(ctx context.Context) error {
+	if s.Cache != nil {
+		defer s.Cache.Purge()
+	}
+	for _, client := range s.Clients() {
+		if err := client.FlushDB(ctx).Err(); err != nil {
+			return err
+		}
+	}
+	if s.Mirror != nil {
+		s.Mirror.SendFlush()
+	}
+	return nil
+}
+
+func (s *Store) invalidate(key string) {
+	if s.Cache != nil {
+		s.Cache.Invalidate(key)
+	}
+}
+
+func (s *Store) mirror(key string) {
+	if s.Mirror != nil {
+		s.Mirror.Send(key)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	buf, err := EncodeCompact(&Item{Value: []byte("hello"), Flags: "42", Token: "1234567890"})
+	if err != nil {
+		t.Fatalf("EncodeCompact %+v", err)
+	}
+	item, err := DecodeCompact(buf)
+	if err != nil {
+		t.Fatalf("DecodeCompact %+v", err)
+	}
+	if !bytes.Equal(item.Value, []byte("hello")) {
+		t.Errorf("Value %s", item.Value)
+	}
+	if item.Flags != "42" {
+		t.Errorf("Flags %s", item.Flags)
+	}
+	if item.Token != "1234567890" {
+		t.Errorf("Token %s", item.Token)
+	}
+	if _, err = EncodeCompact(&Item{Flags: "abc"}); err != ErrInvalidFlags {
+		t.Errorf("EncodeCompact should fail with invalid flags")
+	}
+	if _, err = DecodeCompact([]byte("hello")); err != ErrCorruptedValue {
+		t.Errorf("DecodeCompact should fail with corrupted value")
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	ns, err := ParseNamespaces("", "sess:=compact, sess:admin:=hash")
+	if err != nil {
+		t.Fatalf("ParseNamespaces %+v", err)
+	}
+	if l := ns.Layout("user:1"); l != LayoutHash {
+		t.Errorf("Layout %s", l)
+	}
+	if l := ns.Layout("sess:1"); l != LayoutCompact {
+		t.Errorf("Layout %s", l)
+	}
+	if l := ns.Layout("sess:admin:1"); l != LayoutHash {
+		t.Errorf("Layout %s", l)
+	}
+	if _, err = ParseNamespaces("", "sess:=tiny"); err != ErrInvalidLayout {
+		t.Errorf("ParseNamespaces should fail with invalid layout")
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	client := fake.Client()
+	defer client.Close()
+	ctx := context.Background()
+	s := &Store{Redis: client}
+
+	if err := s.Set(ctx, "a", &Item{Value: []byte("1"), Flags: "0", Token: "1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, "a", &Item{Value: []byte("2"), Flags: "0", Token: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := client.PTTL(ctx, "a").Val(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("bad ttl: %v", ttl)
+	}
+	if err := s.Set(ctx, "b", &Item{Value: []byte("1"), Flags: "0", Token: "1"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, "b", &Item{Value: []byte("2"), Flags: "0", Token: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := client.PTTL(ctx, "b").Val(); ttl != -1 {
+		t.Errorf("bad ttl: %v", ttl)
+	}
+	// deleted since read
+	if err := s.Update(ctx, "c", &Item{Value: []byte("2"), Flags: "0", Token: "1"}); err != ErrNotFound {
+		t.Errorf("should not be found: %v", err)
+	}
+	if n := client.Exists(ctx, "c").Val(); n != 0 {
+		t.Error("should not be resurrected")
+	}
+	if err := s.Touch(ctx, "c", time.Hour); err != ErrNotFound {
+		t.Errorf("should not be found: %v", err)
+	}
+	if err := s.Touch(ctx, "a", time.Minute); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const tlsHandshakeTimeout = time.Second * 10
+
+// TLSCerts holds the server certificate and client ca, they can be reloaded without restart
+type TLSCerts struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// Load loads or reloads files
+func (c *TLSCerts) Load() (err error) {
+	var cert tls.Certificate
+	if cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return
+	}
+	var pool *x509.CertPool
+	if c.ClientCAFile != "" {
+		var buf []byte
+		if buf, err = ioutil.ReadFile(c.ClientCAFile); err != nil {
+			return
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return errors.New("no certificate found in " + c.ClientCAFile)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.clientCA = pool
+	return
+}
+
+// Config returns tls config using the latest loaded files,
+// client certificates are verified if given, but not required
+func (c *TLSCerts) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clientCA != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = c.clientCA
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// tlsUser returns common name of the verified client certificate, or empty
+func tlsUser(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLSCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := newTestCert(t, "ca", nil, nil)
+	_, _, serverPEM, serverKeyPEM := newTestCert(t, "server", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := newTestCert(t, "batch", ca, caKey)
+	for name, buf := range map[string][]byte{"ca.pem": caPEM, "server.pem": serverPEM, "server-key.pem": serverKeyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs := &TLSCerts{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	if err := certs.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		_ = tls.Client(clientConn, &tls.Config{
+			ServerName:   "server",
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{clientCert},
+			// server name is not in the certificate, it's not verified
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+	server := tls.Server(serverConn, certs.Config())
+	if err = server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if user := tlsUser(server.ConnectionState()); user != "batch" {
+		t.Errorf("bad tls user: %s", user)
+	}
+
+	certs.ClientCAFile = filepath.Join(dir, "missing.pem")
+	if err = certs.Load(); err == nil {
+		t.Error("should fail")
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v8"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+
+	// TraceKeyPrefix marks a key carrying trace context, "@trace:<trace-id>[-<parent-span-id>]:<key>"
+	TraceKeyPrefix = "@trace:"
+
+	traceBatchSize = 512
+	traceQueueSize = 4096
+)
+
+// TraceID is a w3c trace id
+type TraceID [16]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID is a w3c span id
+type SpanID [8]byte
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsZero returns whether id is all zero
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+// ParseTraceKey extracts trace context from key, returns the key untouched if there is no valid trace context
+func ParseTraceKey(key string) (string, TraceID, SpanID, bool) {
+	var (
+		traceID TraceID
+		spanID  SpanID
+	)
+	if !strings.HasPrefix(key, TraceKeyPrefix) {
+		return key, traceID, spanID, false
+	}
+	s := key[len(TraceKeyPrefix):]
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return key, traceID, spanID, false
+	}
+	ctx := s[:i]
+	if j := strings.IndexByte(ctx, '-'); j >= 0 {
+		if n, err := hex.Decode(spanID[:], []byte(ctx[j+1:])); err != nil || n != len(spanID) || j+1+hex.EncodedLen(len(spanID)) != len(ctx) {
+			return key, traceID, spanID, false
+		}
+		ctx = ctx[:j]
+	}
+	if len(ctx) != hex.EncodedLen(len(traceID)) {
+		return key, traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(ctx)); err != nil || traceID == (TraceID{}) {
+		return key, traceID, spanID, false
+	}
+	return s[i+1:], traceID, spanID, true
+}
+
+// Span is a finished or ongoing span, a nil span is a no-op
+type Span struct {
+	TraceID  TraceID
+	SpanID   SpanID
+	ParentID SpanID
+	Name     string
+	Kind     int
+	Start    time.Time
+	End      time.Time
+	Attrs    map[string]interface{}
+	Err      error
+
+	tracer *Tracer
+}
+
+// SetAttr sets an attribute of span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attrs == nil {
+		s.Attrs = map[string]interface{}{}
+	}
+	s.Attrs[key] = value
+}
+
+// Finish ends span with an optional error and queues it for export
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	s.Err = err
+	s.tracer.enqueue(s)
+}
+
+type spanContextKey struct{}
+
+type redisSpanContextKey struct{}
+
+// SpanFromContext returns the current span of ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a child span of the current span of ctx, it's a no-op if ctx is not traced
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		TraceID:  parent.TraceID,
+		SpanID:   newSpanID(),
+		ParentID: parent.SpanID,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		tracer:   parent.tracer,
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func newSpanID() (id SpanID) {
+	_, _ = rand.Read(id[:])
+	return
+}
+
+func newTraceID() (id TraceID) {
+	_, _ = rand.Read(id[:])
+	return
+}
+
+// Tracer samples and exports spans over OTLP/HTTP with JSON encoding
+type Tracer struct {
+	// Endpoint is the OTLP/HTTP endpoint, spans are posted to Endpoint + "/v1/traces"
+	Endpoint    string
+	ServiceName string
+
+	// ratio is the sampling ratio of commands without trace context, in float64 bits
+	ratio  uint64
+	client *http.Client
+	queue  chan *Span
+}
+
+// NewTracer creates a tracer
+func NewTracer(endpoint, serviceName string, ratio float64) *Tracer {
+	return &Tracer{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		ServiceName: serviceName,
+		ratio:       math.Float64bits(ratio),
+		client:      &http.Client{Timeout: time.Second * 10},
+		queue:       make(chan *Span, traceQueueSize),
+	}
+}
+
+// Ratio returns the sampling ratio
+func (t *Tracer) Ratio() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&t.ratio))
+}
+
+// SetRatio changes the sampling ratio
+func (t *Tracer) SetRatio(ratio float64) {
+	atomic.StoreUint64(&t.ratio, math.Float64bits(ratio))
+}
+
+// Start starts a root span, it's a no-op if tracer is nil or the trace is not sampled;
+// traces continued from a client's trace context are always sampled
+func (t *Tracer) Start(ctx context.Context, name string, traceID TraceID, parentID SpanID) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	if traceID == (TraceID{}) {
+		if ratio := t.Ratio(); ratio < 1 && mrand.Float64() >= ratio {
+			return ctx, nil
+		}
+		traceID = newTraceID()
+	}
+	span := &Span{
+		TraceID:  traceID,
+		SpanID:   newSpanID(),
+		ParentID: parentID,
+		Name:     name,
+		Kind:     SpanKindServer,
+		Start:    time.Now(),
+		tracer:   t,
+	}
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		stats.TraceSpansDropped.Add(1)
+	}
+}
+
+// Run exports queued spans in batches every interval, until ctx is done
+func (t *Tracer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.Export(context.Background(), batch); err != nil {
+			stats.TraceSpansDropped.Add(int64(len(batch)))
+			logger.Warn("failed to export spans", "spans", len(batch), "err", err)
+		} else {
+			stats.TraceSpansExported.Add(int64(len(batch)))
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		case span := <-t.queue:
+			if batch = append(batch, span); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func newOTLPAttr(key string, value interface{}) otlpAttr {
+	attr := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case string:
+		attr.Value.StringValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	default:
+		s := logValue(v)
+		str, ok := s.(string)
+		if !ok {
+			b, _ := json.Marshal(s)
+			str = string(b)
+		}
+		attr.Value.StringValue = &str
+	}
+	return attr
+}
+
+// MarshalOTLP encodes spans as an OTLP/JSON ExportTraceServiceRequest
+func (t *Tracer) MarshalOTLP(spans []*Span) ([]byte, error) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		o := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if !span.ParentID.IsZero() {
+			o.ParentSpanID = span.ParentID.String()
+		}
+		for k, v := range span.Attrs {
+			o.Attributes = append(o.Attributes, newOTLPAttr(k, v))
+		}
+		if span.Err != nil {
+			o.Status = otlpStatus{Code: 2, Message: span.Err.Error()}
+		}
+		out = append(out, o)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{newOTLPAttr("service.name", t.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "redmemd"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	})
+}
+
+// Export posts spans to the OTLP endpoint
+func (t *Tracer) Export(ctx context.Context, spans []*Span) (err error) {
+	var body []byte
+	if body, err = t.MarshalOTLP(spans); err != nil {
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.Endpoint+"/v1/traces", bytes.NewReader(body)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res *http.Response
+	if res, err = t.client.Do(req); err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		err = errors.New("otlp endpoint returned " + res.Status)
+	}
+	return
+}
+
+// TracingHook creates a child span for every redis call of a traced context
+type TracingHook struct{}
+
+var _ redis.Hook = TracingHook{}
+
+func (TracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	_, span := StartSpan(ctx, "redis "+cmd.Name(), SpanKindClient)
+	span.SetAttr("db.system", "redis")
+	span.SetAttr("db.operation", cmd.Name())
+	return context.WithValue(ctx, redisSpanContextKey{}, span), nil
+}
+
+func (TracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if span, ok := ctx.Value(redisSpanContextKey{}).(*Span); ok {
+		span.Finish(redisSpanError(cmd.Err()))
+	}
+	return nil
+}
+
+func (TracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	names := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		names = append(names, cmd.Name())
+	}
+	_, span := StartSpan(ctx, "redis pipeline", SpanKindClient)
+	span.SetAttr("db.system", "redis")
+	span.SetAttr("db.operation", strings.Join(names, " "))
+	return context.WithValue(ctx, redisSpanContextKey{}, span), nil
+}
+
+func (TracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if span, ok := ctx.Value(redisSpanContextKey{}).(*Span); ok {
+		var err error
+		for _, cmd := range cmds {
+			if err = redisSpanError(cmd.Err()); err != nil {
+				break
+			}
+		}
+		span.Finish(err)
+	}
+	return nil
+}
+
+// redisSpanError ignores redis.Nil, a missing key is not a failure
+func redisSpanError(err error) error {
+	if err == redis.Nil {
+		return nil
+	}
+	return err
+}
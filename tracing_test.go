@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceKey(t *testing.T) {
+	key, traceID, spanID, ok := ParseTraceKey("@trace:0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331:user:1")
+	if !ok || key != "user:1" || traceID.String() != "0af7651916cd43dd8448eb211c80319c" || spanID.String() != "b7ad6b7169203331" {
+		t.Errorf("bad trace key: %s %s %s %v", key, traceID, spanID, ok)
+	}
+	key, traceID, spanID, ok = ParseTraceKey("@trace:0af7651916cd43dd8448eb211c80319c:user:1")
+	if !ok || key != "user:1" || traceID.String() != "0af7651916cd43dd8448eb211c80319c" || !spanID.IsZero() {
+		t.Errorf("bad trace key without parent: %s %s %s %v", key, traceID, spanID, ok)
+	}
+	for _, k := range []string{
+		"user:1",
+		"@trace:user:1",
+		"@trace:0af7651916cd43dd8448eb211c80319c",
+		"@trace:00000000000000000000000000000000:user:1",
+		"@trace:0af7651916cd43dd8448eb211c80319c-b7ad:user:1",
+		"@trace:0af7651916cd43dd8448eb211c8031zz:user:1",
+	} {
+		if key, _, _, ok = ParseTraceKey(k); ok || key != k {
+			t.Errorf("should not parse %s", k)
+		}
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	var nilTracer *Tracer
+	if _, span := nilTracer.Start(context.Background(), "get", TraceID{}, SpanID{}); span != nil {
+		t.Error("nil tracer should not trace")
+	}
+	tr := NewTracer("http://127.0.0.1", "redmemd", 0)
+	if _, span := tr.Start(context.Background(), "get", TraceID{}, SpanID{}); span != nil {
+		t.Error("ratio 0 should not sample")
+	}
+	if _, span := tr.Start(context.Background(), "get", TraceID{1}, SpanID{2}); span == nil || span.TraceID != (TraceID{1}) || span.ParentID != (SpanID{2}) {
+		t.Error("client trace context should always be sampled")
+	}
+	if _, span := StartSpan(context.Background(), "lock", SpanKindInternal); span != nil {
+		t.Error("untraced context should not start span")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" {
+			t.Errorf("bad path %s", req.URL.Path)
+		}
+		buf, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(buf, &body); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	tr := NewTracer(server.URL+"/", "redmemd", 1)
+	ctx, root := tr.Start(context.Background(), "memcached get", TraceID{}, SpanID{})
+	_, child := StartSpan(ctx, "redis hgetall", SpanKindClient)
+	child.SetAttr("db.system", "redis")
+	child.Finish(nil)
+	root.Finish(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Run(ctx, time.Hour)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	<-done
+
+	spans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("bad spans: %v", spans)
+	}
+	c, r := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+	if c["traceId"] != r["traceId"] || c["parentSpanId"] != r["spanId"] || r["parentSpanId"] != nil {
+		t.Errorf("bad span relation: %v %v", c, r)
+	}
+	if c["kind"] != float64(SpanKindClient) || r["kind"] != float64(SpanKindServer) {
+		t.Errorf("bad span kind: %v %v", c, r)
+	}
+}
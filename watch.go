@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.guoyk.net/redmemd/memwire"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// watchBufferSize is the number of lines buffered for a watcher, lines are dropped beyond it
+	watchBufferSize = 1024
+	// watchCheckInterval is the interval of checking whether a watching session is draining
+	watchCheckInterval = time.Second
+)
+
+// WatchFilter selects commands streamed to a watcher
+type WatchFilter struct {
+	// Commands are commands to watch, any if empty
+	Commands map[string]bool
+	// Prefix is the key prefix to watch, any if empty
+	Prefix string
+	// Network is the client network to watch, any if nil
+	Network *net.IPNet
+}
+
+// ParseWatchFilter parses arguments of watch command, which are any of
+// "fetchers", "mutations", "all", a command name, "key=<prefix>" and "client=<ip or cidr>"
+func ParseWatchFilter(args []string) (f WatchFilter, err error) {
+	f.Commands = map[string]bool{}
+	for _, arg := range args {
+		switch {
+		case arg == "all":
+		case arg == "fetchers":
+			f.Commands["get"] = true
+			f.Commands["gets"] = true
+		case arg == "mutations":
+			for _, command := range []string{"set", "cas", "add", "replace", "append", "prepend", "incr", "decr", "delete", "touch", "flush_all"} {
+				f.Commands[command] = true
+			}
+		case strings.HasPrefix(arg, "key="):
+			f.Prefix = strings.TrimPrefix(arg, "key=")
+		case strings.HasPrefix(arg, "client="):
+			var networks []*net.IPNet
+			if networks, err = ParseNetworks(strings.TrimPrefix(arg, "client=")); err != nil {
+				return
+			}
+			if len(networks) != 1 {
+				err = errors.New("invalid watch client: " + arg)
+				return
+			}
+			f.Network = networks[0]
+		case isWatchableCommand(arg):
+			f.Commands[arg] = true
+		default:
+			err = errors.New("invalid watch argument: " + arg)
+			return
+		}
+	}
+	return
+}
+
+// isWatchableCommand returns whether command is a fetch or a mutation, other commands are never streamed
+func isWatchableCommand(command string) bool {
+	switch command {
+	case "get", "gets":
+		return true
+	}
+	return isMutatingCommand(command)
+}
+
+// Matches returns whether a command should be streamed
+func (f WatchFilter) Matches(command string, keys []string, ip net.IP) bool {
+	if !isWatchableCommand(command) {
+		return false
+	}
+	if len(f.Commands) > 0 && !f.Commands[command] {
+		return false
+	}
+	if f.Network != nil && (ip == nil || !f.Network.Contains(ip)) {
+		return false
+	}
+	if f.Prefix != "" {
+		for _, key := range keys {
+			if strings.HasPrefix(key, f.Prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Watcher receives lines of matching commands
+type Watcher struct {
+	Filter WatchFilter
+
+	ch      chan string
+	dropped int64
+}
+
+// send queues line without blocking, it's dropped if buffer is full
+func (w *Watcher) send(line string) {
+	select {
+	case w.ch <- line:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		stats.WatchLinesDropped.Add(1)
+	}
+}
+
+// Watchers is the registry of watchers
+type Watchers struct {
+	count int32
+
+	mu    sync.RWMutex
+	items map[*Watcher]struct{}
+}
+
+var watchers = &Watchers{items: map[*Watcher]struct{}{}}
+
+// Add registers a new watcher
+func (ws *Watchers) Add(f WatchFilter) *Watcher {
+	w := &Watcher{Filter: f, ch: make(chan string, watchBufferSize)}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.items[w] = struct{}{}
+	atomic.StoreInt32(&ws.count, int32(len(ws.items)))
+	return w
+}
+
+// Remove unregisters a watcher
+func (ws *Watchers) Remove(w *Watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.items, w)
+	atomic.StoreInt32(&ws.count, int32(len(ws.items)))
+}
+
+// Publish sends a command to matching watchers, line is only formatted if any watcher matches
+func (ws *Watchers) Publish(command string, keys []string, ip net.IP, line func() string) {
+	if atomic.LoadInt32(&ws.count) == 0 {
+		return
+	}
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	var s string
+	for w := range ws.items {
+		if !w.Filter.Matches(command, keys, ip) {
+			continue
+		}
+		if s == "" {
+			s = line()
+		}
+		w.send(s)
+	}
+}
+
+func watchTimestamp(t time.Time) string {
+	return "ts=" + strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', 6, 64)
+}
+
+// watchLine formats a command processed
+func (rt *RoundTripper) watchLine(start time.Time, latency time.Duration) string {
+	return strings.Join([]string{
+		watchTimestamp(start),
+		"conn=" + strconv.FormatInt(rt.Session.ID, 10),
+		"remote=" + rt.Session.RemoteAddr,
+		"user=" + rt.Session.User,
+		"command=" + rt.Command,
+		"keys=" + strings.Join(rt.keys(), ","),
+		"value_size=" + strconv.Itoa(len(rt.Data)+rt.valueSize),
+		"latency_ms=" + strconv.FormatFloat(float64(latency.Microseconds())/1000, 'f', 3, 64),
+		"result=" + rt.code,
+	}, " ")
+}
+
+// watch turns connection into a stream of matching commands, until client closes connection, session drains or ctx is done
+func (rt *RoundTripper) watch(ctx context.Context) (err error) {
+	var filter WatchFilter
+	if filter, err = ParseWatchFilter(rt.Keys); err != nil {
+		return rt.ReplyCode(memwire.CodeClientErr, err.Error())
+	}
+	// force send response
+	rt.Noreply = false
+	if err = rt.ReplyCode(memwire.CodeOK); err != nil {
+		return
+	}
+
+	w := watchers.Add(filter)
+	defer watchers.Remove(w)
+
+	// nothing is expected from client, reading only detects closed connection
+	conn := rt.Session.conn
+	_ = conn.SetReadDeadline(time.Time{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		buf := make([]byte, 512)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		_ = conn.SetReadDeadline(time.Now())
+		<-closed
+	}()
+
+	ticker := time.NewTicker(watchCheckInterval)
+	defer ticker.Stop()
+
+	out := rt.ResponseWriter
+	for {
+		select {
+		case <-ctx.Done():
+			return io.EOF
+		case <-closed:
+			return io.EOF
+		case <-ticker.C:
+			if rt.Session.Draining() {
+				return io.EOF
+			}
+		case line := <-w.ch:
+			// write lines already queued in one flush
+			for n := len(w.ch); ; n-- {
+				if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+					_, _ = out.WriteString(watchTimestamp(time.Now()) + " dropped=" + strconv.FormatInt(dropped, 10) + "\r\n")
+				}
+				_, _ = out.WriteString(line + "\r\n")
+				if n <= 0 {
+					break
+				}
+				line = <-w.ch
+			}
+			_ = conn.SetWriteDeadline(deadline(limits.WriteTimeout()))
+			if err = out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
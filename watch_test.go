@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWatchFilter(t *testing.T) {
+	f, err := ParseWatchFilter([]string{"fetchers", "delete", "key=user:", "client=10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.1.2.3")
+	for _, c := range []struct {
+		command string
+		keys    []string
+		ip      net.IP
+		ok      bool
+	}{
+		{"get", []string{"session:1", "user:1"}, ip, true},
+		{"delete", []string{"user:1"}, ip, true},
+		{"set", []string{"user:1"}, ip, false},
+		{"get", []string{"session:1"}, ip, false},
+		{"get", []string{"user:1"}, net.ParseIP("192.168.1.1"), false},
+		{"get", []string{"user:1"}, nil, false},
+	} {
+		if ok := f.Matches(c.command, c.keys, c.ip); ok != c.ok {
+			t.Errorf("Matches %s %v %s = %v", c.command, c.keys, c.ip, ok)
+		}
+	}
+
+	if f, err = ParseWatchFilter(nil); err != nil || !f.Matches("flush_all", nil, nil) {
+		t.Errorf("empty filter should match everything: %v", err)
+	}
+	for _, command := range []string{"stats", "version", "verbosity", "lru_crawler"} {
+		if f.Matches(command, nil, nil) {
+			t.Errorf("%s should never be streamed", command)
+		}
+	}
+	for _, args := range [][]string{{"foo"}, {"client=bad"}, {"stats"}, {"version"}, {"quit"}, {"gat"}} {
+		if _, err = ParseWatchFilter(args); err == nil {
+			t.Errorf("ParseWatchFilter %v should fail", args)
+		}
+	}
+}
+
+func TestWatchers(t *testing.T) {
+	ws := &Watchers{items: map[*Watcher]struct{}{}}
+	ws.Publish("get", []string{"a"}, nil, func() string {
+		t.Error("line should not be formatted without watchers")
+		return ""
+	})
+
+	mutations, _ := ParseWatchFilter([]string{"mutations"})
+	w := ws.Add(mutations)
+	ws.Publish("get", []string{"a"}, nil, func() string {
+		t.Error("line should not be formatted without matching watchers")
+		return ""
+	})
+	for i := 0; i < watchBufferSize+3; i++ {
+		ws.Publish("set", []string{"a"}, nil, func() string { return "line" })
+	}
+	if len(w.ch) != watchBufferSize || w.dropped != 3 {
+		t.Errorf("bad buffered %d, dropped %d", len(w.ch), w.dropped)
+	}
+	ws.Remove(w)
+	if ws.count != 0 {
+		t.Errorf("bad count %d", ws.count)
+	}
+}